@@ -5,54 +5,49 @@ import (
 	"crypto/ed25519"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
+	"encoding/pem"
 	"flag"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
-	"regexp"
-	"runtime"
 	"strings"
-	"sync"
 	"syscall"
+	"time"
 
 	"github.com/gologme/log"
 	gsyslog "github.com/hashicorp/go-syslog"
 	"github.com/hjson/hjson-go/v4"
-	"github.com/things-go/go-socks5"
 
 	"github.com/yggdrasil-network/yggdrasil-go/src/address"
-	"github.com/yggdrasil-network/yggdrasil-go/src/admin"
 	"github.com/yggdrasil-network/yggdrasil-go/src/config"
-	"github.com/yggdrasil-network/yggdrasil-go/src/core"
-	"github.com/yggdrasil-network/yggdrasil-go/src/multicast"
 	"github.com/yggdrasil-network/yggdrasil-go/src/version"
 
 	"github.com/yggdrasil-network/yggstack/src/netstack"
 	"github.com/yggdrasil-network/yggstack/src/types"
-
-	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"github.com/yggdrasil-network/yggstack/src/yggstack"
 )
 
-type node struct {
-	core           *core.Core
-	multicast      *multicast.Multicast
-	admin          *admin.AdminSocket
-	socks5Listener net.Listener
-}
-
-type UDPSession struct {
-	conn       interface{}
-	remoteAddr net.Addr
-}
-
 // The main function is responsible for configuring and starting Yggdrasil.
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "nc":
+			os.Exit(nc(os.Args[2:]))
+		case "perf":
+			os.Exit(perf(os.Args[2:]))
+		}
+	}
+
 	var localtcp types.TCPLocalMappings
 	var localudp types.UDPLocalMappings
 	var remotetcp types.TCPRemoteMappings
 	var remoteudp types.UDPRemoteMappings
+	var servehttp types.HTTPMappings
+	var sshallowkeys types.PublicKeys
+	tcpoptions := netstack.DefaultTCPOptions()
+	var limits types.Limits
+	socksusers := yggstack.SOCKSUsers{}
 	genconf := flag.Bool("genconf", false, "print a new config to stdout")
 	useconf := flag.Bool("useconf", false, "read HJSON/JSON config from stdin")
 	useconffile := flag.String("useconffile", "", "read HJSON/JSON config from specified file path")
@@ -64,14 +59,53 @@ func main() {
 	logto := flag.String("logto", "stdout", "file path to log to, \"syslog\" or \"stdout\"")
 	getaddr := flag.Bool("address", false, "use in combination with either -useconf or -useconffile, outputs your IPv6 address")
 	getsnet := flag.Bool("subnet", false, "use in combination with either -useconf or -useconffile, outputs your IPv6 subnet")
+	gencert := flag.Bool("gencert", false, "use in combination with either -useconf or -useconffile, outputs a certificate for <public-key>.pk.ygg signed by your private key, followed by the key, in PEM format")
+	certhosts := flag.String("cert-hosts", "", "use in combination with -gencert, comma-separated names to also include under <public-key>.pk.ygg, i.e. www,*")
+	certvalidity := flag.Duration("cert-validity", types.NodeCertificateValidity, "use in combination with -gencert, how long the certificate is valid")
 	getpkey := flag.Bool("publickey", false, "use in combination with either -useconf or -useconffile, outputs your public key")
 	loglevel := flag.String("loglevel", "info", "loglevel to enable")
 	socks := flag.String("socks", "", "address to listen on for SOCKS, i.e. :1080; or UNIX socket file path, i.e. /tmp/yggstack.sock")
 	nameserver := flag.String("nameserver", "", "the Yggdrasil IPv6 address to use as a DNS server for SOCKS")
-	flag.Var(&localtcp, "local-tcp", "TCP ports to forward to the remote Yggdradil node, e.g. 22:[a:b:c:d]:22, 127.0.0.1:22:[a:b:c:d]:22")
+	flag.Var(&localtcp, "local-tcp", "TCP ports to forward to the remote Yggdradil node, e.g. 22:[a:b:c:d]:22, 127.0.0.1:22:[a:b:c:d]:22; further targets and options such as policy=failover or tls follow after commas")
 	flag.Var(&localudp, "local-udp", "UDP ports to forward to the remote Yggdrasil node, e.g. 22:[a:b:c:d]:2022, 127.0.0.1:[a:b:c:d]:22")
-	flag.Var(&remotetcp, "remote-tcp", "TCP ports to expose to the network, e.g. 22, 2022:22, 22:192.168.1.1:2022")
-	flag.Var(&remoteudp, "remote-udp", "UDP ports to expose to the network, e.g. 22, 2022:22, 22:192.168.1.1:2022")
+	flag.Var(&remotetcp, "remote-tcp", "TCP ports to expose to the network, e.g. 22, 2022:22, 22:192.168.1.1, 22:192.168.1.1:2022, [<subnet-address>]:22:192.168.1.1:2022; further targets and options such as policy=failover, tls or sni=<server-name>=<address>:<port> follow after commas")
+	flag.Var(&remoteudp, "remote-udp", "UDP ports to expose to the network, e.g. 22, 2022:22, 22:192.168.1.1, 22:192.168.1.1:2022, [<subnet-address>]:22:192.168.1.1:2022")
+	flag.Var(&servehttp, "serve-http", "serve HTTP on the network from a directory or a local backend, e.g. 80:/var/www, 80:http://127.0.0.1:8080, 80:app.example.ygg=http://127.0.0.1:8081")
+	sshport := flag.Int("ssh", 0, "Yggdrasil TCP port to serve SSH on for shells, commands and port forwarding over the network, i.e. 22")
+	sshauthorizedkeys := flag.String("ssh-authorized-keys", "", "use in combination with -ssh, OpenSSH authorized_keys file, without options, with the keys of the users allowed to log in")
+	flag.Var(&sshallowkeys, "ssh-allow-key", "use in combination with -ssh, public key of a remote node whose users may log in without an SSH key, can be repeated")
+	sshshell := flag.String("ssh-shell", "", "use in combination with -ssh, shell to run commands with instead of $SHELL")
+	routerlink := flag.String("router-link", "", "route your IPv6 subnet to a network segment exchanging raw IPv6 packets over UDP on this address, i.e. [::]:9999; or over an inherited datagram socket, i.e. fd:3")
+	routerpeer := flag.String("router-peer", "", "use in combination with -router-link, the UDP address to exchange packets with instead of the sender of the first packet")
+	tunname := flag.String("tun", "", "attach a TUN adapter with this name, i.e. ygg0, so that host applications can reach the network natively (Linux only)")
+	transparent := flag.String("transparent", "", "address to accept TCP connections and UDP datagrams for 200::/7 redirected by ip6tables REDIRECT or TPROXY on, i.e. [::]:1081 (Linux only)")
+	pcap := flag.String("pcap", "", "file path to write packets exchanged with the network to in pcap format")
+	pcapfilter := flag.String("pcap-filter", "", "use in combination with -pcap, only capture matching packets, e.g. \"host 200::1 and tcp port 80\"")
+	pcapsize := flag.Int64("pcap-max-size", 0, "use in combination with -pcap, rotate the file when it reaches this many megabytes")
+	pcapfiles := flag.Int("pcap-max-files", 1, "use in combination with -pcap-max-size, number of rotated files to keep")
+	pcapdir := flag.String("pcap-dir", "", "directory the startCapture admin command may write captures to, which it names by file name only")
+	flag.StringVar(&tcpoptions.CongestionControl, "tcp-congestion", tcpoptions.CongestionControl, "TCP congestion control algorithm of the netstack, \"reno\" or \"cubic\"")
+	flag.BoolVar(&tcpoptions.SACK, "tcp-sack", tcpoptions.SACK, "enable TCP selective acknowledgements in the netstack")
+	flag.BoolVar(&tcpoptions.ModerateReceiveBuffer, "tcp-moderate-rcvbuf", tcpoptions.ModerateReceiveBuffer, "grow TCP receive buffers of the netstack automatically within -tcp-rcvbuf")
+	flag.Var(&tcpoptions.ReceiveBuffer, "tcp-rcvbuf", "TCP receive buffer sizes of the netstack in bytes as min:default:max")
+	flag.Var(&tcpoptions.SendBuffer, "tcp-sndbuf", "TCP send buffer sizes of the netstack in bytes as min:default:max")
+	flag.Var(&tcpoptions.Keepalive, "tcp-keepalive", "TCP keep-alive of netstack connections as idle:interval:count, i.e. 2h:75s:9, or off")
+	flag.DurationVar(&tcpoptions.TimeWaitTimeout, "tcp-timewait", tcpoptions.TimeWaitTimeout, "how long closed TCP connections of the netstack stay in TIME_WAIT")
+	flag.IntVar(&tcpoptions.MaxInFlight, "tcp-max-inflight", tcpoptions.MaxInFlight, "maximum number of TCP connections being set up at once in each direction of the netstack, 0 for no limit")
+	udpidle := flag.Duration("udp-idle-timeout", types.DefaultUDPIdleTimeout, "close UDP mapping and transparent proxy sessions without traffic for this long")
+	udpmax := flag.Int("udp-max-sessions", types.DefaultUDPMaxSessions, "maximum number of sessions of each UDP mapping, evicting the least recently used one, 0 for no limit")
+	proxyidle := flag.Duration("proxy-idle-timeout", 0, "close proxied TCP connections of mappings after no data in either direction for this long, 0 for no limit")
+	mappingpolicy := flag.String("mapping-startup", "fatal", "what to do when a mapping can't be started with the node, \"fatal\" to exit or \"retry\" to keep retrying in the background")
+	flag.Var(&limits.Global, "limit", "bandwidth in bytes per second and connections of the node together as rate[:conns], i.e. 10M:500, 0 for no limit")
+	flag.Var(&limits.Mapping, "limit-mapping", "bandwidth in bytes per second and connections of each TCP mapping as rate[:conns], i.e. 2M:50")
+	flag.Var(&limits.SOCKSUser, "limit-socks-user", "bandwidth in bytes per second and connections of each SOCKS user, or client address without -socks-user, as rate[:conns]")
+	flag.Var(&limits.PublicKey, "limit-public-key", "bandwidth in bytes per second and connections of each remote Yggdrasil node as rate[:conns]")
+	flag.Var(socksusers, "socks-user", "require SOCKS authentication and allow this user as name:password, can be repeated")
+	socksusersfile := flag.String("socks-users-file", "", "require SOCKS authentication and allow the users of this file, with one name:password per line")
+	healthinterval := flag.Duration("health-interval", types.DefaultHealthInterval, "how often to dial the targets of TCP mappings with several targets to check if they are up, 0 to only notice failed connections")
+	healthtimeout := flag.Duration("health-timeout", types.DefaultHealthTimeout, "how long to wait for a dial to one of several mapping targets, for connections and health checks")
+	ejecttime := flag.Duration("eject-time", types.DefaultEjectTime, "how long to skip a mapping target after dialling it failed")
+	draintimeout := flag.Duration("drain-timeout", 10*time.Second, "on shutdown, how long to wait for open TCP connections and UDP sessions to finish before closing them")
 	flag.Parse()
 
 	// Catch interrupts from the operating system to exit gracefully.
@@ -150,6 +184,9 @@ func main() {
 	default:
 		fmt.Println("Usage:")
 		flag.PrintDefaults()
+		fmt.Println("\nSubcommands:")
+		fmt.Println("  nc\tconnect to or listen on a port on the network, like netcat, see yggstack nc -h")
+		fmt.Println("  perf\tmeasure throughput and latency to another node, like iperf, see yggstack perf -h")
 
 		if *getaddr || *getsnet {
 			fmt.Println("\nError: You need to specify some config data using -useconf or -useconffile.")
@@ -204,348 +241,170 @@ func main() {
 		}
 		fmt.Println(string(pem))
 		return
-	}
 
-	n := &node{}
-
-	// Setup the Yggdrasil node itself.
-	{
-		options := []core.SetupOption{
-			core.NodeInfo(cfg.NodeInfo),
-			core.NodeInfoPrivacy(cfg.NodeInfoPrivacy),
-		}
-		for _, addr := range cfg.Listen {
-			options = append(options, core.ListenAddress(addr))
-		}
-		for _, peer := range cfg.Peers {
-			options = append(options, core.Peer{URI: peer})
-		}
-		for intf, peers := range cfg.InterfacePeers {
-			for _, peer := range peers {
-				options = append(options, core.Peer{URI: peer, SourceInterface: intf})
-			}
-		}
-		for _, allowed := range cfg.AllowedPublicKeys {
-			k, err := hex.DecodeString(allowed)
-			if err != nil {
-				panic(err)
-			}
-			options = append(options, core.AllowedPublicKey(k[:]))
+	case *gencert:
+		options := types.CertificateOptions{Validity: *certvalidity}
+		if *certhosts != "" {
+			options.Hosts = strings.Split(*certhosts, ",")
 		}
-		if n.core, err = core.New(cfg.Certificate, logger, options...); err != nil {
+		cert, err := types.NodeCertificateWithOptions(privateKey, options)
+		if err != nil {
 			panic(err)
 		}
-		address, subnet := n.core.Address(), n.core.Subnet()
-		publicstr := hex.EncodeToString(n.core.PublicKey())
-		logger.Printf("Your public key is %s", publicstr)
-		logger.Printf("Your IPv6 address is %s", address.String())
-		logger.Printf("Your IPv6 subnet is %s", subnet.String())
-		logger.Printf("Your Yggstack resolver name is %s%s", publicstr, types.NameMappingSuffix)
-	}
-
-	// Setup the admin socket.
-	{
-		options := []admin.SetupOption{
-			admin.ListenAddress(cfg.AdminListen),
-		}
-		if cfg.LogLookups {
-			options = append(options, admin.LogLookups{})
-		}
-		if n.admin, err = admin.New(n.core, logger, options...); err != nil {
+		key, err := cfg.MarshalPEMPrivateKey()
+		if err != nil {
 			panic(err)
 		}
-		if n.admin != nil {
-			n.admin.SetupAdminHandlers()
-		}
+		fmt.Print(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})))
+		fmt.Print(string(key))
+		return
 	}
 
-	// Setup the multicast module.
-	{
-		options := []multicast.SetupOption{}
-		for _, intf := range cfg.MulticastInterfaces {
-			options = append(options, multicast.MulticastInterface{
-				Regex:    regexp.MustCompile(intf.Regex),
-				Beacon:   intf.Beacon,
-				Listen:   intf.Listen,
-				Port:     intf.Port,
-				Priority: uint8(intf.Priority),
-				Password: intf.Password,
-			})
-		}
-		if n.multicast, err = multicast.New(n.core, logger, options...); err != nil {
-			panic(err)
-		}
-		if n.admin != nil && n.multicast != nil {
-			n.multicast.SetupAdminHandlers(n.admin)
+	policy, err := yggstack.ParseMappingPolicy(*mappingpolicy)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *socksusersfile != "" {
+		if err := socksusers.ReadFile(*socksusersfile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
 	}
-
-	// Setup Yggdrasil netstack
-	s, err := netstack.CreateYggdrasilNetstack(n.core)
+	opts := []yggstack.SetupOption{
+		yggstack.Nameserver(*nameserver),
+		yggstack.TCP(tcpoptions),
+		yggstack.UDPSessions{IdleTimeout: *udpidle, MaxSessions: *udpmax},
+		yggstack.ProxyIdleTimeout(*proxyidle),
+		yggstack.Limits(limits),
+		yggstack.HealthChecks{Interval: *healthinterval, Timeout: *healthtimeout, EjectTime: *ejecttime},
+		socksusers,
+		policy,
+		yggstack.CaptureDirectory(*pcapdir),
+	}
+	n, err := yggstack.New(cfg, logger, opts...)
 	if err != nil {
 		panic(err)
 	}
 
 	// Create SOCKS server
-	{
-		if socks != nil && *socks != "" {
-			socksOptions := []socks5.Option{
-				socks5.WithDial(s.DialContext),
-			}
-			if nameserver != nil {
-				if *nameserver == "" {
-					logger.Infof("DNS nameserver is not set!")
-					logger.Infof("SOCKS server will not be able to resolve hostnames other than .pk.ygg !")
-				}
-				resolver := types.NewNameResolver(s, *nameserver)
-				socksOptions = append(socksOptions, socks5.WithResolver(resolver))
-			}
-			if logger.GetLevel("debug") {
-				socksOptions = append(socksOptions, socks5.WithLogger(logger))
-			}
-			server := socks5.NewServer(socksOptions...)
-			if strings.Contains(*socks, ":") {
-				logger.Infof("Starting SOCKS server on %s", *socks)
-				go server.ListenAndServe("tcp", *socks) // nolint:errcheck
-			} else {
-				logger.Infof("Starting SOCKS server with socket file %s", *socks)
-				n.socks5Listener, err = net.Listen("unix", *socks)
-				if err != nil {
-					// If address in use, try connecting to
-					// the socket to see if other yggstack
-					// instance is listening on it
-
-					if isErrorAddressAlreadyInUse(err) {
-						_, err = net.Dial("unix", *socks)
-						if err != nil {
-							// Unlink dead socket if not connected
-							err = os.RemoveAll(*socks)
-							if err != nil {
-								panic(err)
-							}
-						} else {
-							panic(fmt.Errorf("Another yggstack instance is listening on socket '%s'", *socks))
-						}
-					} else {
-						panic(err)
-					}
-				}
-				go server.Serve(n.socks5Listener) // nolint:errcheck
-			}
+	if socks != nil && *socks != "" {
+		if err = n.AddSOCKSServer(*socks); err != nil {
+			panic(err)
 		}
 	}
 
 	// Create local TCP mappings (forwarding connections from local port
 	// to remote Yggdrasil node)
-	{
-		for _, mapping := range localtcp {
-			go func(mapping types.TCPMapping) {
-				listener, err := net.ListenTCP("tcp", mapping.Listen)
-				if err != nil {
-					panic(err)
-				}
-				logger.Infof("Mapping local TCP port %d to Yggdrasil %s", mapping.Listen.Port, mapping.Mapped)
-				for {
-					c, err := listener.Accept()
-					if err != nil {
-						panic(err)
-					}
-					r, err := s.DialTCP(mapping.Mapped)
-					if err != nil {
-						logger.Errorf("Failed to connect to %s: %s", mapping.Mapped, err)
-						_ = c.Close()
-						continue
-					}
-					go types.ProxyTCP(n.core.MTU(), c, r)
-				}
-			}(mapping)
+	for _, mapping := range localtcp {
+		if err = n.AddLocalTCPMapping(mapping); err != nil {
+			panic(err)
 		}
 	}
 
 	// Create local UDP mappings (forwarding connections from local port
 	// to remote Yggdrasil node)
-	{
-		for _, mapping := range localudp {
-			go func(mapping types.UDPMapping) {
-				mtu := n.core.MTU()
-				udpListenConn, err := net.ListenUDP("udp", mapping.Listen)
-				if err != nil {
-					panic(err)
-				}
-				logger.Infof("Mapping local UDP port %d to Yggdrasil %s", mapping.Listen.Port, mapping.Mapped)
-				localUdpConnections := new(sync.Map)
-				udpBuffer := make([]byte, mtu)
-				for {
-					bytesRead, remoteUdpAddr, err := udpListenConn.ReadFrom(udpBuffer)
-					if err != nil {
-						if bytesRead == 0 {
-							continue
-						}
-					}
-
-					remoteUdpAddrStr := remoteUdpAddr.String()
-
-					connVal, ok := localUdpConnections.Load(remoteUdpAddrStr)
-
-					if !ok {
-						logger.Debugf("Creating new session for %s", remoteUdpAddr.String())
-						udpFwdConn, err := s.DialUDP(mapping.Mapped)
-						if err != nil {
-							logger.Errorf("Failed to connect to %s: %s", mapping.Mapped, err)
-							continue
-						}
-						udpSession := &UDPSession{
-							conn:       udpFwdConn,
-							remoteAddr: remoteUdpAddr,
-						}
-						localUdpConnections.Store(remoteUdpAddrStr, udpSession)
-						go types.ReverseProxyUDP(mtu, udpListenConn, remoteUdpAddr, udpFwdConn)
-					}
-
-					udpSession, ok := connVal.(*UDPSession)
-					if !ok {
-						continue
-					}
-
-					udpFwdConnPtr := udpSession.conn.(*gonet.UDPConn)
-					udpFwdConn := *udpFwdConnPtr
-
-					_, err = udpFwdConn.Write(udpBuffer[:bytesRead])
-					if err != nil {
-						logger.Debugf("Cannot write from yggdrasil to udp listener: %q", err)
-						udpFwdConn.Close()
-						localUdpConnections.Delete(remoteUdpAddrStr)
-						continue
-					}
-				}
-			}(mapping)
+	for _, mapping := range localudp {
+		if err = n.AddLocalUDPMapping(mapping); err != nil {
+			panic(err)
 		}
 	}
 
 	// Create remote TCP mappings (forwarding connections from Yggdrasil
 	// node to local port)
-	{
-		for _, mapping := range remotetcp {
-			go func(mapping types.TCPMapping) {
-				listener, err := s.ListenTCP(mapping.Listen)
-				if err != nil {
-					panic(err)
-				}
-				logger.Infof("Mapping Yggdrasil TCP port %d to %s", mapping.Listen.Port, mapping.Mapped)
-				for {
-					c, err := listener.Accept()
-					if err != nil {
-						panic(err)
-					}
-					r, err := net.DialTCP("tcp", nil, mapping.Mapped)
-					if err != nil {
-						logger.Errorf("Failed to connect to %s: %s", mapping.Mapped, err)
-						_ = c.Close()
-						continue
-					}
-					go types.ProxyTCP(n.core.MTU(), c, r)
-				}
-			}(mapping)
+	for _, mapping := range remotetcp {
+		if err = n.AddRemoteTCPMapping(mapping); err != nil {
+			panic(err)
 		}
 	}
 
 	// Create remote UDP mappings (forwarding connections from Yggdrasil
 	// node to local port)
-	{
-		for _, mapping := range remoteudp {
-			go func(mapping types.UDPMapping) {
-				mtu := n.core.MTU()
-				udpListenConn, err := s.ListenUDP(mapping.Listen)
-				if err != nil {
-					panic(err)
-				}
-				logger.Infof("Mapping Yggdrasil UDP port %d to %s", mapping.Listen.Port, mapping.Mapped)
-				remoteUdpConnections := new(sync.Map)
-				udpBuffer := make([]byte, mtu)
-				for {
-					bytesRead, remoteUdpAddr, err := udpListenConn.ReadFrom(udpBuffer)
-					if err != nil {
-						logger.Debugf("udp readFrom error: %v", err)
-					}
-					if bytesRead == 0 {
-						continue
-					}
-
-					remoteUdpAddrStr := remoteUdpAddr.String()
-
-					var udpSession *UDPSession = nil
-
-					connVal, ok := remoteUdpConnections.Load(remoteUdpAddrStr)
-
-					if !ok {
-						logger.Debugf("Creating new session for %s", remoteUdpAddr.String())
-						udpFwdConn, err := net.DialUDP("udp", nil, mapping.Mapped)
-						if err != nil {
-							logger.Errorf("Failed to connect to %s: %s", mapping.Mapped, err)
-							continue
-						}
-						udpSession = &UDPSession{
-							conn:       udpFwdConn,
-							remoteAddr: remoteUdpAddr,
-						}
-						remoteUdpConnections.Store(remoteUdpAddrStr, udpSession)
-						go types.ReverseProxyUDP(mtu, udpListenConn, remoteUdpAddr, udpFwdConn)
-					} else {
-						udpSession, ok = connVal.(*UDPSession)
-
-						if !ok {
-							continue
-						}
-					}
-
-					udpFwdConnPtr := udpSession.conn.(*net.UDPConn)
-					udpFwdConn := *udpFwdConnPtr
-
-					_, err = udpFwdConn.Write(udpBuffer[:bytesRead])
-					if err != nil {
-						logger.Debugf("Cannot write from yggdrasil to udp listener: %q", err)
-						udpFwdConn.Close()
-						remoteUdpConnections.Delete(remoteUdpAddrStr)
-						continue
-					}
-				}
-			}(mapping)
+	for _, mapping := range remoteudp {
+		if err = n.AddRemoteUDPMapping(mapping); err != nil {
+			panic(err)
 		}
 	}
 
-	// Block until we are told to shut down.
-	<-ctx.Done()
+	// Create HTTP servers (serving directories or local backends on
+	// Yggdrasil node ports)
+	for _, mapping := range servehttp {
+		if err = n.AddHTTPServer(mapping); err != nil {
+			panic(err)
+		}
+	}
 
-	// Shut down the node.
-	_ = n.admin.Stop()
-	_ = n.multicast.Stop()
-	if n.socks5Listener != nil {
-		_ = n.socks5Listener.Close()
-		_ = os.RemoveAll(*socks)
-		logger.Infof("Stopped UNIX socket listener")
+	// Create SSH server (serving shells and port forwarding on a Yggdrasil
+	// node port)
+	if *sshport != 0 {
+		options := yggstack.SSHServerOptions{
+			Listen:         &net.TCPAddr{Port: *sshport},
+			AuthorizedKeys: *sshauthorizedkeys,
+			AllowedKeys:    sshallowkeys,
+			Shell:          *sshshell,
+		}
+		if err = n.AddSSHServer(options); err != nil {
+			panic(err)
+		}
 	}
-	n.core.Stop()
-}
 
-// Helper to detect if socket address is in use
-// https://stackoverflow.com/a/52152912
-func isErrorAddressAlreadyInUse(err error) bool {
-	var eOsSyscall *os.SyscallError
-	if !errors.As(err, &eOsSyscall) {
-		return false
+	// Route the subnet to a network segment
+	if *routerlink != "" {
+		if err = n.AddRouterLink(*routerlink, *routerpeer); err != nil {
+			panic(err)
+		}
 	}
-	var errErrno syscall.Errno // doesn't need a "*" (ptr) because it's already a ptr (uintptr)
-	if !errors.As(eOsSyscall, &errErrno) {
-		return false
+
+	// Create transparent proxy (forwarding redirected connections to their
+	// original Yggdrasil destination)
+	if *transparent != "" {
+		if err = n.AddTransparentProxy(*transparent); err != nil {
+			panic(err)
+		}
+	}
+
+	// Attach a TUN adapter for the host
+	if *tunname != "" {
+		if err = n.AddTUN(*tunname); err != nil {
+			panic(err)
+		}
+	}
+
+	// Capture packets exchanged with the network
+	if *pcap != "" {
+		options := netstack.CaptureOptions{
+			Path:     *pcap,
+			MaxSize:  *pcapsize * 1024 * 1024,
+			MaxFiles: *pcapfiles,
+			Filter:   *pcapfilter,
+		}
+		if err = n.StartCapture(options); err != nil {
+			panic(err)
+		}
 	}
-	if errors.Is(errErrno, syscall.EADDRINUSE) {
-		return true
+
+	// The node is shut down below rather than by the signal context, so
+	// that open connections can finish.
+	if err = n.Start(context.Background()); err != nil {
+		logger.Errorf("Failed to start: %s", err)
+		os.Exit(1)
 	}
-	const WSAEADDRINUSE = 10048
-	if runtime.GOOS == "windows" && errErrno == WSAEADDRINUSE {
-		return true
+
+	// Block until we are told to shut down, or the node fails.
+	select {
+	case <-ctx.Done():
+		logger.Infof("Shutting down, draining connections for up to %s", *draintimeout)
+		drainCtx, cancel := context.WithTimeout(context.Background(), *draintimeout)
+		err = n.Shutdown(drainCtx)
+		cancel()
+		if err != nil {
+			logger.Warnf("Shutdown was not clean: %s", err)
+			os.Exit(2)
+		}
+	case <-n.Done():
+		logger.Errorf("Yggstack stopped: %s", n.Err())
+		os.Exit(1)
 	}
-	return false
 }
 
 // Helper to set logging level
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gologme/log"
+
+	"github.com/yggdrasil-network/yggstack/src/types"
+	"github.com/yggdrasil-network/yggstack/src/yggstack"
+)
+
+// nc connects to or listens on a port on the network and pipes standard
+// input and output through it, like netcat
+func nc(args []string) int {
+	fs := flag.NewFlagSet("nc", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: yggstack nc [flags] <address> <port>")
+		fmt.Fprintln(fs.Output(), "       yggstack nc -l [flags] [<address>] <port>")
+		fs.PrintDefaults()
+	}
+	node := addNodeFlags(fs)
+	udp := fs.Bool("u", false, "use UDP instead of TCP, with a datagram for each read of stdin")
+	listen := fs.Bool("l", false, "listen for a connection, or the datagrams of one node, instead of connecting")
+	wait := fs.Duration("w", 2*time.Second, "with -u, how long to wait for replies once stdin is closed")
+	_ = fs.Parse(args)
+
+	var host, port string
+	switch {
+	case fs.NArg() == 2:
+		host, port = fs.Arg(0), fs.Arg(1)
+	case fs.NArg() == 1 && *listen:
+		port = fs.Arg(0)
+	default:
+		fs.Usage()
+		return 2
+	}
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		fmt.Fprintf(os.Stderr, "Invalid port %q\n", port)
+		return 2
+	}
+	address := net.JoinHostPort(host, port)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	n, logger, err := node.start(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer n.Stop()
+
+	stdio := types.NewStdioConn(os.Stdin, os.Stdout, int(n.Core().MTU()))
+	switch {
+	case *listen && *udp:
+		err = ncListenUDP(ctx, n, stdio, address)
+	case *listen:
+		err = ncListenTCP(ctx, n, stdio, address)
+	case *udp:
+		err = ncDialUDP(ctx, n, logger, stdio, address, *wait)
+	default:
+		err = ncDialTCP(ctx, n, stdio, address)
+	}
+	if err != nil && ctx.Err() == nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func ncDialTCP(ctx context.Context, n *yggstack.Node, stdio *types.StdioConn, address string) error {
+	conn, err := n.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	return ncProxyTCP(n, stdio, conn)
+}
+
+func ncListenTCP(ctx context.Context, n *yggstack.Node, stdio *types.StdioConn, address string) error {
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return err
+	}
+	if addr.IP.IsUnspecified() {
+		addr.IP = nil
+	}
+	listener, err := n.ListenTCP(addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+	// Only one connection, like netcat
+	conn, err := listener.Accept()
+	_ = listener.Close()
+	if err != nil {
+		return err
+	}
+	return ncProxyTCP(n, stdio, conn)
+}
+
+// ncProxyTCP pipes stdin and stdout through the connection until both
+// directions are done
+func ncProxyTCP(n *yggstack.Node, stdio *types.StdioConn, conn net.Conn) error {
+	err := types.ProxyTCP(n.Core().MTU(), stdio, conn)
+	waitForTCPClose(n, 5*time.Second)
+	return err
+}
+
+// How long nc -u waits for the node to answer pings before sending anyway
+const pingTimeout = 10 * time.Second
+
+// ncDialUDP sends each read of stdin as a datagram through a session of
+// the UDP forwarder, with stdin and stdout as its client
+func ncDialUDP(ctx context.Context, n *yggstack.Node, logger *log.Logger, stdio *types.StdioConn, address string, wait time.Duration) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ips, err := n.Resolver().LookupAll(ctx, host)
+	if err != nil {
+		return err
+	}
+	address = net.JoinHostPort(ips[0].String(), port)
+	// Datagrams are lost until there are paths and a session between the
+	// nodes, which a ping sets up
+	pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+	_, err = n.Ping(pingCtx, ips[0])
+	cancel()
+	if err != nil {
+		logger.Warnf("No reply to pings from %s, sending anyway: %s", ips[0], err)
+	}
+
+	mtu := n.Core().MTU()
+	dial := func(net.Addr) (net.Conn, error) {
+		conn, err := n.DialContext(ctx, "udp", address)
+		if err != nil {
+			logger.Errorf("Failed to connect to %s: %s", address, err)
+		}
+		return conn, err
+	}
+	sessions := types.NewUDPSessionManager(mtu, stdio, dial, types.UDPSessionOptions{MaxSessions: 1})
+	defer sessions.Close() // nolint:errcheck
+	if err := types.ServeUDP(mtu, stdio, sessions); !errors.Is(err, io.EOF) {
+		return err
+	}
+	// Stop once no more replies arrive
+	for returned := uint64(math.MaxUint64); returned != sessions.Stats().PacketsReturned; {
+		returned = sessions.Stats().PacketsReturned
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+	}
+	return nil
+}
+
+// ncListenUDP exchanges datagrams with the first node to send one,
+// through a session of the UDP forwarder with stdin and stdout as its
+// target
+func ncListenUDP(ctx context.Context, n *yggstack.Node, stdio *types.StdioConn, address string) error {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	if addr.IP.IsUnspecified() {
+		addr.IP = nil
+	}
+	listener, err := n.ListenUDP(addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	var client net.Addr
+	dial := func(addr net.Addr) (net.Conn, error) {
+		if client != nil {
+			return nil, fmt.Errorf("already exchanging datagrams with %s", client)
+		}
+		client = addr
+		return stdio, nil
+	}
+	mtu := n.Core().MTU()
+	// The session ends with stdin rather than when idle
+	sessions := types.NewUDPSessionManager(mtu, listener, dial, types.UDPSessionOptions{
+		IdleTimeout: math.MaxInt64,
+		MaxSessions: 1,
+	})
+	defer sessions.Close()                     // nolint:errcheck
+	go types.ServeUDP(mtu, listener, sessions) // nolint:errcheck
+	select {
+	case <-ctx.Done():
+	case <-stdio.Done():
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/yggdrasil-network/yggstack/src/types"
+	"github.com/yggdrasil-network/yggstack/src/yggstack"
+)
+
+// perf measures the throughput and latency between two nodes over the
+// netstack, like iperf
+func perf(args []string) int {
+	fs := flag.NewFlagSet("perf", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: yggstack perf -server [flags]")
+		fmt.Fprintln(fs.Output(), "       yggstack perf -client <address> [flags]")
+		fs.PrintDefaults()
+	}
+	node := addNodeFlags(fs)
+	bitrate := types.Bitrate(1e6)
+	server := fs.Bool("server", false, "answer tests of clients")
+	client := fs.String("client", "", "run a test against the server at this Yggdrasil address or .pk.ygg name")
+	port := fs.Int("port", yggstack.DefaultPerfPort, "the Yggdrasil TCP and UDP port of the server")
+	udp := fs.Bool("u", false, "test with UDP datagrams at -bitrate instead of TCP")
+	streams := fs.Int("P", 1, "number of parallel streams")
+	duration := fs.Duration("t", 10*time.Second, "how long to send")
+	interval := fs.Duration("i", time.Second, "how often to report during the test")
+	length := fs.Int("l", 0, "size of writes, or of datagrams with -u (default 128K for TCP, 1232 for UDP)")
+	fs.Var(&bitrate, "bitrate", "with -u, bits per second over all streams, with an optional K, M or G suffix")
+	jsonout := fs.Bool("json", false, "print results as JSON")
+	_ = fs.Parse(args)
+
+	if *server == (*client != "") || fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	n, _, err := node.start(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer n.Stop()
+
+	if *server {
+		return perfServer(ctx, n, *port, *jsonout)
+	}
+	address := net.JoinHostPort(*client, strconv.Itoa(*port))
+	options := yggstack.PerfOptions{
+		UDP:      *udp,
+		Streams:  *streams,
+		Duration: *duration,
+		Interval: *interval,
+		Length:   *length,
+		Bitrate:  uint64(bitrate),
+	}
+	report := func(iv yggstack.PerfInterval) {
+		fmt.Printf("[%5.1f-%5.1f s]  %10s  %14s  %s\n", iv.Start, iv.End,
+			formatBytes(iv.Bytes), formatBits(iv.BitsPerSecond), formatRetransmits(iv.Retransmits))
+	}
+	if *jsonout {
+		report = nil
+	} else {
+		protocol := "TCP"
+		if *udp {
+			protocol = "UDP"
+		}
+		fmt.Printf("Testing %s over %s with %d streams\n", address, protocol, *streams)
+	}
+	result, err := n.Perf(ctx, address, options, report)
+	waitForTCPClose(n, 5*time.Second)
+	if err != nil {
+		if ctx.Err() == nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 1
+	}
+	if *jsonout {
+		return printJSON(result)
+	}
+	fmt.Printf("Latency %.2f ms\n", result.LatencyMs)
+	if len(result.Streams) > 1 {
+		for _, stream := range result.Streams {
+			printPerfStream(fmt.Sprintf("[%3d]", stream.Stream), stream, *udp)
+		}
+	}
+	printPerfStream("[SUM]", result.Sum, *udp)
+	fmt.Printf("Client %s\n", formatRetransmits(result.Retransmits))
+	fmt.Printf("Server %s\n", formatRetransmits(result.ServerRetransmits))
+	return 0
+}
+
+// perfServer answers tests until interrupted
+func perfServer(ctx context.Context, n *yggstack.Node, port int, jsonout bool) int {
+	if err := n.AddPerfServer(yggstack.PerfServerOptions{
+		Listen: port,
+		Results: func(remote net.Addr, r yggstack.PerfReport) {
+			if jsonout {
+				b, _ := json.Marshal(struct {
+					Remote string `json:"remote"`
+					yggstack.PerfReport
+				}{remote.String(), r})
+				fmt.Println(string(b))
+				return
+			}
+			var sum yggstack.PerfStream
+			for _, stream := range r.Streams {
+				sum.BytesReceived += stream.BytesReceived
+				sum.BitsPerSecond += stream.BitsPerSecond
+				sum.PacketsReceived += stream.PacketsReceived
+				sum.PacketsLost += stream.PacketsLost
+				sum.OutOfOrder += stream.OutOfOrder
+				sum.JitterMs += stream.JitterMs / float64(len(r.Streams))
+			}
+			fmt.Printf("Test from %s over %s with %d streams\n", remote, r.Protocol, len(r.Streams))
+			printPerfStream("[SUM]", sum, r.Protocol == "udp")
+			fmt.Printf("Server %s\n", formatRetransmits(r.Retransmits))
+		},
+	}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Serving perf tests on port %d of %s and %s%s\n",
+		port, n.Address(), hex.EncodeToString(n.PublicKey()), types.NameMappingSuffix)
+	select {
+	case <-ctx.Done():
+		return 0
+	case <-n.Done():
+		fmt.Fprintln(os.Stderr, n.Err())
+		return 1
+	}
+}
+
+func printJSON(v interface{}) int {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(string(b))
+	return 0
+}
+
+func printPerfStream(label string, stream yggstack.PerfStream, udp bool) {
+	if !udp {
+		sent := ""
+		if stream.BytesSent > 0 {
+			sent = "sent " + formatBytes(stream.BytesSent) + ", "
+		}
+		fmt.Printf("%s  %sreceived %s, %s\n", label, sent, formatBytes(stream.BytesReceived), formatBits(stream.BitsPerSecond))
+		return
+	}
+	lost := 0.0
+	if expected := stream.PacketsReceived + stream.PacketsLost; expected > 0 {
+		lost = float64(stream.PacketsLost) * 100 / float64(expected)
+	}
+	fmt.Printf("%s  received %s, %s, jitter %.3f ms, lost %d/%d datagrams (%.2f%%), %d out of order\n", label,
+		formatBytes(stream.BytesReceived), formatBits(stream.BitsPerSecond), stream.JitterMs,
+		stream.PacketsLost, stream.PacketsReceived+stream.PacketsLost, lost, stream.OutOfOrder)
+}
+
+func formatRetransmits(r yggstack.PerfRetransmits) string {
+	return fmt.Sprintf("retransmits %d (fast %d, slow start %d, timeouts %d)",
+		r.Retransmits, r.FastRetransmits, r.SlowStartRetransmits, r.Timeouts)
+}
+
+func formatBytes(b uint64) string {
+	switch {
+	case b >= 1<<30:
+		return fmt.Sprintf("%.2f GBytes", float64(b)/(1<<30))
+	case b >= 1<<20:
+		return fmt.Sprintf("%.2f MBytes", float64(b)/(1<<20))
+	default:
+		return fmt.Sprintf("%.2f KBytes", float64(b)/(1<<10))
+	}
+}
+
+func formatBits(bps float64) string {
+	switch {
+	case bps >= 1e9:
+		return fmt.Sprintf("%.2f Gbit/s", bps/1e9)
+	case bps >= 1e6:
+		return fmt.Sprintf("%.2f Mbit/s", bps/1e6)
+	default:
+		return fmt.Sprintf("%.2f Kbit/s", bps/1e3)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gologme/log"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/config"
+
+	"github.com/yggdrasil-network/yggstack/src/yggstack"
+)
+
+// nodeFlags are the flags of subcommands, which run a node of their own
+// for as long as the command runs
+type nodeFlags struct {
+	useconffile *string
+	nameserver  *string
+	loglevel    *string
+	peerwait    *time.Duration
+}
+
+func addNodeFlags(fs *flag.FlagSet) *nodeFlags {
+	return &nodeFlags{
+		useconffile: fs.String("useconffile", "", "read HJSON/JSON config from specified file path, for its keys and peers; without one a new key is used"),
+		nameserver:  fs.String("nameserver", "", "the Yggdrasil IPv6 address to use as a DNS server for names other than .pk.ygg"),
+		loglevel:    fs.String("loglevel", "warn", "loglevel to enable, logs are written to stderr"),
+		peerwait:    fs.Duration("peer-wait", 10*time.Second, "how long to wait for a connection to a peer before going ahead anyway"),
+	}
+}
+
+// start starts a node with the configuration. The admin socket and the
+// listen addresses of the configuration are left out, so that the
+// command can run next to a yggstack using the same file.
+func (f *nodeFlags) start(ctx context.Context) (*yggstack.Node, *log.Logger, error) {
+	logger := log.New(os.Stderr, "", log.Flags())
+	setLogLevel(*f.loglevel, logger)
+	cfg := config.GenerateConfig()
+	if *f.useconffile != "" {
+		file, err := os.Open(*f.useconffile)
+		if err != nil {
+			return nil, nil, err
+		}
+		_, err = cfg.ReadFrom(file)
+		_ = file.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("cfg.ReadFrom: %w", err)
+		}
+	}
+	cfg.AdminListen = "none"
+	cfg.Listen = nil
+	n, err := yggstack.New(cfg, logger, yggstack.Nameserver(*f.nameserver))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = n.Start(ctx); err != nil {
+		return nil, nil, err
+	}
+	if !waitForPeer(ctx, n, *f.peerwait) {
+		logger.Warnf("Not connected to any peers after %s", *f.peerwait)
+	}
+	return n, logger, nil
+}
+
+// waitForPeer waits until the node is connected to a peer, since what is
+// sent before that is lost or has to be retransmitted
+func waitForPeer(ctx context.Context, n *yggstack.Node, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		for _, peer := range n.Core().GetPeers() {
+			if peer.Up {
+				return true
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitForTCPClose waits until the TCP connections of the node have
+// finished closing, since stopping the node drops anything not yet sent,
+// including the end of the streams
+func waitForTCPClose(n *yggstack.Node, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if stats, err := n.TCPStats(); err != nil || stats.CurrentConnected == 0 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
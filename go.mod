@@ -10,6 +10,8 @@ require (
 	github.com/hjson/hjson-go/v4 v4.4.0
 	github.com/things-go/go-socks5 v0.0.5
 	github.com/yggdrasil-network/yggdrasil-go v0.5.9
+	golang.org/x/crypto v0.28.0
+	golang.org/x/sys v0.26.0
 	gvisor.dev/gvisor v0.0.0-20240810013311-326fe0f2a77f
 )
 
@@ -27,12 +29,10 @@ require (
 	github.com/quic-go/quic-go v0.48.0 // indirect
 	github.com/wlynxg/anet v0.0.5 // indirect
 	go.uber.org/mock v0.5.0 // indirect
-	golang.org/x/crypto v0.28.0 // indirect
 	golang.org/x/exp v0.0.0-20241009180824-f66d83c29e7c // indirect
 	golang.org/x/mod v0.21.0 // indirect
 	golang.org/x/net v0.30.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
-	golang.org/x/sys v0.26.0 // indirect
 	golang.org/x/text v0.19.0 // indirect
 	golang.org/x/time v0.7.0 // indirect
 	golang.org/x/tools v0.26.0 // indirect
@@ -0,0 +1,58 @@
+package netstack
+
+// Health is the state of the netstack's connection to the Yggdrasil
+// network
+type Health int
+
+const (
+	HealthOK       Health = iota // Packets are flowing
+	HealthDegraded               // Reading failed and is being retried
+	HealthFailed                 // Reading failed permanently
+)
+
+func (h Health) String() string {
+	switch h {
+	case HealthOK:
+		return "ok"
+	case HealthDegraded:
+		return "degraded"
+	case HealthFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// Health returns the state of the netstack and the error which caused
+// it, if any.
+func (s *YggdrasilNetstack) Health() (Health, error) {
+	s.healthMutex.Lock()
+	defer s.healthMutex.Unlock()
+	return s.health, s.healthErr
+}
+
+// Failed returns a channel which is closed when the netstack can no
+// longer reach the Yggdrasil network.
+func (s *YggdrasilNetstack) Failed() <-chan struct{} {
+	return s.failed
+}
+
+func (s *YggdrasilNetstack) setHealth(health Health, err error) {
+	s.healthMutex.Lock()
+	defer s.healthMutex.Unlock()
+	if s.health == HealthFailed {
+		return
+	}
+	s.health, s.healthErr = health, err
+	if health == HealthFailed {
+		s.logger.Errorf("Failed to read from the Yggdrasil network: %s", err)
+		close(s.failed)
+	}
+}
+
+// Close stops the netstack. It must be called before stopping the
+// Yggdrasil core, so that the NIC doesn't report it as a failure.
+func (s *YggdrasilNetstack) Close() {
+	s.nic.Close()
+	s.stack.Close()
+}
@@ -0,0 +1,68 @@
+package netstack
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gologme/log"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/config"
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+)
+
+func TestNetstackFailsWithCore(t *testing.T) {
+	readRetryMin, readRetryMax, readRetries = time.Millisecond, time.Millisecond, 2
+	defer func() {
+		readRetryMin, readRetryMax, readRetries = 100*time.Millisecond, 5*time.Second, 8
+	}()
+	logger := log.New(io.Discard, "", 0)
+	c, err := core.New(config.GenerateConfig().Certificate, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := CreateYggdrasilNetstack(c, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if health, _ := s.Health(); health != HealthOK {
+		t.Fatalf("expected a healthy netstack, got %s", health)
+	}
+
+	// Stopping the core from under the netstack is a failure
+	c.Stop()
+	select {
+	case <-s.Failed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("netstack did not fail")
+	}
+	if health, err := s.Health(); health != HealthFailed || err == nil {
+		t.Fatalf("expected a failed netstack, got %s: %v", health, err)
+	}
+}
+
+func TestNetstackClose(t *testing.T) {
+	readRetryMin, readRetryMax, readRetries = time.Millisecond, time.Millisecond, 2
+	defer func() {
+		readRetryMin, readRetryMax, readRetries = 100*time.Millisecond, 5*time.Second, 8
+	}()
+	logger := log.New(io.Discard, "", 0)
+	c, err := core.New(config.GenerateConfig().Certificate, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := CreateYggdrasilNetstack(c, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stopping the core after closing the netstack is not
+	s.Close()
+	c.Stop()
+	select {
+	case <-s.Failed():
+		t.Fatal("closed netstack should not fail")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
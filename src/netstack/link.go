@@ -0,0 +1,292 @@
+package netstack
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// routedNIC is an additional NIC which the node's subnet, or a part of
+// it, is routed to, with forwarding between it and the Yggdrasil NIC.
+type routedNIC struct {
+	stack    *YggdrasilNetstack
+	nicID    tcpip.NICID
+	replaced []tcpip.Route // Yggdrasil NIC routes covering the subnet
+	split    []tcpip.Route // Routes replacing them, minus the subnet
+}
+
+// attachNIC adds the endpoint as a new NIC and routes the subnet to it.
+// The first address of the subnet is assigned to the NIC, so that hosts
+// behind it can use it as a gateway.
+func (s *YggdrasilNetstack) attachNIC(endpoint stack.LinkEndpoint, subnet net.IPNet) (*routedNIC, error) {
+	ones, _ := subnet.Mask.Size()
+	destination, err := tcpip.NewSubnet(
+		tcpip.AddrFromSlice(subnet.IP.To16()),
+		tcpip.MaskFromBytes(subnet.Mask),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("tcpip.NewSubnet: %w", err)
+	}
+	for _, route := range s.stack.GetRouteTable() {
+		if route.NIC != 1 && (route.Destination.Contains(destination.ID()) || destination.Contains(route.Destination.ID())) {
+			return nil, fmt.Errorf("subnet %s is already routed to another link", subnet.String())
+		}
+	}
+
+	nicID := s.stack.NextNICID()
+	for s.stack.HasNIC(nicID) {
+		nicID = s.stack.NextNICID()
+	}
+	r := &routedNIC{
+		stack: s,
+		nicID: nicID,
+	}
+	if err := s.stack.CreateNIC(r.nicID, endpoint); err != nil {
+		return nil, fmt.Errorf("s.stack.CreateNIC: %s", err.String())
+	}
+	for _, nicID := range []tcpip.NICID{1, r.nicID} {
+		if _, err := s.stack.SetNICForwarding(nicID, ipv6.ProtocolNumber, true); err != nil {
+			s.stack.RemoveNIC(r.nicID)
+			return nil, fmt.Errorf("s.stack.SetNICForwarding: %s", err.String())
+		}
+	}
+	if err := s.stack.AddProtocolAddress(
+		r.nicID,
+		tcpip.ProtocolAddress{
+			Protocol: ipv6.ProtocolNumber,
+			AddressWithPrefix: tcpip.AddressWithPrefix{
+				Address:   tcpip.AddrFromSlice(SubnetHost(subnet, 1)),
+				PrefixLen: ones,
+			},
+		},
+		stack.AddressProperties{},
+	); err != nil {
+		s.stack.RemoveNIC(r.nicID)
+		return nil, fmt.Errorf("s.stack.AddProtocolAddress: %s", err.String())
+	}
+
+	// The netstack prefers routes through the NIC which holds the source
+	// address over longer prefixes, so locally generated traffic for the
+	// subnet would leave through the Yggdrasil NIC. Instead split the
+	// routes covering the subnet so that they no longer contain it.
+	for _, route := range s.stack.GetRouteTable() {
+		if route.NIC != 1 || route.Destination.Prefix() >= ones || !route.Destination.Contains(destination.ID()) {
+			continue
+		}
+		r.replaced = append(r.replaced, route)
+		for _, split := range excludeSubnet(route.Destination, subnet) {
+			r.split = append(r.split, tcpip.Route{
+				Destination: split,
+				NIC:         route.NIC,
+			})
+		}
+	}
+	s.stack.RemoveRoutes(func(route tcpip.Route) bool {
+		return containsRoute(r.replaced, route)
+	})
+	for _, route := range r.split {
+		s.stack.AddRoute(route)
+	}
+	s.stack.AddRoute(tcpip.Route{
+		Destination: destination,
+		NIC:         r.nicID,
+	})
+	return r, nil
+}
+
+// detach removes the NIC and restores the original routes.
+func (r *routedNIC) detach() error {
+	r.stack.stack.RemoveRoutes(func(route tcpip.Route) bool {
+		return route.NIC == r.nicID || containsRoute(r.split, route)
+	})
+	for _, route := range r.replaced {
+		r.stack.stack.AddRoute(route)
+	}
+	if err := r.stack.stack.RemoveNIC(r.nicID); err != nil {
+		return fmt.Errorf("RemoveNIC: %s", err.String())
+	}
+	return nil
+}
+
+// SubnetHost returns the address with the given host number in the
+// subnet, i.e. 1 for the gateway address
+func SubnetHost(subnet net.IPNet, host byte) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, subnet.IP.To16())
+	ip[net.IPv6len-1] |= host
+	return ip
+}
+
+// PacketLink carries raw IPv6 packets to and from a network segment
+// over a packet socket, one packet per datagram. This can be a UDP
+// socket for UDP/IP encapsulation, or a datagram socketpair shared
+// with a helper process.
+type PacketLink struct {
+	*routedNIC
+	conn      net.PacketConn
+	peer      atomic.Pointer[net.Addr]
+	connected net.Conn // Set if the socket has a peer of its own
+	subnet    net.IPNet
+	endpoint  *channel.Endpoint
+	cancel    context.CancelFunc
+}
+
+// AddPacketLink attaches a packet link to the netstack and routes the
+// given subnet to it, turning yggstack into a router between that
+// segment and the Yggdrasil network. Packets are exchanged with the
+// peer, or if peer is nil, with the first address a packet is received
+// from. A connected socket, such as one end of a socketpair, only
+// exchanges packets with the other end. Packets from other senders, or
+// from source addresses outside of the subnet, are dropped.
+func (s *YggdrasilNetstack) AddPacketLink(conn net.PacketConn, peer net.Addr, subnet net.IPNet) (*PacketLink, error) {
+	mtu := s.nic.MTU()
+	l := &PacketLink{
+		conn:     conn,
+		subnet:   subnet,
+		endpoint: channel.New(512, mtu, ""),
+	}
+	if c, ok := conn.(net.Conn); ok && c.RemoteAddr() != nil {
+		l.connected = c
+	} else if peer != nil {
+		l.peer.Store(&peer)
+	}
+	var err error
+	if l.routedNIC, err = s.attachNIC(l.endpoint, subnet); err != nil {
+		return nil, err
+	}
+	var ctx context.Context
+	ctx, l.cancel = context.WithCancel(context.Background())
+	go l.readLoop(int(mtu))
+	go l.writeLoop(ctx)
+	return l, nil
+}
+
+func (l *PacketLink) readLoop(mtu int) {
+	buf := make([]byte, mtu)
+	for {
+		n, from, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < header.IPv6MinimumSize || header.IPVersion(buf[:n]) != header.IPv6Version {
+			continue
+		}
+		if !l.fromPeer(from) {
+			l.stack.logger.Debugf("Dropping packet from %s, which is not the peer of the packet link", from)
+			continue
+		}
+		if src := header.IPv6(buf[:n]).SourceAddress(); !l.subnet.Contains(net.IP(src.AsSlice())) {
+			l.stack.logger.Debugf("Dropping packet from %s on the packet link, which is outside of %s", src, l.subnet.String())
+			continue
+		}
+		pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{
+			Payload: buffer.MakeWithData(buf[:n]),
+		})
+		l.endpoint.InjectInbound(ipv6.ProtocolNumber, pkb)
+		pkb.DecRef()
+	}
+}
+
+// fromPeer reports whether a packet from the sender belongs to the link.
+// Without a configured peer, the first sender becomes the peer.
+func (l *PacketLink) fromPeer(from net.Addr) bool {
+	if l.connected != nil {
+		// Only the other end can send on a connected socket
+		return true
+	}
+	if from == nil {
+		return false
+	}
+	if l.peer.CompareAndSwap(nil, &from) {
+		l.stack.logger.Infof("Packet link peer is %s", from)
+		return true
+	}
+	return sameAddr(*l.peer.Load(), from)
+}
+
+func sameAddr(a, b net.Addr) bool {
+	ua, ok1 := a.(*net.UDPAddr)
+	ub, ok2 := b.(*net.UDPAddr)
+	if ok1 && ok2 {
+		return ua.IP.Equal(ub.IP) && ua.Port == ub.Port && ua.Zone == ub.Zone
+	}
+	return a.Network() == b.Network() && a.String() == b.String()
+}
+
+func (l *PacketLink) writeLoop(ctx context.Context) {
+	failing := false
+	for {
+		pkt := l.endpoint.ReadContext(ctx)
+		if pkt == nil {
+			return
+		}
+		view := pkt.ToView()
+		var err error
+		if l.connected != nil {
+			_, err = l.connected.Write(view.AsSlice())
+		} else if peer := l.peer.Load(); peer != nil {
+			_, err = l.conn.WriteTo(view.AsSlice(), *peer)
+		}
+		view.Release()
+		pkt.DecRef()
+		// Only log the first of a run of failures, as every packet
+		// would fail the same way
+		switch {
+		case err != nil && !failing && ctx.Err() == nil:
+			l.stack.logger.Warnf("Failed to write to the packet link: %s", err)
+			failing = true
+		case err == nil && failing:
+			l.stack.logger.Infof("Writing to the packet link recovered")
+			failing = false
+		}
+	}
+}
+
+// Close detaches the link from the netstack and closes the socket.
+func (l *PacketLink) Close() error {
+	l.cancel()
+	if err := l.detach(); err != nil {
+		return err
+	}
+	return l.conn.Close()
+}
+
+// excludeSubnet returns the prefixes which together cover outer except
+// for inner, from the longest to the shortest
+func excludeSubnet(outer tcpip.Subnet, inner net.IPNet) []tcpip.Subnet {
+	ip := inner.IP.To16()
+	ones, _ := inner.Mask.Size()
+	var subnets []tcpip.Subnet
+	for prefix := ones; prefix > outer.Prefix(); prefix-- {
+		sibling := make(net.IP, net.IPv6len)
+		copy(sibling, ip)
+		sibling[(prefix-1)/8] ^= 0x80 >> ((prefix - 1) % 8)
+		mask := net.CIDRMask(prefix, 128)
+		subnet, err := tcpip.NewSubnet(
+			tcpip.AddrFromSlice(sibling.Mask(mask)),
+			tcpip.MaskFromBytes(mask),
+		)
+		if err != nil {
+			continue
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets
+}
+
+func containsRoute(routes []tcpip.Route, route tcpip.Route) bool {
+	for _, r := range routes {
+		if r.Equal(route) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package netstack
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+func buildUDPPacket(src, dst net.IP, srcPort, dstPort uint16, payload []byte) []byte {
+	pkt := make([]byte, header.IPv6MinimumSize+header.UDPMinimumSize+len(payload))
+	ip := header.IPv6(pkt)
+	ip.Encode(&header.IPv6Fields{
+		PayloadLength:     uint16(header.UDPMinimumSize + len(payload)),
+		TransportProtocol: header.UDPProtocolNumber,
+		HopLimit:          64,
+		SrcAddr:           tcpip.AddrFromSlice(src.To16()),
+		DstAddr:           tcpip.AddrFromSlice(dst.To16()),
+	})
+	udp := header.UDP(pkt[header.IPv6MinimumSize:])
+	udp.Encode(&header.UDPFields{
+		SrcPort: srcPort,
+		DstPort: dstPort,
+		Length:  uint16(header.UDPMinimumSize + len(payload)),
+	})
+	copy(udp.Payload(), payload)
+	xsum := header.PseudoHeaderChecksum(header.UDPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(len(udp)))
+	udp.SetChecksum(^udp.CalculateChecksum(checksum.Checksum(payload, xsum)))
+	return pkt
+}
+
+func TestPacketLink(t *testing.T) {
+	s := newTestNetstack(t)
+	segment, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer segment.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := s.AddPacketLink(conn, nil, s.Subnet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer link.Close()
+
+	host := make(net.IP, net.IPv6len)
+	copy(host, s.Subnet().IP)
+	host[15] = 0x05
+
+	// A host on the segment sends a datagram to the node
+	listener, err := s.ListenUDP(&net.UDPAddr{IP: s.Address(), Port: 5353})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	pkt := buildUDPPacket(host, s.Address(), 1234, 5353, []byte("inbound"))
+	if _, err = segment.WriteTo(pkt, conn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	_ = listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "inbound" || !from.(*net.UDPAddr).IP.Equal(host) {
+		t.Fatalf("unexpected datagram %q from %s", buf[:n], from)
+	}
+
+	// The node replies, which is routed back to the segment
+	if _, err = listener.WriteTo([]byte("outbound"), from); err != nil {
+		t.Fatal(err)
+	}
+	_ = segment.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, _, err = segment.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	ip := header.IPv6(buf[:n])
+	if !ip.IsValid(n) || ip.DestinationAddress() != tcpip.AddrFromSlice(host) {
+		t.Fatalf("unexpected packet on the segment: %x", buf[:n])
+	}
+	if payload := header.UDP(ip.Payload()).Payload(); string(payload) != "outbound" {
+		t.Fatalf("unexpected payload %q", payload)
+	}
+
+	// Other senders can't inject packets or take the link over, and the
+	// peer can't send from addresses outside of the subnet
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err = other.WriteTo(buildUDPPacket(host, s.Address(), 1234, 5353, []byte("other")), conn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	spoofed := buildUDPPacket(net.ParseIP("200::1"), s.Address(), 1234, 5353, []byte("spoofed"))
+	if _, err = segment.WriteTo(spoofed, conn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = segment.WriteTo(buildUDPPacket(host, s.Address(), 1234, 5353, []byte("peer")), conn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	_ = listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, _, err = listener.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "peer" {
+		t.Fatalf("unexpected datagram %q, only the one of the peer should arrive", buf[:n])
+	}
+	if _, err = listener.WriteTo([]byte("outbound"), from); err != nil {
+		t.Fatal(err)
+	}
+	_ = segment.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err = segment.ReadFrom(buf); err != nil {
+		t.Fatalf("replies should still go to the peer: %s", err)
+	}
+}
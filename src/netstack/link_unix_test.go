@@ -0,0 +1,80 @@
+//go:build unix
+
+package netstack
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// socketpairConns returns both ends of a datagram socketpair, like the
+// one shared with a helper process for an fd:<n> router link
+func socketpairConns(t *testing.T) (net.PacketConn, net.PacketConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make([]net.PacketConn, 2)
+	for i, fd := range fds {
+		file := os.NewFile(uintptr(fd), "socketpair")
+		conns[i], err = net.FilePacketConn(file)
+		_ = file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return conns[0], conns[1]
+}
+
+func TestPacketLinkSocketpair(t *testing.T) {
+	s := newTestNetstack(t)
+	conn, segment := socketpairConns(t)
+	defer segment.Close()
+	link, err := s.AddPacketLink(conn, nil, s.Subnet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer link.Close()
+
+	host := SubnetHost(s.Subnet(), 5)
+	listener, err := s.ListenUDP(&net.UDPAddr{IP: s.Address(), Port: 5353})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if _, err = segment.(net.Conn).Write(buildUDPPacket(host, s.Address(), 1234, 5353, []byte("inbound"))); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	_ = listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "inbound" {
+		t.Fatalf("unexpected datagram %q", buf[:n])
+	}
+
+	// The sender of the socketpair is unnamed, so the reply goes back
+	// to the other end of it
+	if _, err = listener.WriteTo([]byte("outbound"), from); err != nil {
+		t.Fatal(err)
+	}
+	_ = segment.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err = segment.(net.Conn).Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	ip := header.IPv6(buf[:n])
+	if !ip.IsValid(n) || ip.DestinationAddress() != tcpip.AddrFromSlice(host) {
+		t.Fatalf("unexpected packet on the segment: %x", buf[:n])
+	}
+	if payload := header.UDP(ip.Payload()).Payload(); string(payload) != "outbound" {
+		t.Fatalf("unexpected payload %q", payload)
+	}
+}
@@ -2,9 +2,11 @@ package netstack
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
-	"strconv"
+	"sync"
+	"sync/atomic"
 
 	"github.com/yggdrasil-network/yggdrasil-go/src/core"
 
@@ -18,11 +20,34 @@ import (
 )
 
 type YggdrasilNetstack struct {
-	stack *stack.Stack
+	stack       *stack.Stack
+	nic         *YggdrasilNIC
+	logger      core.Logger
+	mutex       sync.Mutex
+	resolver    Resolver
+	address     net.IP
+	subnet      net.IPNet
+	healthMutex sync.Mutex
+	health      Health
+	healthErr   error
+	failed      chan struct{}
+	tcpOptions  TCPOptions
+	tcpInFlight chan struct{} // Limits connections being set up, if set
+	tcpDialing  atomic.Int64
 }
 
-func CreateYggdrasilNetstack(ygg *core.Core) (*YggdrasilNetstack, error) {
+// Resolver looks up the addresses of a host name
+type Resolver interface {
+	LookupAll(ctx context.Context, name string) ([]net.IP, error)
+}
+
+func CreateYggdrasilNetstack(ygg *core.Core, logger core.Logger) (*YggdrasilNetstack, error) {
 	s := &YggdrasilNetstack{
+		logger:     logger,
+		failed:     make(chan struct{}),
+		tcpOptions: DefaultTCPOptions(),
+		address:    ygg.Address(),
+		subnet:     ygg.Subnet(),
 		stack: stack.New(stack.Options{
 			NetworkProtocols:   []stack.NetworkProtocolFactory{ipv6.NewProtocol},
 			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol6},
@@ -43,52 +68,167 @@ func CreateYggdrasilNetstack(ygg *core.Core) (*YggdrasilNetstack, error) {
 func convertToFullAddr(ip net.IP, port int) (tcpip.FullAddress, tcpip.NetworkProtocolNumber, error) {
 	addr := tcpip.Address{}
 	ip16 := ip.To16()
-	if ip16 != nil {
+	if ip16 != nil && !ip16.IsUnspecified() {
 		addr = tcpip.AddrFromSlice(ip16)
 	}
+	// Leave the NIC unset so that the route table picks it, as the subnet
+	// may be routed to a link other than the Yggdrasil NIC.
 	return tcpip.FullAddress{
-		NIC:  1,
 		Addr: addr,
 		Port: uint16(port),
 	}, ipv6.ProtocolNumber, nil
 }
 
-func convertToFullAddrFromString(endpoint string) (tcpip.FullAddress, tcpip.NetworkProtocolNumber, error) {
+func convertToFullAddrFromString(network, endpoint string) (tcpip.FullAddress, tcpip.NetworkProtocolNumber, error) {
 	host, port, err := net.SplitHostPort(endpoint)
 	if err != nil {
 		return tcpip.FullAddress{}, 0, fmt.Errorf("net.SplitHostPort: %w", err)
 	}
+	var ip net.IP
+	if host != "" {
+		if ip = net.ParseIP(host); ip == nil {
+			return tcpip.FullAddress{}, 0, fmt.Errorf("invalid IP address %q", host)
+		}
+	}
 	pn := 80
 	if port != "" {
-		if pn, err = strconv.Atoi(port); err != nil {
-			return tcpip.FullAddress{}, 0, fmt.Errorf("strconv.Atoi: %w", err)
+		if pn, err = net.LookupPort(network, port); err != nil {
+			return tcpip.FullAddress{}, 0, fmt.Errorf("net.LookupPort: %w", err)
 		}
 	}
-	return convertToFullAddr(net.ParseIP(host), pn)
+	return convertToFullAddr(ip, pn)
 }
 
+// SetResolver sets the resolver used by Dial and DialContext to look up
+// addresses which are not IP literals
+func (s *YggdrasilNetstack) SetResolver(r Resolver) {
+	s.resolver = r
+}
+
+// Address returns the Yggdrasil address of the node
+func (s *YggdrasilNetstack) Address() net.IP {
+	return s.address
+}
+
+// Subnet returns the routed Yggdrasil subnet of the node
+func (s *YggdrasilNetstack) Subnet() net.IPNet {
+	return s.subnet
+}
+
+// Dial connects to the address on the named network, see net.Dial
+func (s *YggdrasilNetstack) Dial(network, address string) (net.Conn, error) {
+	return s.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address on the named network using the
+// provided context, see net.Dialer.DialContext. Host names are looked
+// up using the resolver, and each resulting address is tried in turn.
 func (s *YggdrasilNetstack) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
-	fa, pn, err := convertToFullAddrFromString(address)
+	switch network {
+	case "tcp", "tcp6", "udp", "udp6":
+	default:
+		return nil, fmt.Errorf("network %q not supported", network)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("net.SplitHostPort: %w", err)
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return s.dialAddress(ctx, network, address)
+	}
+	if s.resolver == nil {
+		return nil, fmt.Errorf("no resolver configured to look up %q", host)
+	}
+	ips, err := s.resolver.LookupAll(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, ip := range ips {
+		conn, err := s.dialAddress(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (s *YggdrasilNetstack) dialAddress(ctx context.Context, network, address string) (net.Conn, error) {
+	fa, pn, err := convertToFullAddrFromString(network, address)
 	if err != nil {
 		return nil, fmt.Errorf("convertToFullAddrFromString: %w", err)
 	}
 	switch network {
 	case "tcp", "tcp6":
-		return gonet.DialContextTCP(ctx, s.stack, fa, pn)
-	case "udp", "udp6":
+		conn, err := s.dialTCP(ctx, tcpip.FullAddress{}, fa, pn)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	default:
 		conn, err := gonet.DialUDP(s.stack, nil, &fa, pn)
 		if err != nil {
 			return nil, fmt.Errorf("gonet.DialUDP: %w", err)
 		}
 		return conn, nil
+	}
+}
+
+// Listen announces on the local address, see net.Listen. Only the
+// "tcp" and "tcp6" networks are supported.
+func (s *YggdrasilNetstack) Listen(network, address string) (net.Listener, error) {
+	switch network {
+	case "tcp", "tcp6":
 	default:
-		return nil, fmt.Errorf("not supported")
+		return nil, fmt.Errorf("network %q not supported", network)
+	}
+	fa, pn, err := convertToFullAddrFromString(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("convertToFullAddrFromString: %w", err)
+	}
+	if err := s.assignAddress(fa.Addr); err != nil {
+		return nil, err
+	}
+	listener, err := s.listenTCP(fa, pn)
+	if err != nil {
+		return nil, err
+	}
+	return listener, nil
+}
+
+// ListenPacket announces on the local address, see net.ListenPacket.
+// Only the "udp" and "udp6" networks are supported.
+func (s *YggdrasilNetstack) ListenPacket(network, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp6":
+	default:
+		return nil, fmt.Errorf("network %q not supported", network)
+	}
+	fa, pn, err := convertToFullAddrFromString(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("convertToFullAddrFromString: %w", err)
+	}
+	if err := s.assignAddress(fa.Addr); err != nil {
+		return nil, err
 	}
+	return gonet.DialUDP(s.stack, &fa, nil, pn)
 }
 
 func (s *YggdrasilNetstack) DialTCP(addr *net.TCPAddr) (*gonet.TCPConn, error) {
 	fa, pn, _ := convertToFullAddr(addr.IP, addr.Port)
-	return gonet.DialTCP(s.stack, fa, pn)
+	return s.dialTCP(context.Background(), tcpip.FullAddress{}, fa, pn)
+}
+
+// DialTCPWithBind connects from a specific local address, which may be
+// any address from the node's subnet
+func (s *YggdrasilNetstack) DialTCPWithBind(ctx context.Context, laddr, raddr *net.TCPAddr) (*gonet.TCPConn, error) {
+	lfa, _, _ := convertToFullAddr(laddr.IP, laddr.Port)
+	rfa, pn, _ := convertToFullAddr(raddr.IP, raddr.Port)
+	if err := s.assignAddress(lfa.Addr); err != nil {
+		return nil, err
+	}
+	return s.dialTCP(ctx, lfa, rfa, pn)
 }
 
 func (s *YggdrasilNetstack) DialUDP(addr *net.UDPAddr) (*gonet.UDPConn, error) {
@@ -96,12 +236,62 @@ func (s *YggdrasilNetstack) DialUDP(addr *net.UDPAddr) (*gonet.UDPConn, error) {
 	return gonet.DialUDP(s.stack, nil, &fa, pn)
 }
 
+// DialUDPWithBind connects from a specific local address, which may be
+// any address from the node's subnet
+func (s *YggdrasilNetstack) DialUDPWithBind(laddr, raddr *net.UDPAddr) (*gonet.UDPConn, error) {
+	lfa, _, _ := convertToFullAddr(laddr.IP, laddr.Port)
+	rfa, pn, _ := convertToFullAddr(raddr.IP, raddr.Port)
+	if err := s.assignAddress(lfa.Addr); err != nil {
+		return nil, err
+	}
+	return gonet.DialUDP(s.stack, &lfa, &rfa, pn)
+}
+
 func (s *YggdrasilNetstack) ListenTCP(addr *net.TCPAddr) (net.Listener, error) {
 	fa, pn, _ := convertToFullAddr(addr.IP, addr.Port)
-	return gonet.ListenTCP(s.stack, fa, pn)
+	if err := s.assignAddress(fa.Addr); err != nil {
+		return nil, err
+	}
+	listener, err := s.listenTCP(fa, pn)
+	if err != nil {
+		return nil, err
+	}
+	return listener, nil
 }
 
 func (s *YggdrasilNetstack) ListenUDP(addr *net.UDPAddr) (*gonet.UDPConn, error) {
 	fa, pn, _ := convertToFullAddr(addr.IP, addr.Port)
+	if err := s.assignAddress(fa.Addr); err != nil {
+		return nil, err
+	}
 	return gonet.DialUDP(s.stack, &fa, nil, pn)
 }
+
+// assignAddress makes sure that the address can be used locally. Any
+// address from the node's subnet is added to the NIC on first use, so
+// that services can have their own addresses.
+func (s *YggdrasilNetstack) assignAddress(addr tcpip.Address) error {
+	if addr.BitLen() == 0 {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stack.CheckLocalAddress(0, ipv6.ProtocolNumber, addr) != 0 {
+		return nil
+	}
+	ip := net.IP(addr.AsSlice())
+	if !s.subnet.Contains(ip) {
+		return fmt.Errorf("address %s is not assigned to this node", ip)
+	}
+	if err := s.stack.AddProtocolAddress(
+		1,
+		tcpip.ProtocolAddress{
+			Protocol:          ipv6.ProtocolNumber,
+			AddressWithPrefix: addr.WithPrefix(),
+		},
+		stack.AddressProperties{},
+	); err != nil {
+		return fmt.Errorf("s.stack.AddProtocolAddress: %s", err.String())
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package netstack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/gologme/log"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/config"
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+)
+
+type staticResolver map[string][]net.IP
+
+func (r staticResolver) LookupAll(_ context.Context, name string) ([]net.IP, error) {
+	if ips, ok := r[name]; ok {
+		return ips, nil
+	}
+	return nil, fmt.Errorf("no addresses for %q", name)
+}
+
+func newTestNetstack(t *testing.T) *YggdrasilNetstack {
+	cfg := config.GenerateConfig()
+	logger := log.New(io.Discard, "", 0)
+	c, err := core.New(cfg.Certificate, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Stop)
+	s, err := CreateYggdrasilNetstack(c, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestNetstackHTTP(t *testing.T) {
+	s := newTestNetstack(t)
+	listener, err := s.Listen("tcp", "[::]:http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { // nolint:errcheck
+		_, _ = io.WriteString(w, "hello")
+	}))
+
+	// The first address is unroutable, so the dial must fall back to
+	// the second one
+	s.SetResolver(staticResolver{"node.test": {net.ParseIP("127.0.0.1"), s.Address()}})
+	client := &http.Client{Transport: &http.Transport{DialContext: s.DialContext}}
+	resp, err := client.Get("http://node.test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" {
+		t.Fatalf("unexpected response %q", body)
+	}
+}
+
+func TestNetstackPacket(t *testing.T) {
+	s := newTestNetstack(t)
+	pc, err := s.ListenPacket("udp", net.JoinHostPort(s.Address().String(), "5353"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	conn, err := s.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Fatalf("unexpected datagram %q", buf[:n])
+	}
+	if from.String() != conn.LocalAddr().String() {
+		t.Fatalf("datagram from %s, expected %s", from, conn.LocalAddr())
+	}
+	// Service names are looked up for the network of the socket
+	if port, err := net.LookupPort("udp", "ntp"); err == nil {
+		if _, err := net.LookupPort("tcp", "ntp"); err != nil {
+			ntp, err := s.ListenPacket("udp", ":ntp")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ntp.Close()
+			if ntp.LocalAddr().(*net.UDPAddr).Port != port {
+				t.Fatalf("unexpected address %s for ntp", ntp.LocalAddr())
+			}
+		}
+	}
+	if _, err = s.Listen("udp", ":80"); err == nil {
+		t.Fatal("Listen should not support udp")
+	}
+	if _, err = s.ListenPacket("tcp", ":80"); err == nil {
+		t.Fatal("ListenPacket should not support tcp")
+	}
+}
+
+func TestNetstackSubnet(t *testing.T) {
+	s := newTestNetstack(t)
+	subnet := s.Subnet()
+	service := make(net.IP, net.IPv6len)
+	copy(service, subnet.IP)
+	service[15] = 0x10
+	client := make(net.IP, net.IPv6len)
+	copy(client, subnet.IP)
+	client[15] = 0x20
+
+	listener, err := s.ListenTCP(&net.TCPAddr{IP: service, Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		if c, err := listener.Accept(); err == nil {
+			accepted <- c.RemoteAddr()
+			_ = c.Close()
+		}
+	}()
+
+	conn, err := s.DialTCPWithBind(context.Background(), &net.TCPAddr{IP: client}, &net.TCPAddr{IP: service, Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if remote := <-accepted; !remote.(*net.TCPAddr).IP.Equal(client) {
+		t.Fatalf("connection from %s, expected %s", remote, client)
+	}
+
+	if _, err = s.ListenTCP(&net.TCPAddr{IP: net.ParseIP("300::10"), Port: 80}); err == nil {
+		t.Fatal("addresses outside of the node's subnet should be rejected")
+	}
+}
@@ -0,0 +1,72 @@
+// Package netstacktest provides helpers for tests which need netstacks
+// on in-process Yggdrasil nodes.
+package netstacktest
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gologme/log"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/config"
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+
+	"github.com/yggdrasil-network/yggstack/src/netstack"
+)
+
+// NewPeered returns two netstacks on in-process nodes which are peered
+// with each other over loopback TCP, once they can reach each other.
+// Both are closed when the test ends.
+func NewPeered(tb testing.TB) (*netstack.YggdrasilNetstack, *netstack.YggdrasilNetstack) {
+	tb.Helper()
+	logger := log.New(io.Discard, "", 0)
+	var stacks [2]*netstack.YggdrasilNetstack
+	var cores [2]*core.Core
+	for i := range stacks {
+		c, err := core.New(config.GenerateConfig().Certificate, logger)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(c.Stop)
+		s, err := netstack.CreateYggdrasilNetstack(c, logger)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(s.Close)
+		cores[i], stacks[i] = c, s
+	}
+	listener, err := cores[0].Listen(&url.URL{Scheme: "tcp", Host: "127.0.0.1:0"}, "")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err = cores[1].AddPeer(&url.URL{Scheme: "tcp", Host: listener.Addr().String()}, ""); err != nil {
+		tb.Fatal(err)
+	}
+
+	// Wait until the nodes can reach each other
+	echo, err := stacks[0].ListenTCP(&net.TCPAddr{Port: 7})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		if c, err := echo.Accept(); err == nil {
+			_ = c.Close()
+		}
+	}()
+	for start := time.Now(); time.Since(start) < 10*time.Second; {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		c, err := stacks[1].DialTCPWithBind(ctx, &net.TCPAddr{}, &net.TCPAddr{IP: stacks[0].Address(), Port: 7})
+		cancel()
+		if err == nil {
+			_ = c.Close()
+			return stacks[0], stacks[1]
+		}
+	}
+	tb.Fatal("nodes did not connect")
+	return nil, nil
+}
@@ -0,0 +1,380 @@
+package netstack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const (
+	pcapMagic       = 0xa1b2c3d4
+	pcapLinkTypeRaw = 101 // LINKTYPE_RAW, packets begin with the IP header
+	pcapSnapLen     = 65535
+)
+
+// CaptureOptions configures a packet capture of the Yggdrasil NIC
+type CaptureOptions struct {
+	Path     string // File to write to
+	MaxSize  int64  // Rotate the file when it reaches this size, 0 for no limit
+	MaxFiles int    // Number of rotated files to keep besides the current one
+	Filter   string // Only capture matching packets, see ParseCaptureFilter
+}
+
+// PacketCapture writes IPv6 packets to a file in pcap format, rotating
+// it to <path>.1, <path>.2 and so on when it reaches the size limit
+type PacketCapture struct {
+	mutex   sync.Mutex
+	options CaptureOptions
+	filter  CaptureFilter
+	file    *os.File
+	size    int64
+	buf     []byte
+	err     error       // Why the capture stopped by itself
+	failed  func(error) // Called once if it does
+}
+
+// NewPacketCapture creates the capture file and writes the pcap header.
+func NewPacketCapture(options CaptureOptions) (*PacketCapture, error) {
+	filter, err := ParseCaptureFilter(options.Filter)
+	if err != nil {
+		return nil, err
+	}
+	c := &PacketCapture{
+		options: options,
+		filter:  filter,
+	}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// open creates the capture file, or truncates it if it is an earlier
+// capture. Other files are left alone, so that a mistyped path doesn't
+// destroy them.
+func (c *PacketCapture) open() error {
+	file, err := os.OpenFile(c.options.Path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile: %w", err)
+	}
+	if err = checkCaptureFile(file); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Truncate(0); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("file.Truncate: %w", err)
+	}
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkTypeRaw)
+	if _, err = file.Write(hdr); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("file.Write: %w", err)
+	}
+	c.file, c.size = file, int64(len(hdr))
+	return nil
+}
+
+// checkCaptureFile returns an error unless the file is empty or holds a
+// pcap capture
+func checkCaptureFile(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("file.Stat: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", file.Name())
+	}
+	if info.Size() == 0 {
+		return nil
+	}
+	magic := make([]byte, 4)
+	if _, err = file.ReadAt(magic, 0); err != nil || binary.LittleEndian.Uint32(magic) != pcapMagic {
+		return fmt.Errorf("refusing to overwrite %s, which is not a pcap file", file.Name())
+	}
+	return nil
+}
+
+func (c *PacketCapture) rotate() error {
+	if err := c.file.Close(); err != nil {
+		return err
+	}
+	if c.options.MaxFiles <= 0 {
+		_ = os.Remove(c.options.Path)
+		return c.open()
+	}
+	for i := 1; i <= c.options.MaxFiles; i++ {
+		if err := checkRotatedFile(c.rotatedPath(i)); err != nil {
+			return err
+		}
+	}
+	for i := c.options.MaxFiles - 1; i > 0; i-- {
+		_ = os.Rename(c.rotatedPath(i), c.rotatedPath(i+1))
+	}
+	_ = os.Rename(c.options.Path, c.rotatedPath(1))
+	return c.open()
+}
+
+// checkRotatedFile returns an error if a rotated file would replace
+// something other than a capture
+func checkRotatedFile(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	return checkCaptureFile(file)
+}
+
+func (c *PacketCapture) rotatedPath(n int) string {
+	return c.options.Path + "." + strconv.Itoa(n)
+}
+
+// WritePacket records the packet if it matches the filter. Errors are
+// not returned, as they must not affect the traffic being captured.
+func (c *PacketCapture) WritePacket(pkt []byte) {
+	if !c.filter.Match(pkt) {
+		return
+	}
+	caplen := len(pkt)
+	if caplen > pcapSnapLen {
+		caplen = pcapSnapLen
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.file == nil {
+		return
+	}
+	record := int64(16 + caplen)
+	if c.options.MaxSize > 0 && c.size+record > c.options.MaxSize && c.size > 24 {
+		if err := c.rotate(); err != nil {
+			c.fail(fmt.Errorf("failed to rotate %s: %w", c.options.Path, err))
+			return
+		}
+	}
+	now := time.Now()
+	c.buf = append(c.buf[:0], make([]byte, 16)...)
+	binary.LittleEndian.PutUint32(c.buf[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(c.buf[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(c.buf[8:], uint32(caplen))
+	binary.LittleEndian.PutUint32(c.buf[12:], uint32(len(pkt)))
+	c.buf = append(c.buf, pkt[:caplen]...)
+	if _, err := c.file.Write(c.buf); err != nil {
+		c.fail(fmt.Errorf("failed to write to %s: %w", c.options.Path, err))
+		return
+	}
+	c.size += record
+}
+
+// fail stops the capture after an error
+func (c *PacketCapture) fail(err error) {
+	if c.file != nil {
+		_ = c.file.Close()
+		c.file = nil
+	}
+	c.err = err
+	if c.failed != nil {
+		c.failed(err)
+	}
+}
+
+// Err returns why the capture stopped by itself, if it did
+func (c *PacketCapture) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err
+}
+
+// Close stops the capture and closes the file.
+func (c *PacketCapture) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+// CaptureFilter matches packets against alternatives joined by "or",
+// each of which is a list of terms joined by "and"
+type CaptureFilter [][]captureTerm
+
+type captureTerm struct {
+	not   bool
+	dir   string // "src", "dst" or empty for either
+	kind  string // "net", "port" or "proto"
+	net   *net.IPNet
+	port  uint16
+	proto uint8
+}
+
+// ParseCaptureFilter parses a filter in a subset of the pcap-filter
+// syntax, i.e. "host 200::1 and tcp port 80 or not udp". Supported terms
+// are [src|dst] host <ip>, [src|dst] net <cidr>, [src|dst] port <n> and
+// tcp, udp or icmp6, each optionally preceded by "not". An empty filter
+// matches all packets.
+func ParseCaptureFilter(filter string) (CaptureFilter, error) {
+	var f CaptureFilter
+	var terms []captureTerm
+	var term captureTerm
+	tokens := strings.Fields(strings.ToLower(filter))
+	for i := 0; i < len(tokens); i++ {
+		next := func() (string, error) {
+			if i+1 >= len(tokens) {
+				return "", fmt.Errorf("capture filter: %q requires an argument", tokens[i])
+			}
+			i++
+			return tokens[i], nil
+		}
+		switch token := tokens[i]; token {
+		case "and", "&&":
+			continue
+		case "or", "||":
+			if len(terms) == 0 {
+				return nil, fmt.Errorf("capture filter: unexpected %q", token)
+			}
+			f, terms = append(f, terms), nil
+		case "not", "!":
+			term.not = !term.not
+		case "src", "dst":
+			term.dir = token
+		case "host", "net":
+			arg, err := next()
+			if err != nil {
+				return nil, err
+			}
+			if !strings.Contains(arg, "/") {
+				arg += "/128"
+			}
+			_, ipnet, err := net.ParseCIDR(arg)
+			if err != nil || ipnet.IP.To4() != nil {
+				return nil, fmt.Errorf("capture filter: invalid IPv6 %s %q", token, tokens[i])
+			}
+			term.kind, term.net = "net", ipnet
+			terms, term = append(terms, term), captureTerm{}
+		case "port":
+			arg, err := next()
+			if err != nil {
+				return nil, err
+			}
+			port, err := strconv.ParseUint(arg, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("capture filter: invalid port %q", arg)
+			}
+			term.kind, term.port = "port", uint16(port)
+			terms, term = append(terms, term), captureTerm{}
+		case "tcp", "udp", "icmp6":
+			if term.dir != "" {
+				return nil, fmt.Errorf("capture filter: %q can't follow %q", token, term.dir)
+			}
+			term.kind, term.proto = "proto", map[string]uint8{
+				"tcp":   uint8(header.TCPProtocolNumber),
+				"udp":   uint8(header.UDPProtocolNumber),
+				"icmp6": uint8(header.ICMPv6ProtocolNumber),
+			}[token]
+			terms, term = append(terms, term), captureTerm{}
+		default:
+			return nil, fmt.Errorf("capture filter: unknown term %q", token)
+		}
+	}
+	if term.not || term.dir != "" || (len(terms) == 0 && len(f) > 0) {
+		return nil, fmt.Errorf("capture filter: unexpected end of filter")
+	}
+	if len(terms) > 0 {
+		f = append(f, terms)
+	}
+	return f, nil
+}
+
+// Match reports whether the IPv6 packet matches the filter
+func (f CaptureFilter) Match(pkt []byte) bool {
+	if len(f) == 0 {
+		return true
+	}
+	if len(pkt) < header.IPv6MinimumSize {
+		return false
+	}
+	ip := header.IPv6(pkt)
+	src, dst := net.IP(pkt[8:24]), net.IP(pkt[24:40])
+	proto := uint8(ip.TransportProtocol())
+	var srcPort, dstPort uint16
+	var hasPorts bool
+	if payload := pkt[header.IPv6MinimumSize:]; len(payload) >= 4 {
+		switch ip.TransportProtocol() {
+		case header.TCPProtocolNumber, header.UDPProtocolNumber:
+			srcPort = binary.BigEndian.Uint16(payload[0:])
+			dstPort = binary.BigEndian.Uint16(payload[2:])
+			hasPorts = true
+		}
+	}
+	for _, terms := range f {
+		matched := true
+		for _, t := range terms {
+			var m bool
+			switch t.kind {
+			case "net":
+				m = (t.dir != "dst" && t.net.Contains(src)) || (t.dir != "src" && t.net.Contains(dst))
+			case "port":
+				m = hasPorts && ((t.dir != "dst" && srcPort == t.port) || (t.dir != "src" && dstPort == t.port))
+			case "proto":
+				m = proto == t.proto
+			}
+			if m == t.not {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// StartCapture starts capturing packets read from and written to the
+// Yggdrasil network, replacing any capture already running.
+func (s *YggdrasilNetstack) StartCapture(options CaptureOptions) error {
+	c, err := NewPacketCapture(options)
+	if err != nil {
+		return err
+	}
+	c.failed = func(err error) {
+		s.logger.Errorf("Stopped capturing packets: %s", err)
+		s.nic.capture.CompareAndSwap(c, nil)
+	}
+	if old := s.nic.capture.Swap(c); old != nil {
+		_ = old.Close()
+	}
+	return nil
+}
+
+// StopCapture stops the running capture, if any.
+func (s *YggdrasilNetstack) StopCapture() error {
+	if c := s.nic.capture.Swap(nil); c != nil {
+		return c.Close()
+	}
+	return nil
+}
+
+// Capturing returns the options of the running capture, if any.
+func (s *YggdrasilNetstack) Capturing() (CaptureOptions, bool) {
+	if c := s.nic.capture.Load(); c != nil {
+		return c.options, true
+	}
+	return CaptureOptions{}, false
+}
@@ -0,0 +1,135 @@
+package netstack
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCaptureFilter(t *testing.T) {
+	pkt := buildUDPPacket(net.ParseIP("200::1"), net.ParseIP("300::2"), 1234, 53, []byte("query"))
+	tests := []struct {
+		filter string
+		match  bool
+	}{
+		{"", true},
+		{"udp", true},
+		{"tcp", false},
+		{"not tcp", true},
+		{"host 200::1", true},
+		{"src host 200::1", true},
+		{"dst host 200::1", false},
+		{"net 300::/64 and port 53", true},
+		{"dst port 1234", false},
+		{"tcp or dst port 53", true},
+		{"tcp or udp and port 80", false},
+	}
+	for _, test := range tests {
+		f, err := ParseCaptureFilter(test.filter)
+		if err != nil {
+			t.Fatalf("%q: %s", test.filter, err)
+		}
+		if f.Match(pkt) != test.match {
+			t.Errorf("%q: expected match %v", test.filter, test.match)
+		}
+	}
+	for _, filter := range []string{"port", "host 10.0.0.1", "or udp", "udp or", "src tcp", "not", "bogus"} {
+		if _, err := ParseCaptureFilter(filter); err == nil {
+			t.Errorf("%q: expected an error", filter)
+		}
+	}
+}
+
+func TestPacketCaptureRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ygg.pcap")
+	pkt := buildUDPPacket(net.ParseIP("200::1"), net.ParseIP("200::2"), 1, 2, make([]byte, 100))
+	record := int64(16 + len(pkt))
+	c, err := NewPacketCapture(CaptureOptions{
+		Path:     path,
+		MaxSize:  24 + 2*record,
+		MaxFiles: 2,
+		Filter:   "udp",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		c.WritePacket(pkt)
+	}
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 7 packets make for three full files, of which the oldest is gone
+	for name, packets := range map[string]int64{path: 1, path + ".1": 2, path + ".2": 2} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(data)) != 24+packets*record {
+			t.Errorf("%s: unexpected size %d", name, len(data))
+		}
+		if binary.LittleEndian.Uint32(data) != pcapMagic || binary.LittleEndian.Uint32(data[20:]) != pcapLinkTypeRaw {
+			t.Errorf("%s: bad pcap header", name)
+		}
+	}
+	if _, err = os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected no third rotated file")
+	}
+}
+
+func TestPacketCaptureKeepsOtherFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "important")
+	if err := os.WriteFile(path, []byte("important data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPacketCapture(CaptureOptions{Path: path}); err == nil {
+		t.Fatal("a file which is not a capture should not be overwritten")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "important data" {
+		t.Fatalf("file was changed to %q", data)
+	}
+	if _, err := NewPacketCapture(CaptureOptions{Path: filepath.Dir(path)}); err == nil {
+		t.Fatal("a directory should not be captured to")
+	}
+
+	// An earlier capture is replaced
+	path = filepath.Join(t.TempDir(), "ygg.pcap")
+	for i := 0; i < 2; i++ {
+		c, err := NewPacketCapture(CaptureOptions{Path: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = c.Close()
+	}
+}
+
+func TestPacketCaptureRotationFailure(t *testing.T) {
+	s := newTestNetstack(t)
+	path := filepath.Join(t.TempDir(), "ygg.pcap")
+	if err := os.WriteFile(path+".1", []byte("important data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pkt := buildUDPPacket(net.ParseIP("200::1"), net.ParseIP("200::2"), 1, 2, make([]byte, 100))
+	if err := s.StartCapture(CaptureOptions{
+		Path:     path,
+		MaxSize:  24 + int64(16+len(pkt)),
+		MaxFiles: 1,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	c := s.nic.capture.Load()
+	c.WritePacket(pkt)
+	c.WritePacket(pkt)
+	if c.Err() == nil {
+		t.Fatal("rotating onto another file should stop the capture")
+	}
+	if _, ok := s.Capturing(); ok {
+		t.Fatal("a failed capture should not be reported as running")
+	}
+	if data, _ := os.ReadFile(path + ".1"); string(data) != "important data" {
+		t.Fatalf("file was changed to %q", data)
+	}
+}
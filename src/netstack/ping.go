@@ -0,0 +1,63 @@
+package netstack
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// How long Ping waits for each reply before sending another request
+const pingInterval = time.Second
+
+// Ping sends ICMPv6 echo requests to the address until one is answered
+// or the context is done, and returns the round trip time of the reply.
+// Unanswered requests are expected while the paths and sessions between
+// the nodes are set up, so a reply also means that datagrams can go both
+// ways.
+func (s *YggdrasilNetstack) Ping(ctx context.Context, ip net.IP) (time.Duration, error) {
+	var wq waiter.Queue
+	ep, terr := s.stack.NewEndpoint(icmp.ProtocolNumber6, ipv6.ProtocolNumber, &wq)
+	if terr != nil {
+		return 0, fmt.Errorf("s.stack.NewEndpoint: %s", terr.String())
+	}
+	conn := gonet.NewUDPConn(&wq, ep)
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	request := make([]byte, header.ICMPv6EchoMinimumSize)
+	reply := make([]byte, 1500)
+	for seq := uint16(1); ; seq++ {
+		echo := header.ICMPv6(request)
+		echo.SetType(header.ICMPv6EchoRequest)
+		echo.SetSequence(seq)
+		sent := time.Now()
+		if _, err := conn.WriteTo(request, &net.UDPAddr{IP: ip}); err != nil {
+			return 0, err
+		}
+		_ = conn.SetReadDeadline(sent.Add(pingInterval))
+		for {
+			n, _, err := conn.ReadFrom(reply)
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			if err != nil {
+				// Timed out, try again
+				break
+			}
+			answer := header.ICMPv6(reply[:n])
+			if n >= header.ICMPv6EchoMinimumSize && answer.Type() == header.ICMPv6EchoReply && answer.Sequence() == seq {
+				return time.Since(sent), nil
+			}
+		}
+	}
+}
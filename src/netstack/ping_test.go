@@ -0,0 +1,25 @@
+package netstack
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPing(t *testing.T) {
+	s := newTestNetstack(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.Ping(ctx, s.Address()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody answers for an unknown node, until the context is done
+	ctx, cancel = context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	if _, err := s.Ping(ctx, net.ParseIP("200::1")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to pass, got %v", err)
+	}
+}
@@ -0,0 +1,335 @@
+package netstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// Listen backlog used unless MaxInFlight is set, as in gonet
+const defaultListenBacklog = 10
+
+// BufferRange is the minimum, default and maximum size of a TCP buffer.
+// It can be set as a flag in the form min:default:max, i.e.
+// 4096:1048576:4194304.
+type BufferRange struct {
+	Min, Default, Max int
+}
+
+func (r *BufferRange) String() string {
+	return fmt.Sprintf("%d:%d:%d", r.Min, r.Default, r.Max)
+}
+
+func (r *BufferRange) Set(value string) error {
+	tokens := strings.Split(value, ":")
+	if len(tokens) != 3 {
+		return fmt.Errorf("buffer range must be min:default:max")
+	}
+	var sizes [3]int
+	for i, token := range tokens {
+		size, err := strconv.Atoi(token)
+		if err != nil || size <= 0 {
+			return fmt.Errorf("invalid buffer size %q", token)
+		}
+		sizes[i] = size
+	}
+	if sizes[0] > sizes[1] || sizes[1] > sizes[2] {
+		return fmt.Errorf("buffer range must satisfy min <= default <= max")
+	}
+	r.Min, r.Default, r.Max = sizes[0], sizes[1], sizes[2]
+	return nil
+}
+
+// Keepalive configures TCP keep-alive probes. It can be set as a flag in
+// the form idle:interval:count, i.e. 2h:75s:9, or "off".
+type Keepalive struct {
+	Idle     time.Duration // Zero disables keep-alives
+	Interval time.Duration
+	Count    int
+}
+
+func (k *Keepalive) String() string {
+	if k.Idle == 0 {
+		return "off"
+	}
+	return fmt.Sprintf("%s:%s:%d", k.Idle, k.Interval, k.Count)
+}
+
+func (k *Keepalive) Set(value string) error {
+	if value == "off" {
+		*k = Keepalive{}
+		return nil
+	}
+	tokens := strings.Split(value, ":")
+	if len(tokens) != 3 {
+		return fmt.Errorf("keepalive must be idle:interval:count or off")
+	}
+	idle, err := time.ParseDuration(tokens[0])
+	if err != nil || idle <= 0 {
+		return fmt.Errorf("invalid keepalive idle time %q", tokens[0])
+	}
+	interval, err := time.ParseDuration(tokens[1])
+	if err != nil || interval <= 0 {
+		return fmt.Errorf("invalid keepalive interval %q", tokens[1])
+	}
+	count, err := strconv.Atoi(tokens[2])
+	if err != nil || count <= 0 {
+		return fmt.Errorf("invalid keepalive count %q", tokens[2])
+	}
+	k.Idle, k.Interval, k.Count = idle, interval, count
+	return nil
+}
+
+// TCPOptions tunes the TCP implementation of the netstack
+type TCPOptions struct {
+	CongestionControl     string // "reno" or "cubic"
+	SACK                  bool
+	ModerateReceiveBuffer bool // Grow receive buffers automatically
+	ReceiveBuffer         BufferRange
+	SendBuffer            BufferRange
+	Keepalive             Keepalive
+	TimeWaitTimeout       time.Duration
+	MaxInFlight           int // Connections being set up at once, 0 for no limit
+}
+
+// DefaultTCPOptions returns the options which the netstack starts with
+func DefaultTCPOptions() TCPOptions {
+	return TCPOptions{
+		CongestionControl: "reno",
+		ReceiveBuffer: BufferRange{
+			Min:     tcp.MinBufferSize,
+			Default: tcp.DefaultReceiveBufferSize,
+			Max:     tcp.MaxBufferSize,
+		},
+		SendBuffer: BufferRange{
+			Min:     tcp.MinBufferSize,
+			Default: tcp.DefaultSendBufferSize,
+			Max:     tcp.MaxBufferSize,
+		},
+		TimeWaitTimeout: tcp.DefaultTCPTimeWaitTimeout,
+	}
+}
+
+// SetTCPOptions applies the options to the netstack. Buffer sizes and
+// keep-alives only affect connections created afterwards.
+func (s *YggdrasilNetstack) SetTCPOptions(options TCPOptions) error {
+	cc := tcpip.CongestionControlOption(options.CongestionControl)
+	sack := tcpip.TCPSACKEnabled(options.SACK)
+	moderate := tcpip.TCPModerateReceiveBufferOption(options.ModerateReceiveBuffer)
+	rcvbuf := tcpip.TCPReceiveBufferSizeRangeOption(options.ReceiveBuffer)
+	sndbuf := tcpip.TCPSendBufferSizeRangeOption(options.SendBuffer)
+	timewait := tcpip.TCPTimeWaitTimeoutOption(options.TimeWaitTimeout)
+	for _, opt := range []struct {
+		name   string
+		option tcpip.SettableTransportProtocolOption
+	}{
+		{"congestion control", &cc},
+		{"SACK", &sack},
+		{"receive buffer moderation", &moderate},
+		{"receive buffer", &rcvbuf},
+		{"send buffer", &sndbuf},
+		{"TIME_WAIT timeout", &timewait},
+	} {
+		if err := s.stack.SetTransportProtocolOption(tcp.ProtocolNumber, opt.option); err != nil {
+			return fmt.Errorf("failed to set TCP %s: %s", opt.name, err.String())
+		}
+	}
+	if options.MaxInFlight < 0 {
+		return fmt.Errorf("invalid maximum connections in flight %d", options.MaxInFlight)
+	}
+	var inFlight chan struct{}
+	if options.MaxInFlight > 0 {
+		inFlight = make(chan struct{}, options.MaxInFlight)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tcpOptions, s.tcpInFlight = options, inFlight
+	return nil
+}
+
+// TCPOptions returns the options last applied to the netstack
+func (s *YggdrasilNetstack) TCPOptions() TCPOptions {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.tcpOptions
+}
+
+// configureTCPEndpoint applies the per-connection options to a new
+// endpoint. Accepted connections inherit them from the listener.
+func (s *YggdrasilNetstack) configureTCPEndpoint(ep tcpip.Endpoint) {
+	keepalive := s.TCPOptions().Keepalive
+	if keepalive.Idle == 0 {
+		return
+	}
+	idle := tcpip.KeepaliveIdleOption(keepalive.Idle)
+	interval := tcpip.KeepaliveIntervalOption(keepalive.Interval)
+	_ = ep.SetSockOpt(&idle)
+	_ = ep.SetSockOpt(&interval)
+	_ = ep.SetSockOptInt(tcpip.KeepaliveCountOption, keepalive.Count)
+	ep.SocketOptions().SetKeepAlive(true)
+}
+
+// dialTCP connects like gonet.DialTCPWithBind, but configures the
+// endpoint first and counts towards the connections in flight.
+func (s *YggdrasilNetstack) dialTCP(ctx context.Context, laddr, raddr tcpip.FullAddress, pn tcpip.NetworkProtocolNumber) (*gonet.TCPConn, error) {
+	s.mutex.Lock()
+	inFlight := s.tcpInFlight
+	s.mutex.Unlock()
+	if inFlight != nil {
+		select {
+		case inFlight <- struct{}{}:
+			defer func() { <-inFlight }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	s.tcpDialing.Add(1)
+	defer s.tcpDialing.Add(-1)
+
+	var wq waiter.Queue
+	ep, tcperr := s.stack.NewEndpoint(tcp.ProtocolNumber, pn, &wq)
+	if tcperr != nil {
+		return nil, errors.New(tcperr.String())
+	}
+	s.configureTCPEndpoint(ep)
+	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.WritableEvents)
+	wq.EventRegister(&waitEntry)
+	defer wq.EventUnregister(&waitEntry)
+	if laddr != (tcpip.FullAddress{}) {
+		if tcperr = ep.Bind(laddr); tcperr != nil {
+			ep.Close()
+			return nil, fmt.Errorf("ep.Bind(%+v) = %s", laddr, tcperr)
+		}
+	}
+	tcperr = ep.Connect(raddr)
+	if _, ok := tcperr.(*tcpip.ErrConnectStarted); ok {
+		select {
+		case <-ctx.Done():
+			ep.Close()
+			return nil, ctx.Err()
+		case <-notifyCh:
+		}
+		tcperr = ep.LastError()
+	}
+	if tcperr != nil {
+		ep.Close()
+		return nil, &net.OpError{
+			Op:   "connect",
+			Net:  "tcp",
+			Addr: &net.TCPAddr{IP: net.IP(raddr.Addr.AsSlice()), Port: int(raddr.Port)},
+			Err:  errors.New(tcperr.String()),
+		}
+	}
+	return gonet.NewTCPConn(&wq, ep), nil
+}
+
+// listenTCP listens like gonet.ListenTCP, but configures the endpoint
+// first and uses MaxInFlight as the backlog.
+func (s *YggdrasilNetstack) listenTCP(addr tcpip.FullAddress, pn tcpip.NetworkProtocolNumber) (*gonet.TCPListener, error) {
+	var wq waiter.Queue
+	ep, tcperr := s.stack.NewEndpoint(tcp.ProtocolNumber, pn, &wq)
+	if tcperr != nil {
+		return nil, errors.New(tcperr.String())
+	}
+	s.configureTCPEndpoint(ep)
+	backlog := s.TCPOptions().MaxInFlight
+	if backlog == 0 {
+		backlog = defaultListenBacklog
+	}
+	if tcperr = ep.Bind(addr); tcperr != nil {
+		ep.Close()
+		return nil, &net.OpError{
+			Op:   "bind",
+			Net:  "tcp",
+			Addr: &net.TCPAddr{IP: net.IP(addr.Addr.AsSlice()), Port: int(addr.Port)},
+			Err:  errors.New(tcperr.String()),
+		}
+	}
+	if tcperr = ep.Listen(backlog); tcperr != nil {
+		ep.Close()
+		return nil, &net.OpError{
+			Op:   "listen",
+			Net:  "tcp",
+			Addr: &net.TCPAddr{IP: net.IP(addr.Addr.AsSlice()), Port: int(addr.Port)},
+			Err:  errors.New(tcperr.String()),
+		}
+	}
+	return gonet.NewTCPListener(s.stack, &wq, ep), nil
+}
+
+// TCPStats are counters from the netstack's TCP implementation
+type TCPStats struct {
+	CongestionControl    string `json:"congestion_control"`
+	SACK                 bool   `json:"sack"`
+	Dialing              int64  `json:"dialing"`
+	ActiveOpenings       uint64 `json:"active_openings"`
+	PassiveOpenings      uint64 `json:"passive_openings"`
+	CurrentEstablished   uint64 `json:"current_established"`
+	CurrentConnected     uint64 `json:"current_connected"`
+	FailedAttempts       uint64 `json:"failed_attempts"`
+	EstablishedResets    uint64 `json:"established_resets"`
+	EstablishedTimedout  uint64 `json:"established_timedout"`
+	ListenOverflowDrops  uint64 `json:"listen_overflow_drops"`
+	SegmentsSent         uint64 `json:"segments_sent"`
+	SegmentsReceived     uint64 `json:"segments_received"`
+	Retransmits          uint64 `json:"retransmits"`
+	FastRetransmits      uint64 `json:"fast_retransmits"`
+	SACKRecoveries       uint64 `json:"sack_recoveries"`
+	Timeouts             uint64 `json:"timeouts"`
+	ResetsSent           uint64 `json:"resets_sent"`
+	ResetsReceived       uint64 `json:"resets_received"`
+	ResetsDropped        uint64 `json:"resets_dropped"`
+	ChecksumErrors       uint64 `json:"checksum_errors"`
+	InvalidSegments      uint64 `json:"invalid_segments"`
+	SegmentSendErrors    uint64 `json:"segment_send_errors"`
+	SlowStartRetransmits uint64 `json:"slow_start_retransmits"`
+}
+
+// TCPStats returns the TCP counters of the netstack, to verify the
+// effect of the TCP options
+func (s *YggdrasilNetstack) TCPStats() TCPStats {
+	var cc tcpip.CongestionControlOption
+	var sack tcpip.TCPSACKEnabled
+	_ = s.stack.TransportProtocolOption(tcp.ProtocolNumber, &cc)
+	_ = s.stack.TransportProtocolOption(tcp.ProtocolNumber, &sack)
+	stats := s.stack.Stats().TCP
+	var resetsDropped uint64
+	if s.nic != nil {
+		resetsDropped = s.nic.rstDropped.Load()
+	}
+	return TCPStats{
+		CongestionControl:    string(cc),
+		SACK:                 bool(sack),
+		Dialing:              s.tcpDialing.Load(),
+		ActiveOpenings:       stats.ActiveConnectionOpenings.Value(),
+		PassiveOpenings:      stats.PassiveConnectionOpenings.Value(),
+		CurrentEstablished:   stats.CurrentEstablished.Value(),
+		CurrentConnected:     stats.CurrentConnected.Value(),
+		FailedAttempts:       stats.FailedConnectionAttempts.Value(),
+		EstablishedResets:    stats.EstablishedResets.Value(),
+		EstablishedTimedout:  stats.EstablishedTimedout.Value(),
+		ListenOverflowDrops:  stats.ListenOverflowSynDrop.Value() + stats.ListenOverflowAckDrop.Value(),
+		SegmentsSent:         stats.SegmentsSent.Value(),
+		SegmentsReceived:     stats.ValidSegmentsReceived.Value(),
+		Retransmits:          stats.Retransmits.Value(),
+		FastRetransmits:      stats.FastRetransmit.Value(),
+		SACKRecoveries:       stats.SACKRecovery.Value(),
+		Timeouts:             stats.Timeouts.Value(),
+		ResetsSent:           stats.ResetsSent.Value(),
+		ResetsReceived:       stats.ResetsReceived.Value(),
+		ResetsDropped:        resetsDropped,
+		ChecksumErrors:       stats.ChecksumErrors.Value(),
+		InvalidSegments:      stats.InvalidSegmentsReceived.Value(),
+		SegmentSendErrors:    stats.SegmentSendErrors.Value(),
+		SlowStartRetransmits: stats.SlowStartRetransmits.Value(),
+	}
+}
@@ -0,0 +1,117 @@
+package netstack
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+func TestTCPOptionFlags(t *testing.T) {
+	var r BufferRange
+	if err := r.Set("4096:65536:1048576"); err != nil {
+		t.Fatal(err)
+	}
+	if r != (BufferRange{4096, 65536, 1048576}) {
+		t.Fatalf("unexpected buffer range %v", r)
+	}
+	for _, value := range []string{"4096", "1:2:x", "8:4:16", "0:1:2"} {
+		if err := r.Set(value); err == nil {
+			t.Errorf("buffer range %q should be rejected", value)
+		}
+	}
+
+	var k Keepalive
+	if err := k.Set("30s:10s:3"); err != nil {
+		t.Fatal(err)
+	}
+	if k != (Keepalive{30 * time.Second, 10 * time.Second, 3}) || k.String() != "30s:10s:3" {
+		t.Fatalf("unexpected keepalive %v", k)
+	}
+	if err := k.Set("off"); err != nil || k != (Keepalive{}) {
+		t.Fatalf("keepalive should be off, got %v, %v", k, err)
+	}
+	for _, value := range []string{"30s", "30s:10s:0", "x:10s:3"} {
+		if err := k.Set(value); err == nil {
+			t.Errorf("keepalive %q should be rejected", value)
+		}
+	}
+}
+
+func TestTCPOptions(t *testing.T) {
+	s := newTestNetstack(t)
+	options := DefaultTCPOptions()
+	options.CongestionControl = "cubic"
+	options.SACK = true
+	options.ReceiveBuffer = BufferRange{4096, 65536, 1 << 20}
+	options.Keepalive = Keepalive{time.Minute, 10 * time.Second, 3}
+	options.TimeWaitTimeout = 5 * time.Second
+	options.MaxInFlight = 4
+	if err := s.SetTCPOptions(options); err != nil {
+		t.Fatal(err)
+	}
+
+	var rcvbuf tcpip.TCPReceiveBufferSizeRangeOption
+	if err := s.stack.TransportProtocolOption(tcp.ProtocolNumber, &rcvbuf); err != nil {
+		t.Fatal(err)
+	}
+	if BufferRange(rcvbuf) != options.ReceiveBuffer {
+		t.Fatalf("receive buffer range not applied, got %v", rcvbuf)
+	}
+	var timewait tcpip.TCPTimeWaitTimeoutOption
+	if err := s.stack.TransportProtocolOption(tcp.ProtocolNumber, &timewait); err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(timewait) != options.TimeWaitTimeout {
+		t.Fatalf("TIME_WAIT timeout not applied, got %v", timewait)
+	}
+
+	before := s.TCPStats()
+	if before.CongestionControl != "cubic" || !before.SACK {
+		t.Fatalf("unexpected stats %+v", before)
+	}
+	listener, err := s.ListenTCP(&net.TCPAddr{Port: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			_ = conn.Close()
+		}
+	}()
+	conn, err := s.DialTCP(&net.TCPAddr{IP: s.Address(), Port: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	after := s.TCPStats()
+	if after.ActiveOpenings != before.ActiveOpenings+1 || after.PassiveOpenings != before.PassiveOpenings+1 {
+		t.Fatalf("connection not counted, before %+v, after %+v", before, after)
+	}
+	if after.Dialing != 0 {
+		t.Fatalf("dial still counted as in flight")
+	}
+
+	options.CongestionControl = "bbr"
+	if err := s.SetTCPOptions(options); err == nil {
+		t.Fatal("unknown congestion control should be rejected")
+	}
+}
+
+func TestResetsDropped(t *testing.T) {
+	s := newTestNetstack(t)
+	nic := &YggdrasilNIC{stack: s, rstPackets: make(chan *stack.PacketBuffer, 1)}
+	for i := 0; i < 3; i++ {
+		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{})
+		nic.queueRST(pkt)
+		pkt.DecRef()
+	}
+	if dropped := nic.rstDropped.Load(); dropped != 2 {
+		t.Fatalf("expected 2 resets dropped, got %d", dropped)
+	}
+	(<-nic.rstPackets).DecRef()
+}
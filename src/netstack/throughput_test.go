@@ -0,0 +1,58 @@
+package netstack_test
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/yggdrasil-network/yggstack/src/netstack/netstacktest"
+)
+
+// BenchmarkTCPThroughput measures bulk TCP throughput between two nodes,
+// i.e. go test -run=^$ -bench=TCPThroughput -benchtime 3s ./src/netstack/
+//
+// On one core, three runs each:
+//
+//	one read, delivery and write buffer:    47.04, 45.81, 40.84 MB/s
+//	queued delivery, pooled write buffers:  47.64, 47.33, 54.27 MB/s
+//	delivering queued packets under one
+//	read lock rather than each on its own:  48.84, 49.53, 48.42 MB/s
+//	                                        vs 51.11, 51.76, 48.50 MB/s
+//
+// Taking the lock once for several packets made no difference, so each
+// packet is delivered on its own.
+func BenchmarkTCPThroughput(b *testing.B) {
+	server, client := netstacktest.NewPeered(b)
+	listener, err := server.ListenTCP(&net.TCPAddr{Port: 5001})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan int64, 1)
+	go func() {
+		c, err := listener.Accept()
+		if err != nil {
+			received <- 0
+			return
+		}
+		n, _ := io.Copy(io.Discard, c)
+		_ = c.Close()
+		received <- n
+	}()
+	c, err := client.DialTCP(&net.TCPAddr{IP: server.Address(), Port: 5001})
+	if err != nil {
+		b.Fatal(err)
+	}
+	chunk := make([]byte, 64*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = c.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	_ = c.Close()
+	if n := <-received; n != int64(b.N*len(chunk)) {
+		b.Fatalf("received %d of %d bytes", n, b.N*len(chunk))
+	}
+}
@@ -0,0 +1,179 @@
+//go:build linux
+
+package netstack
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/link/tun"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// TUNLink is a TUN adapter attached to the netstack, which lets host
+// applications reach the Yggdrasil network natively. The adapter is
+// driven by a channel endpoint rather than fdbased, as the latter can
+// deadlock when its NIC is removed while it is delivering a packet.
+type TUNLink struct {
+	*routedNIC
+	name     string
+	file     *os.File
+	endpoint *channel.Endpoint
+	cancel   context.CancelFunc
+}
+
+// AddTUN creates or attaches to the named TUN adapter and routes the
+// subnet to it. The host side of the adapter is brought up with the
+// second address of the subnet and a /7 prefix, so that the host routes
+// all Yggdrasil traffic through the adapter. This requires
+// CAP_NET_ADMIN.
+func (s *YggdrasilNetstack) AddTUN(name string, subnet net.IPNet) (*TUNLink, error) {
+	fd, err := tun.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("tun.Open: %w", err)
+	}
+	if err = unix.SetNonblock(fd, true); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("unix.SetNonblock: %w", err)
+	}
+	mtu := s.nic.MTU()
+	t := &TUNLink{
+		name:     name,
+		file:     os.NewFile(uintptr(fd), "/dev/net/tun"),
+		endpoint: channel.New(512, mtu, ""),
+	}
+	if t.routedNIC, err = s.attachNIC(t.endpoint, subnet); err != nil {
+		_ = t.file.Close()
+		return nil, err
+	}
+	var ctx context.Context
+	ctx, t.cancel = context.WithCancel(context.Background())
+	go t.readLoop(int(mtu))
+	go t.writeLoop(ctx)
+	if err = configureTUN(name, mtu, SubnetHost(subnet, 2), 7); err != nil {
+		_ = t.Close()
+		return nil, fmt.Errorf("configureTUN: %w", err)
+	}
+	return t, nil
+}
+
+// Name returns the name of the TUN adapter
+func (t *TUNLink) Name() string {
+	return t.name
+}
+
+func (t *TUNLink) readLoop(mtu int) {
+	buf := make([]byte, mtu)
+	for {
+		n, err := t.file.Read(buf)
+		if err != nil {
+			return
+		}
+		if n < header.IPv6MinimumSize || header.IPVersion(buf[:n]) != header.IPv6Version {
+			continue
+		}
+		pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{
+			Payload: buffer.MakeWithData(buf[:n]),
+		})
+		t.endpoint.InjectInbound(ipv6.ProtocolNumber, pkb)
+		pkb.DecRef()
+	}
+}
+
+func (t *TUNLink) writeLoop(ctx context.Context) {
+	for {
+		pkt := t.endpoint.ReadContext(ctx)
+		if pkt == nil {
+			return
+		}
+		view := pkt.ToView()
+		_, _ = t.file.Write(view.AsSlice())
+		view.Release()
+		pkt.DecRef()
+	}
+}
+
+// Close detaches the TUN adapter from the netstack and brings it down.
+func (t *TUNLink) Close() error {
+	t.cancel()
+	_ = setTUNUp(t.name, false)
+	err := t.detach()
+	_ = t.file.Close()
+	return err
+}
+
+type in6Ifreq struct {
+	addr      [16]byte
+	prefixlen uint32
+	ifindex   int32
+}
+
+// configureTUN sets the MTU and the address of the host side of the TUN
+// adapter and brings it up
+func configureTUN(name string, mtu uint32, addr net.IP, prefixlen uint32) error {
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("unix.Socket: %w", err)
+	}
+	defer unix.Close(fd) // nolint:errcheck
+
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		return fmt.Errorf("unix.NewIfreq: %w", err)
+	}
+	if err = unix.IoctlIfreq(fd, unix.SIOCGIFINDEX, ifr); err != nil {
+		return fmt.Errorf("SIOCGIFINDEX: %w", err)
+	}
+	req := in6Ifreq{
+		prefixlen: prefixlen,
+		ifindex:   int32(ifr.Uint32()),
+	}
+	copy(req.addr[:], addr.To16())
+
+	ifr.SetUint32(mtu)
+	if err = unix.IoctlIfreq(fd, unix.SIOCSIFMTU, ifr); err != nil {
+		return fmt.Errorf("SIOCSIFMTU: %w", err)
+	}
+	// Nothing else is on the link, so skip duplicate address detection,
+	// which would leave the address unusable for a moment
+	_ = os.WriteFile("/proc/sys/net/ipv6/conf/"+name+"/accept_dad", []byte("0"), 0644)
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCSIFADDR, uintptr(unsafe.Pointer(&req))); errno != 0 && errno != unix.EEXIST {
+		return fmt.Errorf("SIOCSIFADDR: %w", errno)
+	}
+	return setTUNUp(name, true)
+}
+
+// setTUNUp brings the host side of the TUN adapter up or down
+func setTUNUp(name string, up bool) error {
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("unix.Socket: %w", err)
+	}
+	defer unix.Close(fd) // nolint:errcheck
+
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		return fmt.Errorf("unix.NewIfreq: %w", err)
+	}
+	if err = unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("SIOCGIFFLAGS: %w", err)
+	}
+	if up {
+		ifr.SetUint16(ifr.Uint16() | unix.IFF_UP | unix.IFF_RUNNING)
+	} else {
+		ifr.SetUint16(ifr.Uint16() &^ unix.IFF_UP)
+	}
+	if err = unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("SIOCSIFFLAGS: %w", err)
+	}
+	return nil
+}
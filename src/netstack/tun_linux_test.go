@@ -0,0 +1,104 @@
+//go:build linux
+
+package netstack
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestTUN runs in its own user and network namespace, so that it needs
+// no privileges and leaves the host's interfaces alone.
+func TestTUN(t *testing.T) {
+	if os.Getenv("YGGSTACK_TUN_TEST") == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestTUN$", "-test.v")
+		cmd.Env = append(os.Environ(), "YGGSTACK_TUN_TEST=1")
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET,
+			UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+			GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		}
+		var out bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &out, &out
+		if err := cmd.Start(); err != nil {
+			t.Skipf("user namespaces are not available: %s", err)
+		}
+		if err := cmd.Wait(); err != nil {
+			t.Fatalf("%s\n%s", err, out.String())
+		}
+		if bytes.Contains(out.Bytes(), []byte("--- SKIP")) {
+			t.Skip(out.String())
+		}
+		return
+	}
+
+	s := newTestNetstack(t)
+	link, err := s.AddTUN("ygg0", s.Subnet())
+	if err != nil {
+		t.Skipf("TUN is not available: %s", err)
+	}
+	defer link.Close()
+	gateway, host := SubnetHost(s.Subnet(), 1), SubnetHost(s.Subnet(), 2)
+
+	// A host application connects to the netstack
+	listener, err := s.ListenTCP(&net.TCPAddr{IP: gateway, Port: 8080})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		c, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.WriteString(c, "from netstack")
+		_ = c.Close()
+	}()
+	// The host address is usable once the kernel notices the link is up
+	var c net.Conn
+	for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		c, err = net.DialTimeout("tcp", net.JoinHostPort(gateway.String(), "8080"), 5*time.Second)
+		if err == nil || !errors.Is(err, syscall.EADDRNOTAVAIL) || time.Since(start) > 5*time.Second {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(c)
+	_ = c.Close()
+	if err != nil || string(got) != "from netstack" {
+		t.Fatalf("unexpected response %q: %v", got, err)
+	}
+
+	// The netstack connects to a host application
+	hostListener, err := net.ListenTCP("tcp6", &net.TCPAddr{IP: host})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hostListener.Close()
+	go func() {
+		c, err := hostListener.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.WriteString(c, "from host")
+		_ = c.Close()
+	}()
+	r, err := s.DialTCP(hostListener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = io.ReadAll(r)
+	_ = r.Close()
+	if err != nil || string(got) != "from host" {
+		t.Fatalf("unexpected response %q: %v", got, err)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package netstack
+
+import (
+	"fmt"
+	"net"
+)
+
+// TUNLink is a TUN adapter attached to the netstack, which is only
+// supported on Linux
+type TUNLink struct{}
+
+// AddTUN always fails on this platform
+func (s *YggdrasilNetstack) AddTUN(name string, subnet net.IPNet) (*TUNLink, error) {
+	return nil, fmt.Errorf("TUN mode is not supported on this platform")
+}
+
+func (t *TUNLink) Name() string {
+	return ""
+}
+
+func (t *TUNLink) Close() error {
+	return nil
+}
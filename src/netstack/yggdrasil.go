@@ -1,8 +1,10 @@
 package netstack
 
 import (
-	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/yggdrasil-network/yggdrasil-go/src/core"
 	"github.com/yggdrasil-network/yggdrasil-go/src/ipv6rwc"
@@ -15,51 +17,55 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 )
 
+// How the NIC retries reading from the Yggdrasil network after errors,
+// before giving up and failing the netstack
+var (
+	readRetryMin = 100 * time.Millisecond
+	readRetryMax = 5 * time.Second
+	readRetries  = 8
+)
+
+const (
+	readQueueSize = 256 // Packets read but not yet delivered
+	rstQueueSize  = 100 // Resets waiting to be written
+)
+
 type YggdrasilNIC struct {
 	stack      *YggdrasilNetstack
 	ipv6rwc    *ipv6rwc.ReadWriteCloser
+	mutex      sync.RWMutex
 	dispatcher stack.NetworkDispatcher
-	readBuf    []byte
-	writeBuf   []byte
+	readQueue  chan *buffer.View
+	writeBufs  sync.Pool
 	rstPackets chan *stack.PacketBuffer
+	rstDropped atomic.Uint64
+	rstFull    atomic.Bool
+	capture    atomic.Pointer[PacketCapture]
+	closing    atomic.Bool
+	closed     chan struct{}
 }
 
 func (s *YggdrasilNetstack) NewYggdrasilNIC(ygg *core.Core) tcpip.Error {
 	rwc := ipv6rwc.NewReadWriteCloser(ygg)
 	mtu := rwc.MTU()
 	nic := &YggdrasilNIC{
+		stack:      s,
 		ipv6rwc:    rwc,
-		readBuf:    make([]byte, mtu),
-		writeBuf:   make([]byte, mtu),
-		rstPackets: make(chan *stack.PacketBuffer, 100),
+		readQueue:  make(chan *buffer.View, readQueueSize),
+		rstPackets: make(chan *stack.PacketBuffer, rstQueueSize),
+		closed:     make(chan struct{}),
+	}
+	nic.writeBufs.New = func() any {
+		buf := make([]byte, 0, mtu)
+		return &buf
 	}
 	if err := s.stack.CreateNIC(1, nic); err != nil {
 		return err
 	}
-	go func() {
-		var rx int
-		var err error
-		for {
-			rx, err = nic.ipv6rwc.Read(nic.readBuf)
-			if err != nil {
-				log.Println(err)
-				break
-			}
-			pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{
-				Payload: buffer.MakeWithData(nic.readBuf[:rx]),
-			})
-			nic.dispatcher.DeliverNetworkPacket(ipv6.ProtocolNumber, pkb)
-		}
-	}()
-	go func() {
-		for {
-			pkt := <- nic.rstPackets
-			if pkt == nil {
-				continue
-			}
-			_ = nic.writePacket(pkt)
-		}
-	}()
+	s.nic = nic
+	go nic.readLoop(int(mtu), readRetryMin, readRetryMax, readRetries)
+	go nic.deliverLoop()
+	go nic.rstLoop()
 	_, snet, err := net.ParseCIDR("0200::/7")
 	if err != nil {
 		return &tcpip.ErrBadAddress{}
@@ -91,9 +97,121 @@ func (s *YggdrasilNetstack) NewYggdrasilNIC(ygg *core.Core) tcpip.Error {
 	return nil
 }
 
-func (e *YggdrasilNIC) Attach(dispatcher stack.NetworkDispatcher) { e.dispatcher = dispatcher }
+// readLoop reads packets from the Yggdrasil network and queues them for
+// the deliverLoop, so that reading the next packet overlaps with the
+// netstack processing the previous ones. Read errors are retried with a
+// backoff while the netstack is reported as degraded, and fail the
+// netstack if they persist.
+func (e *YggdrasilNIC) readLoop(mtu int, retryMin, retryMax time.Duration, retries int) {
+	buf := make([]byte, mtu)
+	failures, backoff := 0, retryMin
+	for {
+		rx, err := e.ipv6rwc.Read(buf)
+		if err != nil {
+			if e.isClosed() {
+				return
+			}
+			if failures++; failures > retries {
+				e.stack.setHealth(HealthFailed, err)
+				return
+			}
+			e.stack.logger.Warnf("Failed to read from the Yggdrasil network, retrying in %s: %s", backoff, err)
+			e.stack.setHealth(HealthDegraded, err)
+			select {
+			case <-time.After(backoff):
+			case <-e.closed:
+				return
+			}
+			if backoff *= 2; backoff > retryMax {
+				backoff = retryMax
+			}
+			continue
+		}
+		if failures > 0 {
+			e.stack.logger.Infof("Reading from the Yggdrasil network recovered")
+			e.stack.setHealth(HealthOK, nil)
+			failures, backoff = 0, retryMin
+		}
+		if c := e.capture.Load(); c != nil {
+			c.WritePacket(buf[:rx])
+		}
+		// The view comes from a pool of chunks sized to fit the packet
+		v := buffer.NewViewWithData(buf[:rx])
+		select {
+		case e.readQueue <- v:
+		case <-e.closed:
+			v.Release()
+			return
+		}
+	}
+}
+
+// deliverLoop hands queued packets to the netstack.
+func (e *YggdrasilNIC) deliverLoop() {
+	for {
+		select {
+		case v := <-e.readQueue:
+			e.deliver(v)
+		case <-e.closed:
+			return
+		}
+	}
+}
+
+func (e *YggdrasilNIC) deliver(v *buffer.View) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	if e.dispatcher == nil {
+		v.Release()
+		return
+	}
+	pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithView(v),
+	})
+	e.dispatcher.DeliverNetworkPacket(ipv6.ProtocolNumber, pkb)
+	pkb.DecRef()
+}
+
+// rstLoop writes the resets queued by WritePackets.
+func (e *YggdrasilNIC) rstLoop() {
+	for {
+		select {
+		case pkt := <-e.rstPackets:
+			_ = e.writePacket(pkt)
+			pkt.DecRef()
+		case <-e.closed:
+			for {
+				select {
+				case pkt := <-e.rstPackets:
+					pkt.DecRef()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *YggdrasilNIC) isClosed() bool {
+	select {
+	case <-e.closed:
+		return true
+	default:
+		return false
+	}
+}
 
-func (e *YggdrasilNIC) IsAttached() bool { return e.dispatcher != nil }
+func (e *YggdrasilNIC) Attach(dispatcher stack.NetworkDispatcher) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.dispatcher = dispatcher
+}
+
+func (e *YggdrasilNIC) IsAttached() bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.dispatcher != nil
+}
 
 func (e *YggdrasilNIC) MTU() uint32 { return uint32(e.ipv6rwc.MTU()) }
 
@@ -109,52 +227,74 @@ func (*YggdrasilNIC) SetLinkAddress(tcpip.LinkAddress) {}
 
 func (*YggdrasilNIC) Wait() {}
 
-func (e *YggdrasilNIC) writePacket(
-	pkt *stack.PacketBuffer,
-) tcpip.Error {
-	// We need to recover from panic() here because
-	// parser in ToView() gets confused on some packets
-	// without payload and panics
-	defer func() {
-		r := recover()
-		if r != nil {
+// writePacket writes the packet to the Yggdrasil network, which copies
+// it, so a packet in one piece is passed as is and others are gathered
+// into a pooled buffer.
+func (e *YggdrasilNIC) writePacket(pkt *stack.PacketBuffer) tcpip.Error {
+	var data []byte
+	if slices := pkt.AsSlices(); len(slices) == 1 {
+		data = slices[0]
+	} else {
+		bufp := e.writeBufs.Get().(*[]byte)
+		defer e.writeBufs.Put(bufp)
+		data = (*bufp)[:0]
+		for _, slice := range slices {
+			data = append(data, slice...)
 		}
-	}()
-	vv := pkt.ToView()
-	n, err := vv.Read(e.writeBuf)
-	if err != nil {
-		return &tcpip.ErrAborted{}
+		*bufp = data
 	}
-	_, err = e.ipv6rwc.Write(e.writeBuf[:n])
-	if err != nil {
+	if c := e.capture.Load(); c != nil {
+		c.WritePacket(data)
+	}
+	if _, err := e.ipv6rwc.Write(data); err != nil {
 		return &tcpip.ErrAborted{}
 	}
 	return nil
 }
 
-func (e *YggdrasilNIC) WritePackets(
-	list stack.PacketBufferList,
-) (int, tcpip.Error) {
-	var i int = 0
-	var err tcpip.Error = nil
-	for i, pkt := range list.AsSlice() {
-		if pkt.Data().Size() == 0 {
-			if pkt.Network().TransportProtocol() == tcp.ProtocolNumber {
-				tcpHeader := header.TCP(pkt.TransportHeader().Slice())
-				if (tcpHeader.Flags() & header.TCPFlagRst) == header.TCPFlagRst {
-					e.rstPackets <- pkt
-					continue
-				}
-			}
+// WritePackets writes the packets in order. Resets without payload are
+// handed to a separate goroutine instead, so that tearing a connection
+// down never waits on the Yggdrasil network.
+func (e *YggdrasilNIC) WritePackets(list stack.PacketBufferList) (int, tcpip.Error) {
+	written := 0
+	for _, pkt := range list.AsSlice() {
+		if isEmptyRST(pkt) {
+			e.queueRST(pkt)
+			written++
+			continue
 		}
-		err = e.writePacket(pkt)
-		if err != nil {
-			log.Println(err)
-			return i - 1, err
+		if err := e.writePacket(pkt); err != nil {
+			e.stack.logger.Debugf("Failed to write to the Yggdrasil network: %s", err)
+			return written, err
 		}
+		written++
 	}
+	return written, nil
+}
 
-	return i, nil
+// queueRST queues the reset for the rstLoop, or drops it if the queue is
+// full. The peer then only learns that the connection is gone when its
+// next segment is answered with another reset.
+func (e *YggdrasilNIC) queueRST(pkt *stack.PacketBuffer) {
+	pkt.IncRef()
+	select {
+	case e.rstPackets <- pkt:
+		e.rstFull.Store(false)
+	default:
+		pkt.DecRef()
+		e.rstDropped.Add(1)
+		if !e.rstFull.Swap(true) {
+			e.stack.logger.Warnf("Dropping TCP resets, %d are already waiting to be written to the Yggdrasil network", cap(e.rstPackets))
+		}
+	}
+}
+
+func isEmptyRST(pkt *stack.PacketBuffer) bool {
+	if pkt.Data().Size() != 0 || pkt.Network().TransportProtocol() != tcp.ProtocolNumber {
+		return false
+	}
+	tcpHeader := header.TCP(pkt.TransportHeader().Slice())
+	return len(tcpHeader) >= header.TCPMinimumSize && tcpHeader.Flags()&header.TCPFlagRst != 0
 }
 
 func (e *YggdrasilNIC) WriteRawPacket(*stack.PacketBuffer) tcpip.Error {
@@ -172,9 +312,15 @@ func (e *YggdrasilNIC) ParseHeader(*stack.PacketBuffer) bool {
 	return true
 }
 
+// Close stops the NIC. Read errors after this are expected, as the
+// Yggdrasil core is stopped next, and are not reported.
 func (e *YggdrasilNIC) Close() {
+	// RemoveNIC calls Close again once the NIC is removed
+	if e.closing.Swap(true) {
+		return
+	}
+	close(e.closed)
 	e.stack.stack.RemoveNIC(1)
-	e.dispatcher = nil
 }
 
 func (e *YggdrasilNIC) SetOnCloseAction(func()) {}
@@ -0,0 +1,282 @@
+package types
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+)
+
+// BalancePolicy decides which target of a mapping a connection goes to
+type BalancePolicy string
+
+const (
+	BalanceRoundRobin BalancePolicy = "round-robin" // Each target in turn
+	BalanceLeastConn  BalancePolicy = "least-conn"  // The target with the fewest open connections
+	BalanceFailover   BalancePolicy = "failover"    // The first target which is up
+)
+
+// ParseBalancePolicy parses a balancing policy, where an empty one is
+// round-robin
+func ParseBalancePolicy(policy string) (BalancePolicy, error) {
+	switch p := BalancePolicy(policy); p {
+	case "":
+		return BalanceRoundRobin, nil
+	case BalanceRoundRobin, BalanceLeastConn, BalanceFailover:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown balancing policy %q, expected %q, %q or %q", policy, BalanceRoundRobin, BalanceLeastConn, BalanceFailover)
+	}
+}
+
+// Defaults for HealthOptions
+const (
+	DefaultHealthInterval = 10 * time.Second
+	DefaultHealthTimeout  = 5 * time.Second
+	DefaultEjectTime      = 30 * time.Second
+)
+
+// HealthOptions configures how a Balancer finds targets which are down
+type HealthOptions struct {
+	Interval  time.Duration // Dial each target this often, 0 for no active checks
+	Timeout   time.Duration // Give up on a dial to one of several targets after this long
+	EjectTime time.Duration // Skip a target after a failed dial for this long
+}
+
+// TargetStats describes a target of a Balancer
+type TargetStats struct {
+	Address   string `json:"address"`
+	Healthy   bool   `json:"healthy"`
+	Active    int64  `json:"active"`
+	Conns     uint64 `json:"conns"`
+	Failures  uint64 `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+type balancerTarget struct {
+	addr     *net.TCPAddr
+	active   atomic.Int64
+	conns    atomic.Uint64
+	failures atomic.Uint64
+	mutex    sync.Mutex
+	ejected  time.Time // Until when the target is skipped
+	lastErr  error
+}
+
+func (t *balancerTarget) healthy(now time.Time) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return !now.Before(t.ejected)
+}
+
+// Balancer spreads the connections of a mapping over its targets. Targets
+// are ejected for a while when dialling them fails, either for a
+// connection or for an active health check, and a connection tries the
+// next target instead. Ejected targets are only used if all of them are.
+type Balancer struct {
+	name    string
+	policy  BalancePolicy
+	dial    func(ctx context.Context, addr *net.TCPAddr) (net.Conn, error)
+	options HealthOptions
+	logger  core.Logger
+	targets []*balancerTarget
+	next    atomic.Uint64
+}
+
+// NewBalancer creates a balancer which dials the targets with dial. Zero
+// timeouts are replaced with the defaults.
+func NewBalancer(name string, targets []*net.TCPAddr, policy BalancePolicy, dial func(ctx context.Context, addr *net.TCPAddr) (net.Conn, error), options HealthOptions, logger core.Logger) *Balancer {
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultHealthTimeout
+	}
+	if options.EjectTime <= 0 {
+		options.EjectTime = DefaultEjectTime
+	}
+	if policy == "" {
+		policy = BalanceRoundRobin
+	}
+	b := &Balancer{
+		name:    name,
+		policy:  policy,
+		dial:    dial,
+		options: options,
+		logger:  logger,
+	}
+	for _, addr := range targets {
+		b.targets = append(b.targets, &balancerTarget{addr: addr})
+	}
+	return b
+}
+
+// Name returns the name of the balancer, which is used in its logs
+func (b *Balancer) Name() string {
+	return b.name
+}
+
+// order returns the targets in the order to try them for a connection
+func (b *Balancer) order() []*balancerTarget {
+	targets := make([]*balancerTarget, 0, len(b.targets))
+	switch b.policy {
+	case BalanceFailover:
+		targets = append(targets, b.targets...)
+	default:
+		start := int(b.next.Add(1)-1) % len(b.targets)
+		targets = append(targets, b.targets[start:]...)
+		targets = append(targets, b.targets[:start]...)
+		if b.policy == BalanceLeastConn {
+			sort.SliceStable(targets, func(i, j int) bool {
+				return targets[i].active.Load() < targets[j].active.Load()
+			})
+		}
+	}
+	// Healthy targets first, keeping the order otherwise
+	now := time.Now()
+	sort.SliceStable(targets, func(i, j int) bool {
+		return targets[i].healthy(now) && !targets[j].healthy(now)
+	})
+	return targets
+}
+
+// Dial connects to a target chosen by the policy, trying the others in
+// turn if that fails or takes longer than the timeout. With only one
+// target there is nothing else to try, so its dial is not timed out. The
+// target counts the connection as open until it is closed.
+func (b *Balancer) Dial(ctx context.Context) (net.Conn, error) {
+	var err error
+	for _, target := range b.order() {
+		var conn net.Conn
+		conn, err = b.dialTarget(ctx, target)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			b.eject(target, err)
+			continue
+		}
+		b.restore(target)
+		target.active.Add(1)
+		target.conns.Add(1)
+		return &balancedConn{Conn: conn, target: target}, nil
+	}
+	return nil, err
+}
+
+// dialTarget dials the target, giving up after the timeout if there are
+// other targets to try
+func (b *Balancer) dialTarget(ctx context.Context, target *balancerTarget) (net.Conn, error) {
+	if len(b.targets) > 1 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.options.Timeout)
+		defer cancel()
+	}
+	return b.dial(ctx, target.addr)
+}
+
+func (b *Balancer) eject(target *balancerTarget, err error) {
+	target.failures.Add(1)
+	target.mutex.Lock()
+	wasHealthy := !time.Now().Before(target.ejected)
+	target.ejected = time.Now().Add(b.options.EjectTime)
+	target.lastErr = err
+	target.mutex.Unlock()
+	if wasHealthy && len(b.targets) > 1 {
+		b.logger.Warnf("Target %s of %s is down, skipping it: %s", target.addr, b.name, err)
+	}
+}
+
+func (b *Balancer) restore(target *balancerTarget) {
+	target.mutex.Lock()
+	wasHealthy := !time.Now().Before(target.ejected)
+	target.ejected = time.Time{}
+	target.lastErr = nil
+	target.mutex.Unlock()
+	if !wasHealthy && len(b.targets) > 1 {
+		b.logger.Infof("Target %s of %s is up again", target.addr, b.name)
+	}
+}
+
+// Check dials each target once, and ejects or restores it by the result
+func (b *Balancer) Check(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, target := range b.targets {
+		wg.Add(1)
+		go func(target *balancerTarget) {
+			defer wg.Done()
+			dialCtx, cancel := context.WithTimeout(ctx, b.options.Timeout)
+			defer cancel()
+			conn, err := b.dial(dialCtx, target.addr)
+			if err != nil {
+				// Not the fault of the target if the balancer is stopping
+				if ctx.Err() == nil {
+					b.eject(target, err)
+				}
+				return
+			}
+			_ = conn.Close()
+			b.restore(target)
+		}(target)
+	}
+	wg.Wait()
+}
+
+// Run checks the targets at the interval until the context is done. It
+// returns right away if active checks are disabled or there is only one
+// target, which is used either way.
+func (b *Balancer) Run(ctx context.Context) {
+	if b.options.Interval <= 0 || len(b.targets) < 2 {
+		return
+	}
+	ticker := time.NewTicker(b.options.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.Check(ctx)
+		}
+	}
+}
+
+// Stats returns the state of each target
+func (b *Balancer) Stats() []TargetStats {
+	now := time.Now()
+	stats := make([]TargetStats, 0, len(b.targets))
+	for _, target := range b.targets {
+		s := TargetStats{
+			Address:  target.addr.String(),
+			Healthy:  target.healthy(now),
+			Active:   target.active.Load(),
+			Conns:    target.conns.Load(),
+			Failures: target.failures.Load(),
+		}
+		target.mutex.Lock()
+		if target.lastErr != nil {
+			s.LastError = target.lastErr.Error()
+		}
+		target.mutex.Unlock()
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// balancedConn counts as an open connection of its target until closed
+type balancedConn struct {
+	net.Conn
+	target *balancerTarget
+	once   sync.Once
+}
+
+func (c *balancedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *balancedConn) Close() error {
+	c.once.Do(func() { c.target.active.Add(-1) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,171 @@
+package types
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gologme/log"
+)
+
+// fakeTargets dials pipes to the targets, failing for those marked down
+// and blocking until the dial is cancelled for those marked hanging
+type fakeTargets struct {
+	mutex   sync.Mutex
+	down    map[int]bool
+	hanging map[int]bool
+	dials   []int
+}
+
+func (f *fakeTargets) dial(ctx context.Context, addr *net.TCPAddr) (net.Conn, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.dials = append(f.dials, addr.Port)
+	if f.down[addr.Port] {
+		return nil, fmt.Errorf("target %d is down", addr.Port)
+	}
+	if f.hanging[addr.Port] {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	c, s := net.Pipe()
+	_ = s.Close()
+	return c, nil
+}
+
+func (f *fakeTargets) setDown(port int, down bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.down[port] = down
+}
+
+func newTestBalancer(policy BalancePolicy, options HealthOptions) (*Balancer, *fakeTargets) {
+	f := &fakeTargets{down: map[int]bool{}, hanging: map[int]bool{}}
+	targets := []*net.TCPAddr{{Port: 1}, {Port: 2}, {Port: 3}}
+	return NewBalancer("test", targets, policy, f.dial, options, log.New(io.Discard, "", 0)), f
+}
+
+// dialTargets opens count connections and returns the target port of each
+func dialTargets(t *testing.T, b *Balancer, count int) ([]int, []net.Conn) {
+	t.Helper()
+	var ports []int
+	var conns []net.Conn
+	for i := 0; i < count; i++ {
+		c, err := b.Dial(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, c.(*balancedConn).target.addr.Port)
+		conns = append(conns, c)
+	}
+	return ports, conns
+}
+
+func TestBalancerPolicies(t *testing.T) {
+	t.Run("RoundRobin", func(t *testing.T) {
+		b, _ := newTestBalancer(BalanceRoundRobin, HealthOptions{})
+		if ports, _ := dialTargets(t, b, 4); fmt.Sprint(ports) != "[1 2 3 1]" {
+			t.Fatalf("unexpected targets %v", ports)
+		}
+	})
+	t.Run("LeastConn", func(t *testing.T) {
+		b, _ := newTestBalancer(BalanceLeastConn, HealthOptions{})
+		_, conns := dialTargets(t, b, 3)
+		_ = conns[1].Close()
+		_ = conns[1].Close() // Closing twice doesn't count twice
+		if ports, _ := dialTargets(t, b, 1); ports[0] != 2 {
+			t.Fatalf("expected the target without connections, got %d", ports[0])
+		}
+		if stats := b.Stats(); stats[1].Active != 1 || stats[1].Conns != 2 {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+	})
+	t.Run("Failover", func(t *testing.T) {
+		b, f := newTestBalancer(BalanceFailover, HealthOptions{})
+		if ports, _ := dialTargets(t, b, 2); fmt.Sprint(ports) != "[1 1]" {
+			t.Fatalf("unexpected targets %v", ports)
+		}
+		f.setDown(1, true)
+		if ports, _ := dialTargets(t, b, 2); fmt.Sprint(ports) != "[2 2]" {
+			t.Fatalf("unexpected targets %v", ports)
+		}
+	})
+}
+
+func TestBalancerEjection(t *testing.T) {
+	b, f := newTestBalancer(BalanceRoundRobin, HealthOptions{EjectTime: time.Hour})
+	f.setDown(1, true)
+	// The first connection fails over to the next target, and the failed
+	// one is skipped from then on
+	if ports, _ := dialTargets(t, b, 3); fmt.Sprint(ports) != "[2 2 3]" {
+		t.Fatalf("unexpected targets %v", ports)
+	}
+	if stats := b.Stats(); stats[0].Healthy || stats[0].Failures != 1 || stats[0].LastError == "" {
+		t.Fatalf("unexpected stats %+v", stats[0])
+	}
+
+	// Health checks notice when it is back up
+	f.setDown(1, false)
+	b.Check(context.Background())
+	if stats := b.Stats(); !stats[0].Healthy {
+		t.Fatalf("target should be restored, got %+v", stats[0])
+	}
+
+	// If all targets are down, they are still tried
+	for port := 1; port <= 3; port++ {
+		f.setDown(port, true)
+	}
+	b.Check(context.Background())
+	f.setDown(3, false)
+	if ports, _ := dialTargets(t, b, 1); ports[0] != 3 {
+		t.Fatalf("unexpected target %d", ports[0])
+	}
+}
+
+func TestBalancerDialTimeout(t *testing.T) {
+	b, f := newTestBalancer(BalanceFailover, HealthOptions{Timeout: 50 * time.Millisecond, EjectTime: time.Hour})
+	f.hanging[1] = true
+	// A target which doesn't answer only holds the connection up until
+	// the timeout, then the next one is tried
+	start := time.Now()
+	if ports, _ := dialTargets(t, b, 1); ports[0] != 2 {
+		t.Fatalf("unexpected target %d", ports[0])
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("dial took %s", elapsed)
+	}
+	if stats := b.Stats(); stats[0].Healthy {
+		t.Fatalf("hanging target should be ejected, got %+v", stats[0])
+	}
+}
+
+func TestBalancerSingleTargetNoDialTimeout(t *testing.T) {
+	f := &fakeTargets{down: map[int]bool{}, hanging: map[int]bool{1: true}}
+	b := NewBalancer("test", []*net.TCPAddr{{Port: 1}}, BalanceRoundRobin, f.dial, HealthOptions{Timeout: 50 * time.Millisecond}, log.New(io.Discard, "", 0))
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		_, err := b.Dial(ctx)
+		result <- err
+	}()
+	// The only target is waited for until the caller gives up
+	select {
+	case err := <-result:
+		t.Fatalf("dial to the only target timed out: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	cancel()
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected the cancellation, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial did not return once cancelled")
+	}
+}
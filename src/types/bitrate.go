@@ -0,0 +1,44 @@
+package types
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Bitrate is a rate in bits per second. It can be set as a flag with an
+// optional K, M or G suffix for powers of 1000, like iperf, i.e. 2.5M.
+type Bitrate uint64
+
+func (b *Bitrate) String() string {
+	for _, unit := range []struct {
+		suffix string
+		size   uint64
+	}{{"G", 1e9}, {"M", 1e6}, {"K", 1e3}} {
+		if uint64(*b) >= unit.size && uint64(*b)%unit.size == 0 {
+			return fmt.Sprintf("%d%s", uint64(*b)/unit.size, unit.suffix)
+		}
+	}
+	return strconv.FormatUint(uint64(*b), 10)
+}
+
+func (b *Bitrate) Set(value string) error {
+	number, multiplier := value, 1.0
+	switch {
+	case strings.HasSuffix(value, "K"), strings.HasSuffix(value, "k"):
+		multiplier = 1e3
+	case strings.HasSuffix(value, "M"), strings.HasSuffix(value, "m"):
+		multiplier = 1e6
+	case strings.HasSuffix(value, "G"), strings.HasSuffix(value, "g"):
+		multiplier = 1e9
+	}
+	if multiplier > 1 {
+		number = value[:len(value)-1]
+	}
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil || f <= 0 || f*multiplier >= 1<<63 {
+		return fmt.Errorf("invalid bitrate %q", value)
+	}
+	*b = Bitrate(f * multiplier)
+	return nil
+}
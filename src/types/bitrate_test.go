@@ -0,0 +1,31 @@
+package types
+
+import "testing"
+
+func TestBitrateFlag(t *testing.T) {
+	for value, expected := range map[string]Bitrate{
+		"512":  512,
+		"10M":  10e6,
+		"2.5m": 2.5e6,
+		"64k":  64e3,
+		"1G":   1e9,
+	} {
+		var b Bitrate
+		if err := b.Set(value); err != nil {
+			t.Fatalf("%q: %s", value, err)
+		}
+		if b != expected {
+			t.Fatalf("%q: expected %d, got %d", value, expected, b)
+		}
+	}
+	for _, value := range []string{"", "0", "fast", "-1", "M", "1T"} {
+		var b Bitrate
+		if err := b.Set(value); err == nil {
+			t.Fatalf("%q should be invalid", value)
+		}
+	}
+	b := Bitrate(100e6)
+	if b.String() != "100M" {
+		t.Fatalf("unexpected string %q", b.String())
+	}
+}
@@ -0,0 +1,125 @@
+package types
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const PublicKeyHeader = "X-Yggdrasil-Public-Key"
+
+// HTTPRoute serves either a static directory or proxies to a backend
+// URL for requests with the given Host, or for any host if empty
+type HTTPRoute struct {
+	Host   string
+	Dir    string
+	Target *url.URL
+}
+
+type HTTPMapping struct {
+	Listen *net.TCPAddr
+	Routes []HTTPRoute
+}
+
+type HTTPMappings []HTTPMapping
+
+func (m *HTTPMappings) String() string {
+	return ""
+}
+
+// Set parses <port>:[<host>=]<target>, where target is either a http://
+// or https:// backend URL or a directory. Routes for the same port are
+// merged into one mapping.
+func (m *HTTPMappings) Set(value string) error {
+	port_string, target, found := strings.Cut(value, ":")
+	if !found || target == "" {
+		return fmt.Errorf("Malformed HTTP mapping spec '%s'", value)
+	}
+	port, err := strconv.Atoi(port_string)
+	if err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("Malformed HTTP mapping spec '%s'", value)
+	}
+
+	route := HTTPRoute{}
+	if host, rest, found := strings.Cut(target, "="); found && !strings.ContainsAny(host, "/\\:") {
+		if host == "" || rest == "" {
+			return fmt.Errorf("Malformed HTTP mapping spec '%s'", value)
+		}
+		route.Host = strings.ToLower(host)
+		target = rest
+	}
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		if route.Target, err = url.Parse(target); err != nil || route.Target.Host == "" {
+			return fmt.Errorf("invalid backend URL %q", target)
+		}
+	} else {
+		route.Dir = target
+	}
+
+	for i := range *m {
+		mapping := &(*m)[i]
+		if mapping.Listen.Port != port {
+			continue
+		}
+		for _, r := range mapping.Routes {
+			if r.Host == route.Host {
+				return fmt.Errorf("Duplicate HTTP route for port %d and host '%s'", port, route.Host)
+			}
+		}
+		mapping.Routes = append(mapping.Routes, route)
+		return nil
+	}
+	*m = append(*m, HTTPMapping{
+		Listen: &net.TCPAddr{Port: port},
+		Routes: []HTTPRoute{route},
+	})
+	return nil
+}
+
+// NewHTTPHandler returns a handler dispatching requests to the routes by
+// their Host header. Proxied requests carry X-Forwarded-For and, if the
+// keyForAddr function finds the remote node, X-Yggdrasil-Public-Key.
+func NewHTTPHandler(routes []HTTPRoute, keyForAddr func(net.IP) ed25519.PublicKey) http.Handler {
+	hosts := make(map[string]http.Handler, len(routes))
+	for _, route := range routes {
+		if route.Target == nil {
+			hosts[route.Host] = http.FileServer(http.Dir(route.Dir))
+			continue
+		}
+		target := route.Target
+		hosts[route.Host] = &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(target)
+				r.SetXForwarded()
+				r.Out.Header.Del(PublicKeyHeader)
+				host, _, err := net.SplitHostPort(r.In.RemoteAddr)
+				if err != nil {
+					return
+				}
+				if key := keyForAddr(net.ParseIP(host)); key != nil {
+					r.Out.Header.Set(PublicKeyHeader, hex.EncodeToString(key))
+				}
+			},
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.ToLower(r.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		handler, ok := hosts[host]
+		if !ok {
+			if handler, ok = hosts[""]; !ok {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
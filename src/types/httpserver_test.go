@@ -0,0 +1,87 @@
+package types
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHTTPMappings(t *testing.T) {
+	var httpMappings HTTPMappings
+	if err := httpMappings.Set("80:/var/www"); err != nil {
+		t.Fatal(err)
+	}
+	if err := httpMappings.Set("80:app.example.ygg=http://127.0.0.1:8080"); err != nil {
+		t.Fatal(err)
+	}
+	if err := httpMappings.Set("8080:https://[::1]:8443/base"); err != nil {
+		t.Fatal(err)
+	}
+	if len(httpMappings) != 2 || len(httpMappings[0].Routes) != 2 {
+		t.Fatalf("routes for the same port should be merged, got %+v", httpMappings)
+	}
+	if route := httpMappings[0].Routes[1]; route.Host != "app.example.ygg" || route.Target == nil {
+		t.Fatalf("unexpected route %+v", route)
+	}
+	if err := httpMappings.Set("80:/srv/www"); err == nil {
+		t.Fatal("duplicate default route should be rejected")
+	}
+	if err := httpMappings.Set("a:/var/www"); err == nil {
+		t.Fatal("'a' should be an invalid port")
+	}
+	if err := httpMappings.Set("80"); err == nil {
+		t.Fatal("target must not be empty")
+	}
+	if err := httpMappings.Set("80:http://"); err == nil {
+		t.Fatal("backend URL must have a host")
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Header.Get("X-Forwarded-For")+" "+r.Header.Get(PublicKeyHeader))
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.txt"), []byte("static"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var httpMappings HTTPMappings
+	if err := httpMappings.Set("80:" + dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := httpMappings.Set("80:app.example.ygg=" + backend.URL); err != nil {
+		t.Fatal(err)
+	}
+	key := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	key[0] = 0xaa
+	handler := NewHTTPHandler(httpMappings[0].Routes, func(ip net.IP) ed25519.PublicKey {
+		if ip.Equal(net.ParseIP("200::1")) {
+			return key
+		}
+		return nil
+	})
+
+	request := func(host string) string {
+		r := httptest.NewRequest(http.MethodGet, "http://"+host+"/index.txt", nil)
+		r.RemoteAddr = "[200::1]:12345"
+		r.Header.Set(PublicKeyHeader, "spoofed")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+	if body := request("other.ygg"); body != "static" {
+		t.Fatalf("default route should serve the directory, got %q", body)
+	}
+	if body := request("APP.example.ygg:80"); body != "200::1 "+hex.EncodeToString(key) {
+		t.Fatalf("host route should proxy with forwarding headers, got %q", body)
+	}
+}
@@ -24,7 +24,8 @@ func parseMappingString(value string) (first_address string, first_port int, sec
 		second_port = first_port
 	}
 
-	// If token count is 2, then it is <first-port>:<second-port>
+	// If token count is 2, then it is <first-port>:<second-port>, or
+	// <first-port>:<second-address> with the second port the same
 
 	if tokens_len == 2 {
 		first_port, err = strconv.Atoi(tokens[0])
@@ -33,7 +34,10 @@ func parseMappingString(value string) (first_address string, first_port int, sec
 		}
 		second_port, err = strconv.Atoi(tokens[1])
 		if err != nil {
-			return "", 0, "", 0, fmt.Errorf("Malformed mapping spec '%s'", value)
+			if tokens[1] == "" {
+				return "", 0, "", 0, fmt.Errorf("Malformed mapping spec '%s'", value)
+			}
+			second_address, second_port, err = tokens[1], first_port, nil
 		}
 	}
 
@@ -66,7 +70,7 @@ func parseMappingString(value string) (first_address string, first_port int, sec
 			return "", 0, "", 0, fmt.Errorf("Malformed mapping spec '%s'", value)
 		}
 		second_address, second_port_string, err = net.SplitHostPort(
-			tokens[0] + ":" + tokens[1])
+			tokens[2] + ":" + tokens[3])
 		if err != nil {
 			return "", 0, "", 0, fmt.Errorf("Malformed mapping spec '%s'", value)
 		}
@@ -162,9 +166,124 @@ func parseMappingString(value string) (first_address string, first_port int, sec
 	return first_address, first_port, second_address, second_port, nil
 }
 
+// tcpMappingOptions are the parts of a TCP mapping spec after the first
+// comma: further targets, and options in the form name or name=value
+type tcpMappingOptions struct {
+	extra  []*net.TCPAddr
+	policy BalancePolicy
+	tls    *MappingTLS
+	routes []SNIRoute
+}
+
+// parseMappingTarget parses a further target of a mapping, i.e. [a::1]:80
+func parseMappingTarget(target string) (*net.TCPAddr, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("Malformed mapping target '%s'", target)
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP(host)}
+	if addr.IP == nil {
+		return nil, fmt.Errorf("invalid mapped address %q", host)
+	}
+	if addr.Port, err = strconv.Atoi(port); err != nil || addr.Port == 0 {
+		return nil, fmt.Errorf("invalid mapped port %q", port)
+	}
+	return addr, nil
+}
+
+// splitMappingOptions splits the further targets and the options of a
+// TCP mapping from the mapping spec, i.e.
+// 8080:[a::1]:80,[b::1]:80,policy=failover,tls. The certificate options
+// of TLS are for remote mappings, which terminate it, and the server
+// name for local ones, which originate it. SNI routes are for remote
+// mappings, i.e. 443:127.0.0.1:8443,sni=app.example.ygg=127.0.0.1:9443.
+func splitMappingOptions(value string, remote bool) (spec string, options tcpMappingOptions, err error) {
+	tokens := strings.Split(value, ",")
+	var tlsOptions MappingTLS
+	enableTLS := false
+	for _, token := range tokens[1:] {
+		name, arg, hasArg := strings.Cut(token, "=")
+		if !hasArg && strings.Contains(token, ":") {
+			addr, err := parseMappingTarget(token)
+			if err != nil {
+				return "", options, err
+			}
+			options.extra = append(options.extra, addr)
+			continue
+		}
+		switch {
+		case name == "policy" && hasArg:
+			if options.policy, err = ParseBalancePolicy(arg); err != nil {
+				return "", options, err
+			}
+		case name == "tls" && !hasArg:
+			enableTLS = true
+		case name == "tls-cert" && hasArg && remote:
+			tlsOptions.CertFile, enableTLS = arg, true
+		case name == "tls-key" && hasArg && remote:
+			tlsOptions.KeyFile, enableTLS = arg, true
+		case name == "tls-name" && hasArg && !remote:
+			tlsOptions.ServerName, enableTLS = arg, true
+		case name == "sni" && hasArg && remote:
+			serverName, target, found := strings.Cut(arg, "=")
+			if !found || serverName == "" {
+				return "", options, fmt.Errorf("SNI route must be sni=<server-name>=<address>:<port>")
+			}
+			addr, err := parseMappingTarget(target)
+			if err != nil {
+				return "", options, err
+			}
+			options.routes = append(options.routes, SNIRoute{ServerName: serverName, Target: addr})
+		default:
+			return "", options, fmt.Errorf("unknown mapping option '%s'", token)
+		}
+	}
+	if options.policy != "" && len(options.extra) == 0 {
+		return "", options, fmt.Errorf("a balancing policy needs more than one target")
+	}
+	if (tlsOptions.CertFile == "") != (tlsOptions.KeyFile == "") {
+		return "", options, fmt.Errorf("tls-cert and tls-key must be given together")
+	}
+	if enableTLS {
+		if len(options.routes) > 0 {
+			return "", options, fmt.Errorf("SNI routes pass TLS through and can't terminate it")
+		}
+		options.tls = &tlsOptions
+	}
+	return tokens[0], options, nil
+}
+
+// MappingTLS secures the connections of a TCP mapping on the Yggdrasil
+// side. Remote mappings terminate TLS, with the certificate from the
+// files or otherwise one for the node's key. Local mappings originate
+// TLS and only accept the certificate of the node with the key of the
+// target address.
+type MappingTLS struct {
+	CertFile   string
+	KeyFile    string
+	ServerName string // Sent to the target, which may route by it
+}
+
 type TCPMapping struct {
-	Listen *net.TCPAddr
-	Mapped *net.TCPAddr
+	Listen  *net.TCPAddr
+	Mapped  *net.TCPAddr
+	Extra   []*net.TCPAddr // Further targets which share the connections with Mapped
+	Balance BalancePolicy  // How connections are shared between the targets
+	TLS     *MappingTLS    // TLS on the Yggdrasil side, if not nil
+	Routes  []SNIRoute     // Targets for TLS server names, overriding the others
+}
+
+// SNIRoute sends TLS connections for a server name to a target of a
+// remote mapping. The name may start with a wildcard label, i.e.
+// *.example.ygg.
+type SNIRoute struct {
+	ServerName string
+	Target     *net.TCPAddr
+}
+
+// Targets returns all targets of the mapping
+func (m TCPMapping) Targets() []*net.TCPAddr {
+	return append([]*net.TCPAddr{m.Mapped}, m.Extra...)
 }
 
 type TCPLocalMappings []TCPMapping
@@ -174,12 +293,21 @@ func (m *TCPLocalMappings) String() string {
 }
 
 func (m *TCPLocalMappings) Set(value string) error {
+	spec, options, err := splitMappingOptions(value, false)
+	if err != nil {
+		return err
+	}
 	first_address, first_port, second_address, second_port, err :=
-		parseMappingString(value)
+		parseMappingString(spec)
 
 	if err != nil {
 		return err
 	}
+	for _, target := range options.extra {
+		if target.IP.To4() != nil {
+			return fmt.Errorf("Yggdrasil target address %s can be only IPv6", target)
+		}
+	}
 
 	// First address can be ipv4/ipv6
 	// Second address can be only Yggdrasil ipv6
@@ -198,6 +326,10 @@ func (m *TCPLocalMappings) Set(value string) error {
 			IP:   net.IPv6loopback,
 			Port: second_port,
 		},
+		Extra:   options.extra,
+		Balance: options.policy,
+		TLS:     options.tls,
+		Routes:  options.routes,
 	}
 
 	if first_address != "" {
@@ -228,18 +360,23 @@ func (m *TCPRemoteMappings) String() string {
 }
 
 func (m *TCPRemoteMappings) Set(value string) error {
+	spec, options, err := splitMappingOptions(value, true)
+	if err != nil {
+		return err
+	}
 	first_address, first_port, second_address, second_port, err :=
-		parseMappingString(value)
+		parseMappingString(spec)
 
 	if err != nil {
 		return err
 	}
 
-	// First address must be empty
+	// First address can be empty or an address from the node's
+	// Yggdrasil subnet
 	// Second address can be ipv4/ipv6
 
-	if first_address != "" {
-		return fmt.Errorf("Yggdrasil listening must be empty")
+	if first_address != "" && !strings.Contains(first_address, ":") {
+		return fmt.Errorf("Yggdrasil listening address can be only IPv6")
 	}
 
 	// Create mapping
@@ -252,6 +389,10 @@ func (m *TCPRemoteMappings) Set(value string) error {
 			IP:   net.IPv6loopback,
 			Port: second_port,
 		},
+		Extra:   options.extra,
+		Balance: options.policy,
+		TLS:     options.tls,
+		Routes:  options.routes,
 	}
 
 	if first_address != "" {
@@ -347,11 +488,12 @@ func (m *UDPRemoteMappings) Set(value string) error {
 		return err
 	}
 
-	// First address must be empty
+	// First address can be empty or an address from the node's
+	// Yggdrasil subnet
 	// Second address can be ipv4/ipv6
 
-	if first_address != "" {
-		return fmt.Errorf("Yggdrasil listening must be empty")
+	if first_address != "" && !strings.Contains(first_address, ":") {
+		return fmt.Errorf("Yggdrasil listening address can be only IPv6")
 	}
 
 	// Create mapping
@@ -3,108 +3,200 @@ package types
 import "testing"
 
 func TestEndpointMappings(t *testing.T) {
-	var tcpMappings TCPMappings
-	if err := tcpMappings.Set("1234"); err != nil {
+	var localTcpMappings TCPLocalMappings
+	if err := localTcpMappings.Set("1234:[200::1]:4321"); err != nil {
 		t.Fatal(err)
 	}
-	if err := tcpMappings.Set("1234:192.168.1.1"); err != nil {
+	if err := localTcpMappings.Set("127.0.0.1:1234:[200::1]:4321"); err != nil {
 		t.Fatal(err)
 	}
-	if err := tcpMappings.Set("1234:192.168.1.1:4321"); err != nil {
+	if err := localTcpMappings.Set("[::1]:1234:[200::1]:4321"); err != nil {
 		t.Fatal(err)
 	}
-	if err := tcpMappings.Set("192.168.1.2:1234:192.168.1.1:4321"); err != nil {
+	if mapping := localTcpMappings[len(localTcpMappings)-1]; mapping.Listen.String() != "[::1]:1234" || mapping.Mapped.String() != "[200::1]:4321" {
+		t.Fatalf("unexpected mapping %s -> %s", mapping.Listen, mapping.Mapped)
+	}
+	if err := localTcpMappings.Set("a"); err == nil {
+		t.Fatal("'a' should be an invalid exposed port")
+	}
+	if err := localTcpMappings.Set("1234:192.168.1.1:4321"); err == nil {
+		t.Fatal("mapped address must be an IPv6 literal")
+	}
+	if err := localTcpMappings.Set("localhost:1234:[200::1]:4321"); err == nil {
+		t.Fatal("listen address must be an IP literal")
+	}
+	if err := localTcpMappings.Set("1234:[200::1]:a"); err == nil {
+		t.Fatal("'a' should be an invalid mapped port")
+	}
+	if err := localTcpMappings.Set("8080:[200::1]:80,[200::2]:8080,policy=least-conn"); err != nil {
 		t.Fatal(err)
 	}
-	if err := tcpMappings.Set("1234:[2000::1]:4321"); err != nil {
+	if mapping := localTcpMappings[len(localTcpMappings)-1]; len(mapping.Targets()) != 2 || mapping.Targets()[1].String() != "[200::2]:8080" || mapping.Balance != BalanceLeastConn {
+		t.Fatalf("unexpected targets %v with policy %q", mapping.Targets(), mapping.Balance)
+	}
+	if err := localTcpMappings.Set("8080:[200::1]:80,192.168.1.1:80"); err == nil {
+		t.Fatal("further mapped addresses must be IPv6")
+	}
+	if err := localTcpMappings.Set("8080:[200::1]:80,policy=failover"); err == nil {
+		t.Fatal("a policy needs several targets")
+	}
+	if err := localTcpMappings.Set("8080:[200::1]:80,[200::2]:80,policy=random"); err == nil {
+		t.Fatal("unknown policy should be invalid")
+	}
+	var remoteTcpMappings TCPRemoteMappings
+	if err := remoteTcpMappings.Set("80:127.0.0.1:8080,127.0.0.1:8081,[::1]:8082"); err != nil {
 		t.Fatal(err)
 	}
-	if err := tcpMappings.Set("[2001:1]:1234:[2000::1]:4321"); err != nil {
+	if mapping := remoteTcpMappings[0]; len(mapping.Extra) != 2 || mapping.Extra[1].String() != "[::1]:8082" || mapping.Balance != "" {
+		t.Fatalf("unexpected targets %v", mapping.Targets())
+	}
+	if err := remoteTcpMappings.Set("80:127.0.0.1:8080,127.0.0.1"); err == nil {
+		t.Fatal("further targets need a port")
+	}
+	if err := remoteTcpMappings.Set("443:127.0.0.1:8080,tls-cert=/etc/cert.pem,tls-key=/etc/key.pem"); err != nil {
 		t.Fatal(err)
 	}
-	if err := tcpMappings.Set("a"); err == nil {
-		t.Fatal("'a' should be an invalid exposed port")
+	if mapping := remoteTcpMappings[len(remoteTcpMappings)-1]; mapping.TLS == nil || mapping.TLS.KeyFile != "/etc/key.pem" {
+		t.Fatalf("unexpected TLS options %+v", mapping.TLS)
 	}
-	if err := tcpMappings.Set("1234:localhost"); err == nil {
-		t.Fatal("mapped address must be an IP literal")
+	if err := remoteTcpMappings.Set("443:127.0.0.1:8080,tls-cert=/etc/cert.pem"); err == nil {
+		t.Fatal("a certificate needs a key")
 	}
-	if err := tcpMappings.Set("127.0.0.1:1234:localhost"); err == nil {
-		t.Fatal("mapped address must be an IP literal")
+	if err := remoteTcpMappings.Set("443:127.0.0.1:8080,tls-name=example.ygg"); err == nil {
+		t.Fatal("remote mappings don't send a server name")
 	}
-	if err := tcpMappings.Set("[2000:1]:1234:localhost"); err == nil {
-		t.Fatal("mapped address must be an IP literal")
+	if err := remoteTcpMappings.Set("443:127.0.0.1:8443,sni=app.example.ygg=127.0.0.1:9443,sni=*.api.example.ygg=[::1]:9444"); err != nil {
+		t.Fatal(err)
 	}
-	if err := tcpMappings.Set("localhost:1234:127.0.0.1"); err == nil {
-		t.Fatal("listen address must be an IP literal")
+	if mapping := remoteTcpMappings[len(remoteTcpMappings)-1]; len(mapping.Routes) != 2 || mapping.Routes[1].ServerName != "*.api.example.ygg" || mapping.Routes[1].Target.String() != "[::1]:9444" {
+		t.Fatalf("unexpected SNI routes %+v", mapping.Routes)
 	}
-	if err := tcpMappings.Set("localhost:1234:127.0.0.1"); err == nil {
-		t.Fatal("listen address must be an IP literal")
+	if err := remoteTcpMappings.Set("443:127.0.0.1:8443,sni=app.example.ygg"); err == nil {
+		t.Fatal("an SNI route needs a target")
 	}
-	if err := tcpMappings.Set("localhost:1234:[2000:1]"); err == nil {
-		t.Fatal("listen address must be an IP literal")
+	if err := remoteTcpMappings.Set("443:127.0.0.1:8443,sni=app.example.ygg=127.0.0.1:9443,tls"); err == nil {
+		t.Fatal("SNI routes can't be combined with TLS termination")
 	}
-	if err := tcpMappings.Set("localhost:1234:[2000:1]"); err == nil {
-		t.Fatal("listen address must be an IP literal")
+	if err := localTcpMappings.Set("8443:[200::1]:443,sni=app.example.ygg=[200::2]:443"); err == nil {
+		t.Fatal("local mappings don't route by SNI")
 	}
-	if err := tcpMappings.Set("1234:localhost:a"); err == nil {
-		t.Fatal("'a' should be an invalid mapped port")
+	if err := localTcpMappings.Set("8443:[200::1]:443,tls"); err != nil {
+		t.Fatal(err)
 	}
-	if err := tcpMappings.Set("127.0.0.1:1234:127.0.0.1:a"); err == nil {
-		t.Fatal("'a' should be an invalid mapped port")
+	if mapping := localTcpMappings[len(localTcpMappings)-1]; mapping.TLS == nil || mapping.TLS.CertFile != "" {
+		t.Fatalf("unexpected TLS options %+v", mapping.TLS)
 	}
-	if err := tcpMappings.Set("[2000::1]:1234:[2000::1]:a"); err == nil {
-		t.Fatal("'a' should be an invalid mapped port")
+	if err := localTcpMappings.Set("8443:[200::1]:443,tls-key=/etc/key.pem"); err == nil {
+		t.Fatal("local mappings don't use a certificate")
+	}
+	if err := localTcpMappings.Set("8443:[200::1]:443,compress"); err == nil {
+		t.Fatal("unknown options should be invalid")
 	}
-	var udpMappings UDPMappings
-	if err := udpMappings.Set("1234"); err != nil {
+	if err := remoteTcpMappings.Set("1234"); err != nil {
 		t.Fatal(err)
 	}
-	if err := udpMappings.Set("1234:192.168.1.1"); err != nil {
+	if err := remoteTcpMappings.Set("1234:4321"); err != nil {
 		t.Fatal(err)
 	}
-	if err := udpMappings.Set("1234:192.168.1.1:4321"); err != nil {
+	if err := remoteTcpMappings.Set("1234:192.168.1.1"); err != nil {
 		t.Fatal(err)
 	}
-	if err := udpMappings.Set("192.168.1.2:1234:192.168.1.1:4321"); err != nil {
+	if mapping := remoteTcpMappings[len(remoteTcpMappings)-1]; mapping.Mapped.String() != "192.168.1.1:1234" {
+		t.Fatalf("unexpected mapped address %s", mapping.Mapped)
+	}
+	if err := remoteTcpMappings.Set("1234:192.168.1.1:4321"); err != nil {
 		t.Fatal(err)
 	}
-	if err := udpMappings.Set("1234:[2000::1]:4321"); err != nil {
+	if err := remoteTcpMappings.Set("1234:[2000::1]:4321"); err != nil {
 		t.Fatal(err)
 	}
-	if err := udpMappings.Set("[2001:1]:1234:[2000::1]:4321"); err != nil {
+	if err := remoteTcpMappings.Set("[300::10]:80:127.0.0.1:8080"); err != nil {
 		t.Fatal(err)
 	}
-	if err := udpMappings.Set("a"); err == nil {
+	if mapping := remoteTcpMappings[len(remoteTcpMappings)-1]; mapping.Listen.String() != "[300::10]:80" || mapping.Mapped.String() != "127.0.0.1:8080" {
+		t.Fatalf("unexpected mapping %s -> %s", mapping.Listen, mapping.Mapped)
+	}
+	if err := remoteTcpMappings.Set("127.0.0.1:80:127.0.0.1:8080"); err == nil {
+		t.Fatal("Yggdrasil listen address must be IPv6")
+	}
+	if err := remoteTcpMappings.Set("a"); err == nil {
 		t.Fatal("'a' should be an invalid exposed port")
 	}
-	if err := udpMappings.Set("1234:localhost"); err == nil {
+	if err := remoteTcpMappings.Set("1234:localhost:4321"); err == nil {
 		t.Fatal("mapped address must be an IP literal")
 	}
-	if err := udpMappings.Set("127.0.0.1:1234:localhost"); err == nil {
-		t.Fatal("mapped address must be an IP literal")
+	if err := remoteTcpMappings.Set("1234:127.0.0.1:a"); err == nil {
+		t.Fatal("'a' should be an invalid mapped port")
 	}
-	if err := udpMappings.Set("[2000:1]:1234:localhost"); err == nil {
-		t.Fatal("mapped address must be an IP literal")
+	var localUdpMappings UDPLocalMappings
+	if err := localUdpMappings.Set("1234:[200::1]:4321"); err != nil {
+		t.Fatal(err)
 	}
-	if err := udpMappings.Set("localhost:1234:127.0.0.1"); err == nil {
-		t.Fatal("listen address must be an IP literal")
+	if err := localUdpMappings.Set("127.0.0.1:1234:[200::1]:4321"); err != nil {
+		t.Fatal(err)
 	}
-	if err := udpMappings.Set("localhost:1234:127.0.0.1"); err == nil {
-		t.Fatal("listen address must be an IP literal")
+	if err := localUdpMappings.Set("1234:192.168.1.1:4321"); err == nil {
+		t.Fatal("mapped address must be an IPv6 literal")
 	}
-	if err := udpMappings.Set("localhost:1234:[2000:1]"); err == nil {
-		t.Fatal("listen address must be an IP literal")
+	var remoteUdpMappings UDPRemoteMappings
+	if err := remoteUdpMappings.Set("1234"); err != nil {
+		t.Fatal(err)
 	}
-	if err := udpMappings.Set("localhost:1234:[2000:1]"); err == nil {
-		t.Fatal("listen address must be an IP literal")
+	if err := remoteUdpMappings.Set("1234:192.168.1.1:4321"); err != nil {
+		t.Fatal(err)
 	}
-	if err := udpMappings.Set("1234:localhost:a"); err == nil {
-		t.Fatal("'a' should be an invalid mapped port")
+	if err := remoteUdpMappings.Set("1234:[2000::1]:4321"); err != nil {
+		t.Fatal(err)
 	}
-	if err := udpMappings.Set("127.0.0.1:1234:127.0.0.1:a"); err == nil {
-		t.Fatal("'a' should be an invalid mapped port")
+	if err := remoteUdpMappings.Set("[300::53]:53:127.0.0.1:5353"); err != nil {
+		t.Fatal(err)
 	}
-	if err := udpMappings.Set("[2000::1]:1234:[2000::1]:a"); err == nil {
-		t.Fatal("'a' should be an invalid mapped port")
+	if err := remoteUdpMappings.Set("1234:localhost:4321"); err == nil {
+		t.Fatal("mapped address must be an IP literal")
+	}
+}
+
+// TestEndpointMappingAddresses checks the address forms of the original
+// mapping tests against each kind of mapping. Local mappings need an IPv6
+// Yggdrasil address to map to, remote ones an IPv6 address to listen on.
+func TestEndpointMappingAddresses(t *testing.T) {
+	type valid struct{ local, remote bool }
+	for value, expected := range map[string]valid{
+		"1234":                              {remote: true},
+		"1234:192.168.1.1:4321":             {remote: true},
+		"1234:[2000::1]:4321":               {local: true, remote: true},
+		"[2000::1]:1234:[2000::1]:4321":     {local: true, remote: true},
+		"[2001::1]:1234:127.0.0.1:4321":     {remote: true},
+		"192.168.1.2:1234:192.168.1.1:4321": {},
+		"[2001:1]:1234:[2000::1]:4321":      {},
+		"1234:192.168.1.1":                  {remote: true},
+		"a":                                 {},
+		"1234:localhost":                    {},
+		"127.0.0.1:1234:localhost":          {},
+		"[2000:1]:1234:localhost":           {},
+		"localhost:1234:127.0.0.1":          {},
+		"localhost:1234:[2000:1]":           {},
+		"1234:localhost:a":                  {},
+		"127.0.0.1:1234:127.0.0.1:a":        {},
+		"[2000::1]:1234:[2000::1]:a":        {},
+	} {
+		var localTcp TCPLocalMappings
+		var remoteTcp TCPRemoteMappings
+		var localUdp UDPLocalMappings
+		var remoteUdp UDPRemoteMappings
+		for _, m := range []struct {
+			name  string
+			set   func(string) error
+			valid bool
+		}{
+			{"local TCP", localTcp.Set, expected.local},
+			{"remote TCP", remoteTcp.Set, expected.remote},
+			{"local UDP", localUdp.Set, expected.local},
+			{"remote UDP", remoteUdp.Set, expected.remote},
+		} {
+			if err := m.set(value); (err == nil) != m.valid {
+				t.Fatalf("%s mapping %q: expected valid=%v, got %v", m.name, value, m.valid, err)
+			}
+		}
 	}
 }
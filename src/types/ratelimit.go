@@ -0,0 +1,387 @@
+package types
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+)
+
+// How often a limiter logs that it is throttling or refusing connections
+const limiterReportInterval = time.Minute
+
+// Limit is a bandwidth and connection limit. It can be set as a flag in
+// the form rate[:conns], where the rate is in bytes per second with an
+// optional K, M or G suffix, i.e. 10M:100. A zero rate or connection
+// count means no limit of that kind.
+type Limit struct {
+	Rate  int64 // Bytes per second, both directions together
+	Conns int   // Open connections at once
+}
+
+func (l *Limit) String() string {
+	return fmt.Sprintf("%s:%d", formatRate(l.Rate), l.Conns)
+}
+
+func (l *Limit) Set(value string) error {
+	rate, conns, found := strings.Cut(value, ":")
+	r, err := parseRate(rate)
+	if err != nil {
+		return err
+	}
+	c := 0
+	if found {
+		if c, err = strconv.Atoi(conns); err != nil || c < 0 {
+			return fmt.Errorf("invalid connection limit %q", conns)
+		}
+	}
+	l.Rate, l.Conns = r, c
+	return nil
+}
+
+// IsZero reports whether nothing is limited
+func (l Limit) IsZero() bool {
+	return l.Rate <= 0 && l.Conns <= 0
+}
+
+func parseRate(value string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(value, "K"), strings.HasSuffix(value, "k"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+	rate, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("invalid rate %q", value)
+	}
+	if rate > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("rate %q is too large", value)
+	}
+	return rate * multiplier, nil
+}
+
+func formatRate(rate int64) string {
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if rate >= unit.size && rate%unit.size == 0 {
+			return fmt.Sprintf("%d%s", rate/unit.size, unit.suffix)
+		}
+	}
+	return strconv.FormatInt(rate, 10)
+}
+
+// Limits are the limits of each scope of proxied connections
+type Limits struct {
+	Global    Limit // All connections of the node together
+	Mapping   Limit // Each TCP mapping
+	SOCKSUser Limit // Each SOCKS user, or client address without authentication
+	PublicKey Limit // Each remote Yggdrasil node
+}
+
+// LimiterStats are counters of a Limiter
+type LimiterStats struct {
+	Rate      int64  `json:"rate"`
+	Conns     int    `json:"conns"`
+	Active    int64  `json:"active"`
+	Rejected  uint64 `json:"rejected"`
+	Bytes     uint64 `json:"bytes"`
+	Throttled string `json:"throttled"` // Total time connections waited for the rate
+}
+
+// Limiter enforces a Limit with a token bucket, which holds up to a
+// second worth of bytes, and a count of open connections. A nil Limiter
+// doesn't limit anything.
+type Limiter struct {
+	name       string
+	limit      Limit
+	logger     core.Logger
+	mutex      sync.Mutex
+	tokens     float64
+	last       time.Time
+	lastReport time.Time
+	active     atomic.Int64
+	stats      struct {
+		rejected, bytes, throttled atomic.Uint64
+	}
+}
+
+// NewLimiter creates a limiter, or returns nil if the limit is zero. The
+// name is used when logging that the limit is reached.
+func NewLimiter(name string, limit Limit, logger core.Logger) *Limiter {
+	if limit.IsZero() {
+		return nil
+	}
+	return &Limiter{
+		name:   name,
+		limit:  limit,
+		logger: logger,
+		tokens: float64(limit.Rate),
+		last:   time.Now(),
+	}
+}
+
+// Name returns the name of the limiter
+func (l *Limiter) Name() string {
+	return l.name
+}
+
+// Burst returns the most bytes which pass without waiting, or 0 if the
+// rate isn't limited
+func (l *Limiter) Burst() int {
+	if l == nil || l.limit.Rate <= 0 {
+		return 0
+	}
+	return int(l.limit.Rate)
+}
+
+// Acquire counts a new connection and returns true, or returns false if
+// there are too many already
+func (l *Limiter) Acquire() bool {
+	if l == nil {
+		return true
+	}
+	if active := l.active.Add(1); l.limit.Conns > 0 && active > int64(l.limit.Conns) {
+		l.active.Add(-1)
+		l.stats.rejected.Add(1)
+		l.report("Connection limit of %s reached, refusing connections beyond %d", l.name, l.limit.Conns)
+		return false
+	}
+	return true
+}
+
+// Release uncounts a connection counted by Acquire
+func (l *Limiter) Release() {
+	if l != nil {
+		l.active.Add(-1)
+	}
+}
+
+// Wait blocks until n bytes may pass
+func (l *Limiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+	l.stats.bytes.Add(uint64(n))
+	if l.limit.Rate <= 0 {
+		return
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	rate := float64(l.limit.Rate)
+	l.tokens = min(rate, l.tokens+now.Sub(l.last).Seconds()*rate)
+	l.last = now
+	// Take the tokens right away, so that concurrent connections queue
+	// up behind each other
+	l.tokens -= float64(n)
+	wait := time.Duration(-l.tokens / rate * float64(time.Second))
+	l.mutex.Unlock()
+	if wait > 0 {
+		l.stats.throttled.Add(uint64(wait))
+		l.report("Rate limit of %s reached, throttling to %s bytes per second", l.name, formatRate(l.limit.Rate))
+		time.Sleep(wait)
+	}
+}
+
+// idle reports whether no connection is counted and the bucket is full,
+// so that dropping the limiter changes nothing
+func (l *Limiter) idle() bool {
+	if l.active.Load() > 0 {
+		return false
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.limit.Rate <= 0 || l.tokens+time.Since(l.last).Seconds()*float64(l.limit.Rate) >= float64(l.limit.Rate)
+}
+
+func (l *Limiter) report(format string, args ...interface{}) {
+	if l.logger == nil {
+		return
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	due := now.Sub(l.lastReport) >= limiterReportInterval
+	if due {
+		l.lastReport = now
+	}
+	l.mutex.Unlock()
+	if due {
+		l.logger.Warnf(format, args...)
+	}
+}
+
+// Stats returns the counters of the limiter
+func (l *Limiter) Stats() LimiterStats {
+	return LimiterStats{
+		Rate:      l.limit.Rate,
+		Conns:     l.limit.Conns,
+		Active:    l.active.Load(),
+		Rejected:  l.stats.rejected.Load(),
+		Bytes:     l.stats.bytes.Load(),
+		Throttled: time.Duration(l.stats.throttled.Load()).String(),
+	}
+}
+
+// Limiters are limiters which all apply to the same connection
+type Limiters []*Limiter
+
+// Acquire counts a new connection with all limiters, or returns the one
+// which refused it without counting the connection with any of them
+func (ls Limiters) Acquire() (refused *Limiter) {
+	for i, l := range ls {
+		if !l.Acquire() {
+			ls[:i].Release()
+			return l
+		}
+	}
+	return nil
+}
+
+// Release uncounts a connection counted by Acquire
+func (ls Limiters) Release() {
+	for _, l := range ls {
+		l.Release()
+	}
+}
+
+// Wait blocks until n bytes may pass all limiters
+func (ls Limiters) Wait(n int) {
+	for _, l := range ls {
+		l.Wait(n)
+	}
+}
+
+// Burst returns the most bytes which pass all limiters without waiting,
+// or 0 if none limits the rate
+func (ls Limiters) Burst() int {
+	burst := 0
+	for _, l := range ls {
+		if b := l.Burst(); b > 0 && (burst == 0 || b < burst) {
+			burst = b
+		}
+	}
+	return burst
+}
+
+// How many limiters a LimiterGroup keeps before dropping idle ones
+const limiterGroupPrune = 256
+
+// LimiterGroup creates a limiter with the same limit for each key, i.e.
+// each user, on demand
+type LimiterGroup struct {
+	scope    string
+	limit    Limit
+	logger   core.Logger
+	mutex    sync.Mutex
+	limiters map[string]*Limiter
+}
+
+// NewLimiterGroup creates a group whose limiters are named after the
+// scope and their key
+func NewLimiterGroup(scope string, limit Limit, logger core.Logger) *LimiterGroup {
+	return &LimiterGroup{
+		scope:    scope,
+		limit:    limit,
+		logger:   logger,
+		limiters: make(map[string]*Limiter),
+	}
+}
+
+// Get returns the limiter for the key, or nil if the limit is zero
+func (g *LimiterGroup) Get(key string) *Limiter {
+	if g.limit.IsZero() {
+		return nil
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if l, ok := g.limiters[key]; ok {
+		return l
+	}
+	if len(g.limiters) >= limiterGroupPrune {
+		for k, l := range g.limiters {
+			if l.idle() {
+				delete(g.limiters, k)
+			}
+		}
+	}
+	l := NewLimiter(fmt.Sprintf("%s %s", g.scope, key), g.limit, g.logger)
+	g.limiters[key] = l
+	return l
+}
+
+// Stats returns the counters of the limiters by key
+func (g *LimiterGroup) Stats() map[string]LimiterStats {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	stats := make(map[string]LimiterStats, len(g.limiters))
+	for key, l := range g.limiters {
+		stats[key] = l.Stats()
+	}
+	return stats
+}
+
+// LimitedConn applies limiters to a connection which is proxied by
+// something else, i.e. the SOCKS server. The connection is released from
+// the limiters when it is closed.
+type LimitedConn struct {
+	net.Conn
+	limiters Limiters
+	once     sync.Once
+}
+
+// NewLimitedConn wraps a connection which was already counted with
+// limiters.Acquire
+func NewLimitedConn(conn net.Conn, limiters Limiters) *LimitedConn {
+	return &LimitedConn{Conn: conn, limiters: limiters}
+}
+
+func (c *LimitedConn) Read(b []byte) (int, error) {
+	if burst := c.limiters.Burst(); burst > 0 && len(b) > burst {
+		b = b[:burst]
+	}
+	n, err := c.Conn.Read(b)
+	c.limiters.Wait(n)
+	return n, err
+}
+
+func (c *LimitedConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if burst := c.limiters.Burst(); burst > 0 && len(chunk) > burst {
+			chunk = chunk[:burst]
+		}
+		c.limiters.Wait(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite passes a half-close on if the connection supports it
+func (c *LimitedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *LimitedConn) Close() error {
+	c.once.Do(c.limiters.Release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,106 @@
+package types
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestLimitFlag(t *testing.T) {
+	for value, expected := range map[string]Limit{
+		"0":       {},
+		"512":     {Rate: 512},
+		"10M:100": {Rate: 10 << 20, Conns: 100},
+		"64k":     {Rate: 64 << 10},
+		"0:5":     {Conns: 5},
+		"1G:0":    {Rate: 1 << 30},
+	} {
+		var l Limit
+		if err := l.Set(value); err != nil {
+			t.Fatalf("%q: %s", value, err)
+		}
+		if l != expected {
+			t.Fatalf("%q: expected %+v, got %+v", value, expected, l)
+		}
+	}
+	for _, value := range []string{"", "fast", "-1", "1M:", "1M:-2", "1T", "8589934592G", "9223372036854775807K"} {
+		var l Limit
+		if err := l.Set(value); err == nil {
+			t.Fatalf("%q should be invalid", value)
+		}
+	}
+	l := Limit{Rate: 2 << 20, Conns: 3}
+	if l.String() != "2M:3" {
+		t.Fatalf("unexpected string %q", l.String())
+	}
+}
+
+func TestLimiterConnections(t *testing.T) {
+	if NewLimiter("unused", Limit{}, nil) != nil {
+		t.Fatal("a zero limit should not create a limiter")
+	}
+	a := NewLimiter("a", Limit{Conns: 2}, nil)
+	b := NewLimiter("b", Limit{Conns: 1}, nil)
+	limiters := Limiters{a, b}
+	if refused := limiters.Acquire(); refused != nil {
+		t.Fatalf("first connection refused by %s", refused.Name())
+	}
+	if refused := limiters.Acquire(); refused != b {
+		t.Fatal("second connection should be refused by b")
+	}
+	// A refused connection isn't counted by any of the limiters
+	if a.Stats().Active != 1 || b.Stats().Active != 1 || b.Stats().Rejected != 1 {
+		t.Fatalf("unexpected stats %+v %+v", a.Stats(), b.Stats())
+	}
+	limiters.Release()
+	if refused := limiters.Acquire(); refused != nil {
+		t.Fatalf("connection after release refused by %s", refused.Name())
+	}
+}
+
+func TestLimiterGroup(t *testing.T) {
+	if NewLimiterGroup("user", Limit{}, nil).Get("alice") != nil {
+		t.Fatal("a zero limit should not create limiters")
+	}
+	g := NewLimiterGroup("user", Limit{Conns: 1}, nil)
+	alice, bob := g.Get("alice"), g.Get("bob")
+	if alice == bob || g.Get("alice") != alice || alice.Name() != "user alice" {
+		t.Fatal("each key should have its own limiter")
+	}
+	if !alice.Acquire() || alice.Acquire() || !bob.Acquire() {
+		t.Fatal("keys should be limited separately")
+	}
+	if stats := g.Stats(); len(stats) != 2 || stats["alice"].Rejected != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestProxyTCPRateLimit(t *testing.T) {
+	const rate = 64 << 10
+	limiter := NewLimiter("test", Limit{Rate: rate}, nil)
+	client, server, _ := proxiedTCPPair(t, ProxyOptions{Limiters: Limiters{limiter}})
+
+	// The first second worth of data passes right away, the rest at the
+	// rate of the limit
+	payload := bytes.Repeat([]byte("x"), 2*rate)
+	start := time.Now()
+	go func() {
+		_, _ = server.Write(payload)
+		_ = server.CloseWrite()
+	}()
+	_ = client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	received, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != len(payload) {
+		t.Fatalf("received %d of %d bytes", len(received), len(payload))
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond || elapsed > 3*time.Second {
+		t.Fatalf("transfer took %s, expected about a second", elapsed)
+	}
+	if stats := limiter.Stats(); stats.Bytes != uint64(len(payload)) || stats.Throttled == "0s" {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -2,27 +2,38 @@ package types
 
 import (
 	"context"
-	"crypto/ed25519"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
 	"github.com/yggdrasil-network/yggstack/src/netstack"
 )
 
 const NameMappingSuffix = ".pk.ygg"
 
+// Delay between starting concurrent connection attempts to the
+// resolved candidates, as recommended by RFC 8305
+const ConnectionAttemptDelay = 250 * time.Millisecond
+
+type candidatesKey struct{}
+
 type NameResolver struct {
+	stack    *netstack.YggdrasilNetstack
 	resolver *net.Resolver
+	logger   core.Logger
 }
 
-func NewNameResolver(stack *netstack.YggdrasilNetstack, nameserver string) *NameResolver {
+func NewNameResolver(stack *netstack.YggdrasilNetstack, nameserver string, logger core.Logger) *NameResolver {
 	res := &NameResolver{
+		stack: stack,
 		resolver: &net.Resolver{
 			PreferGo: true,
 		},
+		logger: logger,
 	}
 	if nameserver != "" {
 		res.resolver.Dial = func(ctx context.Context, network, address string) (net.Conn, error) { // nolint:staticcheck
@@ -42,32 +53,135 @@ func NewNameResolver(stack *netstack.YggdrasilNetstack, nameserver string) *Name
 	return res
 }
 
-func (r *NameResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+// IsYggdrasilIP reports whether ip belongs to the Yggdrasil 200::/7 range
+func IsYggdrasilIP(ip net.IP) bool {
+	ip16 := ip.To16()
+	if ip16 == nil || ip.To4() != nil {
+		return false
+	}
+	return ip16[0]&0xfe == 0x02
+}
+
+// LookupAll returns all Yggdrasil addresses of the name, in the order of
+// the DNS answer. Addresses outside of 200::/7 are dropped, since they can
+// not be reached through the netstack. IP literals are returned as they
+// are, and .pk.ygg names resolve to the address of their key.
+func (r *NameResolver) LookupAll(ctx context.Context, name string) ([]net.IP, error) {
 	if strings.HasSuffix(name, NameMappingSuffix) {
-		name = strings.TrimSuffix(name, NameMappingSuffix)
-		// Check if remaining string contains a dot and
-		// assume publickey is a rightmost token
-		name = name[strings.LastIndex(name, ".")+1:]
-		var pk [ed25519.PublicKeySize]byte
-		if b, err := hex.DecodeString(name); err != nil {
-			return nil, nil, fmt.Errorf("hex.DecodeString: %w", err)
-		} else {
-			copy(pk[:], b)
-			return ctx, net.IP(address.AddrForKey(pk[:])[:]), nil
+		pk, err := PublicKeyForName(name)
+		if err != nil {
+			return nil, err
 		}
+		return []net.IP{net.IP(address.AddrForKey(pk)[:])}, nil
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	addrs, err := r.resolver.LookupIP(ctx, "ip6", name)
+	if err != nil {
+		r.logger.Debugf("Failed to lookup %s: %s", name, err)
+		return nil, fmt.Errorf("failed to lookup %q: %w", name, err)
+	}
+	candidates := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if !IsYggdrasilIP(addr) {
+			r.logger.Debugf("Ignoring non-Yggdrasil address %s for %s", addr, name)
+			continue
+		}
+		candidates = append(candidates, addr)
+	}
+	if len(candidates) == 0 {
+		r.logger.Debugf("Failed to lookup %s: no Yggdrasil addresses", name)
+		return nil, fmt.Errorf("no Yggdrasil addresses for %q", name)
+	}
+	return candidates, nil
+}
+
+// Resolve implements the socks5.NameResolver interface. The first
+// candidate is returned, while all of them are stored in the returned
+// context so that DialContext can fall back across them.
+func (r *NameResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	candidates, err := r.LookupAll(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	if len(candidates) > 1 {
+		ctx = context.WithValue(ctx, candidatesKey{}, candidates)
+	}
+	return ctx, candidates[0], nil
+}
+
+// DialContext dials the address through the netstack. If the context
+// carries several candidates for the host from Resolve, TCP connection
+// attempts are raced happy-eyeballs style and the first to succeed wins.
+func (r *NameResolver) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	candidates, _ := ctx.Value(candidatesKey{}).([]net.IP)
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || len(candidates) < 2 || !candidates[0].Equal(net.ParseIP(host)) {
+		return r.stack.DialContext(ctx, network, address)
+	}
+	switch network {
+	case "tcp", "tcp6":
+	default:
+		return r.stack.DialContext(ctx, network, address)
 	}
-	ip := net.ParseIP(name)
-	if ip == nil {
-		addrs, err := r.resolver.LookupIP(ctx, "ip6", name)
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(candidates))
+	dial := func(ip net.IP) {
+		conn, err := r.stack.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
 		if err != nil {
-			fmt.Println("failed to lookup", name, "due to error:", err)
-			return nil, nil, fmt.Errorf("failed to lookup %q: %s", name, err)
+			r.logger.Debugf("Failed to connect to %s: %s", ip, err)
 		}
-		if len(addrs) == 0 {
-			fmt.Println("failed to lookup", name, "due to no addresses")
-			return nil, nil, fmt.Errorf("no addresses for %q", name)
+		results <- dialResult{conn, err}
+	}
+
+	timer := time.NewTimer(ConnectionAttemptDelay)
+	defer timer.Stop()
+	go dial(candidates[0])
+	next, pending := 1, 1
+	var errs []error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			// The previous attempt is taking too long, so start
+			// the next one in parallel
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// Close connections from attempts which are
+				// still in flight, if they succeed at all
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							_ = late.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			errs = append(errs, res.err)
+		}
+		if next < len(candidates) {
+			go dial(candidates[next])
+			next++
+			pending++
+			// The timer may have fired while a result came in, and
+			// the stale fire would start the attempt after this one
+			// right away
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(ConnectionAttemptDelay)
 		}
-		return ctx, addrs[0], nil
 	}
-	return ctx, ip, nil
+	return nil, fmt.Errorf("failed to connect to any of %d addresses: %w", len(candidates), errors.Join(errs...))
 }
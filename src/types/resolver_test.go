@@ -0,0 +1,54 @@
+package types
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/gologme/log"
+)
+
+func TestIsYggdrasilIP(t *testing.T) {
+	for addr, expected := range map[string]bool{
+		"200::1":      true,
+		"201:abcd::1": true,
+		"300::1":      true,
+		"3ff:ffff::1": true,
+		"2001:db8::1": false,
+		"::1":         false,
+		"127.0.0.1":   false,
+	} {
+		if IsYggdrasilIP(net.ParseIP(addr)) != expected {
+			t.Fatalf("IsYggdrasilIP(%s) should be %v", addr, expected)
+		}
+	}
+}
+
+func TestResolverLookupAll(t *testing.T) {
+	r := NewNameResolver(nil, "", log.New(io.Discard, "", 0))
+	ctx := context.Background()
+	pk := "d40d4a7153cf288ea28f1865f6cfe95143a478b5c8c9e7cb002a0633d10a53eb"
+	for _, name := range []string{pk + NameMappingSuffix, "web." + pk + NameMappingSuffix} {
+		ips, err := r.LookupAll(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 1 || !IsYggdrasilIP(ips[0]) {
+			t.Fatalf("%s should resolve to a single Yggdrasil address, got %v", name, ips)
+		}
+	}
+	if _, err := r.LookupAll(ctx, "zz"+NameMappingSuffix); err == nil {
+		t.Fatal("invalid public key should not resolve")
+	}
+	ips, err := r.LookupAll(ctx, "200::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("200::1")) {
+		t.Fatalf("IP literal should resolve to itself, got %v", ips)
+	}
+	if _, ip, err := r.Resolve(ctx, "200::1"); err != nil || !ip.Equal(net.ParseIP("200::1")) {
+		t.Fatalf("Resolve should return the IP literal, got %v (%v)", ip, err)
+	}
+}
@@ -0,0 +1,76 @@
+package types
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// errPeeked stops the handshake which PeekServerName uses to parse the
+// ClientHello
+var errPeeked = errors.New("peeked")
+
+// PeekServerName reads the TLS ClientHello from the connection and
+// returns the requested server name, which is empty if there is none.
+// The returned connection replays what was read, so that TLS passes
+// through untouched. It is returned on errors too, i.e. for clients
+// which don't speak TLS.
+func PeekServerName(conn net.Conn) (string, net.Conn, error) {
+	var peeked bytes.Buffer
+	var serverName string
+	err := tls.Server(readOnlyConn{Reader: io.TeeReader(conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errPeeked
+		},
+	}).Handshake()
+	replay := &replayConn{Conn: conn, reader: io.MultiReader(&peeked, conn)}
+	if !errors.Is(err, errPeeked) {
+		return "", replay, err
+	}
+	return serverName, replay, nil
+}
+
+// MatchServerName reports whether a server name matches a pattern, which
+// is either a name or a wildcard for the names below one, i.e.
+// *.example.ygg. Names are compared without regard to case.
+func MatchServerName(pattern, name string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if suffix, found := strings.CutPrefix(pattern, "*."); found {
+		return strings.HasSuffix(name, "."+suffix)
+	}
+	return pattern == name
+}
+
+// readOnlyConn lets the TLS handshake read the ClientHello, and fails
+// any attempt to answer it
+type readOnlyConn struct {
+	io.Reader
+}
+
+func (c readOnlyConn) Write([]byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                     { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr              { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr             { return nil }
+func (c readOnlyConn) SetDeadline(time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(time.Time) error { return nil }
+
+// replayConn reads the peeked bytes before the rest of the connection
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *replayConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
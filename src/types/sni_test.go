@@ -0,0 +1,92 @@
+package types
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeekServerName(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := NodeCertificate(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	result := make(chan error, 1)
+	go func() {
+		client := tls.Client(c, &tls.Config{ServerName: "app.example.ygg", InsecureSkipVerify: true}) // nolint:gosec
+		if err := client.Handshake(); err != nil {
+			result <- err
+			return
+		}
+		_, err := client.Write([]byte("ping"))
+		result <- err
+	}()
+
+	serverName, replay, err := PeekServerName(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverName != "app.example.ygg" {
+		t.Fatalf("unexpected server name %q", serverName)
+	}
+	// The handshake continues from the replayed ClientHello
+	server := tls.Server(replay, &tls.Config{Certificates: []tls.Certificate{cert}})
+	_ = server.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(server, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("unexpected data %q", buf)
+	}
+	if err = <-result; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPeekServerNameWithoutTLS(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	go func() {
+		_, _ = c.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	}()
+	_ = s.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, replay, err := PeekServerName(s); err == nil {
+		t.Fatal("plain text should not be taken for TLS")
+	} else {
+		buf := make([]byte, 5)
+		if _, err = io.ReadFull(replay, buf); err != nil || string(buf) != "GET /" {
+			t.Fatalf("peeked data should be replayed, got %q, %v", buf, err)
+		}
+	}
+}
+
+func TestMatchServerName(t *testing.T) {
+	for _, test := range []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"app.example.ygg", "app.example.ygg", true},
+		{"app.example.ygg", "APP.Example.ygg.", true},
+		{"app.example.ygg", "api.example.ygg", false},
+		{"*.example.ygg", "api.example.ygg", true},
+		{"*.example.ygg", "a.b.example.ygg", true},
+		{"*.example.ygg", "example.ygg", false},
+		{"app.example.ygg", "", false},
+	} {
+		if MatchServerName(test.pattern, test.name) != test.match {
+			t.Errorf("MatchServerName(%q, %q) should be %t", test.pattern, test.name, test.match)
+		}
+	}
+}
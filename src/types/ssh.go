@@ -0,0 +1,86 @@
+package types
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// PublicKeys is a list of Yggdrasil public keys, which can be given as a
+// flag in hex, once for each key
+type PublicKeys []ed25519.PublicKey
+
+func (k *PublicKeys) String() string {
+	keys := make([]string, 0, len(*k))
+	for _, key := range *k {
+		keys = append(keys, hex.EncodeToString(key))
+	}
+	return strings.Join(keys, ",")
+}
+
+func (k *PublicKeys) Set(value string) error {
+	key, err := hex.DecodeString(value)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("malformed public key %q", value)
+	}
+	*k = append(*k, key)
+	return nil
+}
+
+// Contains reports whether the key is in the list
+func (k PublicKeys) Contains(key ed25519.PublicKey) bool {
+	for _, allowed := range k {
+		if allowed.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForAddress returns the key whose node address is ip, or nil. Addresses
+// from the subnets of the keys don't count, as any host behind the node
+// can use those.
+func (k PublicKeys) ForAddress(ip net.IP) ed25519.PublicKey {
+	for _, key := range k {
+		if KeyHasAddress(key, ip) {
+			return key
+		}
+	}
+	return nil
+}
+
+// LoadAuthorizedKeys reads the keys of an OpenSSH authorized_keys file.
+// Options such as command= or restrict can't be enforced, so entries
+// with options are refused rather than giving their users full access.
+// Blank lines and comments are skipped, but the file must contain at
+// least one key.
+func LoadAuthorizedKeys(path string) ([]ssh.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ssh.PublicKey
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		if len(options) > 0 {
+			return nil, fmt.Errorf("%s:%d: options are not supported: %s", path, i+1, strings.Join(options, ","))
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys found in %s", path)
+	}
+	return keys, nil
+}
@@ -0,0 +1,97 @@
+package types
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+)
+
+func TestLoadAuthorizedKeys(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "authorized_keys")
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	data := "# comment\n\n" + line + "\n  " + line + " user@host\n# trailing\n"
+	if err = os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadAuthorizedKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || string(keys[1].Marshal()) != string(key.Marshal()) {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	// Options can't be enforced, so keys with them give no access at all
+	for _, options := range []string{"no-pty", "restrict", `command="true"`, `from="200::/7"`, "no-port-forwarding,no-agent-forwarding"} {
+		data := "# comment\n" + line + "\n" + options + " " + line + "\n"
+		if err = os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = LoadAuthorizedKeys(path); err == nil || !strings.Contains(err.Error(), ":3:") {
+			t.Fatalf("%s: expected an error for line 3, got %v", options, err)
+		}
+	}
+	if err = os.WriteFile(path, []byte(line+"\nnot a key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadAuthorizedKeys(path); err == nil {
+		t.Fatal("malformed lines should fail")
+	}
+
+	empty := filepath.Join(dir, "empty")
+	if err = os.WriteFile(empty, []byte("# no keys\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadAuthorizedKeys(empty); err == nil {
+		t.Fatal("file without keys should fail")
+	}
+}
+
+func TestPublicKeysFlag(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys PublicKeys
+	if err = keys.Set(hex.EncodeToString(public)); err != nil {
+		t.Fatal(err)
+	}
+	if !keys.Contains(public) || keys.String() != hex.EncodeToString(public) {
+		t.Fatalf("unexpected keys %s", keys.String())
+	}
+	for _, value := range []string{"", "zz", hex.EncodeToString(public[:16])} {
+		if err = keys.Set(value); err == nil {
+			t.Fatalf("%q should be rejected", value)
+		}
+	}
+
+	// Only the node address of a key matches, not its subnet
+	addr, subnet := address.AddrForKey(public), address.SubnetForKey(public)
+	if !keys.ForAddress(net.IP(addr[:])).Equal(public) {
+		t.Fatal("node address should match the key")
+	}
+	host := make(net.IP, net.IPv6len)
+	copy(host, subnet[:])
+	host[15] = 1
+	if keys.ForAddress(host) != nil {
+		t.Fatal("subnet address should not match the key")
+	}
+}
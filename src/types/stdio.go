@@ -0,0 +1,183 @@
+package types
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// StdioConn is a connection, or a socket for datagrams, made of a reader
+// and a writer such as standard input and output, so that they can be
+// proxied like a network connection. Each read of the reader is a
+// datagram. Once the write side is closed, reads end as well, so that
+// proxying stops when the other side is done even while the input stays
+// open, like a terminal.
+type StdioConn struct {
+	w         io.WriteCloser
+	chunks    chan []byte
+	mutex     sync.Mutex
+	pending   []byte    // Rest of a chunk which didn't fit into a read
+	err       error     // Why the reader stopped
+	deadline  time.Time // Of reads
+	changed   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// stdioAddr is the address of both ends of a StdioConn
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+// NewStdioConn starts reading from r in the background, in reads of up
+// to size bytes
+func NewStdioConn(r io.Reader, w io.WriteCloser, size int) *StdioConn {
+	c := &StdioConn{
+		w:       w,
+		chunks:  make(chan []byte),
+		changed: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(c.chunks)
+		for {
+			buf := make([]byte, size)
+			n, err := r.Read(buf)
+			if n > 0 {
+				select {
+				case c.chunks <- buf[:n]:
+				case <-c.done:
+					return
+				}
+			}
+			if err != nil {
+				c.mutex.Lock()
+				c.err = err
+				c.mutex.Unlock()
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// next waits for the next chunk of input until the deadline
+func (c *StdioConn) next() ([]byte, error) {
+	for {
+		c.mutex.Lock()
+		deadline, changed := c.deadline, c.changed
+		c.mutex.Unlock()
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		chunk, err := c.wait(timeout, changed)
+		if timer != nil {
+			timer.Stop()
+		}
+		if chunk != nil || err != nil {
+			return chunk, err
+		}
+	}
+}
+
+// wait returns nothing if the deadline changed while waiting
+func (c *StdioConn) wait(timeout <-chan time.Time, changed <-chan struct{}) ([]byte, error) {
+	select {
+	case chunk, ok := <-c.chunks:
+		if ok {
+			return chunk, nil
+		}
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if c.err == nil || c.err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, c.err
+	case <-c.done:
+		return nil, io.EOF
+	case <-timeout:
+		return nil, os.ErrDeadlineExceeded
+	case <-changed:
+		return nil, nil
+	}
+}
+
+func (c *StdioConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		chunk, err := c.next()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = chunk
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// ReadFrom reads a datagram, which is truncated if b is too short
+func (c *StdioConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	chunk, err := c.next()
+	if err != nil {
+		return 0, nil, err
+	}
+	return copy(b, chunk), stdioAddr{}, nil
+}
+
+func (c *StdioConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+		return c.w.Write(b)
+	}
+}
+
+func (c *StdioConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+// CloseWrite closes the writer, and ends reads
+func (c *StdioConn) CloseWrite() error {
+	return c.Close()
+}
+
+func (c *StdioConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		err = c.w.Close()
+	})
+	return err
+}
+
+// Done is closed once the connection is closed
+func (c *StdioConn) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *StdioConn) LocalAddr() net.Addr  { return stdioAddr{} }
+func (c *StdioConn) RemoteAddr() net.Addr { return stdioAddr{} }
+
+func (c *StdioConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *StdioConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.deadline = t
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return nil
+}
+
+func (c *StdioConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
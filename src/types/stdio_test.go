@@ -0,0 +1,131 @@
+package types
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nopWriteCloser collects what is written to it
+type nopWriteCloser struct {
+	strings.Builder
+	closed bool
+}
+
+func (w *nopWriteCloser) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestStdioConnTCP(t *testing.T) {
+	echo, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		c, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(c, c)
+		_ = c.(*net.TCPConn).CloseWrite()
+	}()
+	conn, err := net.DialTCP("tcp", nil, echo.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The output ends after the echo of all the input
+	out := &nopWriteCloser{}
+	stdio := NewStdioConn(strings.NewReader("ping"), out, 1500)
+	if err = ProxyTCP(1500, stdio, conn); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "ping" || !out.closed {
+		t.Fatalf("unexpected output %q, closed %v", out.String(), out.closed)
+	}
+}
+
+func TestStdioConnEndsWithOutput(t *testing.T) {
+	c1, c2 := net.Pipe()
+	_ = c2.Close()
+
+	// The input stays open, but the other side is done
+	in, _ := io.Pipe()
+	out := &nopWriteCloser{}
+	stdio := NewStdioConn(in, out, 1500)
+	done := make(chan error)
+	go func() { done <- ProxyTCP(1500, stdio, c1) }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxying should end with the other side")
+	}
+	if !out.closed {
+		t.Fatal("output should be closed")
+	}
+}
+
+func TestStdioConnUDP(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	in, inw := io.Pipe()
+	outr, out := io.Pipe()
+	stdio := NewStdioConn(in, out, 1500)
+	dial := func(net.Addr) (net.Conn, error) {
+		return net.DialUDP("udp", nil, echo.LocalAddr().(*net.UDPAddr))
+	}
+	sessions := NewUDPSessionManager(1500, stdio, dial, UDPSessionOptions{MaxSessions: 1})
+	defer sessions.Close()             // nolint:errcheck
+	go ServeUDP(1500, stdio, sessions) // nolint:errcheck
+
+	buf := make([]byte, 10)
+	for _, datagram := range []string{"one", "two"} {
+		if _, err = inw.Write([]byte(datagram)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := outr.Read(buf)
+		if err != nil || string(buf[:n]) != datagram {
+			t.Fatalf("unexpected reply %q: %v", buf[:n], err)
+		}
+	}
+	if stats := sessions.Stats(); stats.Created != 1 || stats.PacketsForwarded != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestStdioConnDeadline(t *testing.T) {
+	in, _ := io.Pipe()
+	stdio := NewStdioConn(in, &nopWriteCloser{}, 1500)
+	_ = stdio.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := stdio.Read(make([]byte, 10)); !isTimeout(err) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	_ = stdio.SetReadDeadline(time.Time{})
+	_ = stdio.Close()
+	if _, err := stdio.Read(make([]byte, 10)); err != io.EOF {
+		t.Fatalf("expected the end of the input once closed, got %v", err)
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -1,42 +1,140 @@
 package types
 
 import (
+	"errors"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func tcpProxyFunc(mtu uint64, dst, src net.Conn) error {
-	buf := make([]byte, mtu)
+// ErrIdleTimeout is returned by ProxyTCPWithOptions when neither side
+// sent anything for the idle timeout
+var ErrIdleTimeout = errors.New("connection idle for too long")
+
+// ProxyOptions tunes ProxyTCPWithOptions
+type ProxyOptions struct {
+	IdleTimeout time.Duration // Close both sides after no data either way for this long, 0 for no limit
+	Limiters    Limiters      // Rate limits for the data in both directions
+}
+
+// Buffers for copying, shared between all proxied connections
+var proxyBuffers sync.Pool
+
+func getProxyBuffer(size uint64) *[]byte {
+	if bufp, ok := proxyBuffers.Get().(*[]byte); ok && uint64(cap(*bufp)) >= size {
+		*bufp = (*bufp)[:size]
+		return bufp
+	}
+	buf := make([]byte, size)
+	return &buf
+}
+
+// errStreamEnded is returned by copy when the source ended but the end
+// can't be passed on to a destination without CloseWrite, so that both
+// connections are closed without reporting an error
+var errStreamEnded = errors.New("stream ended")
+
+// halfCloser is a connection whose write side can be closed on its own,
+// i.e. *net.TCPConn and *gonet.TCPConn. Wrappers return
+// errors.ErrUnsupported if the connection they wrap can't do that.
+type halfCloser interface {
+	CloseWrite() error
+}
+
+// closeWrite closes the write side of the connection, or returns
+// errors.ErrUnsupported if it can't be closed on its own
+func closeWrite(c net.Conn) error {
+	if hc, ok := c.(halfCloser); ok {
+		return hc.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+type tcpProxy struct {
+	mtu        uint64
+	options    ProxyOptions
+	lastActive atomic.Int64
+}
+
+func (p *tcpProxy) copy(dst, src net.Conn) error {
+	bufp := getProxyBuffer(p.mtu)
+	defer proxyBuffers.Put(bufp)
+	buf := *bufp
+	if burst := p.options.Limiters.Burst(); burst > 0 && burst < len(buf) {
+		buf = buf[:burst]
+	}
 	for {
-		n, err := src.Read(buf[:])
-		if err != nil {
-			return err
+		if p.options.IdleTimeout > 0 {
+			idle := time.Since(time.Unix(0, p.lastActive.Load()))
+			if idle >= p.options.IdleTimeout {
+				return ErrIdleTimeout
+			}
+			_ = src.SetReadDeadline(time.Now().Add(p.options.IdleTimeout - idle))
 		}
+		n, err := src.Read(buf)
 		if n > 0 {
-			n, err = dst.Write(buf[:n])
-			if err != nil {
-				return err
+			p.lastActive.Store(time.Now().UnixNano())
+			if len(p.options.Limiters) > 0 {
+				// Waiting for the rate doesn't count as idle
+				p.options.Limiters.Wait(n)
+				p.lastActive.Store(time.Now().UnixNano())
+			}
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			var ne net.Error
+			if p.options.IdleTimeout > 0 && errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			if err == io.EOF {
+				// Pass the end of the stream on, so that the other
+				// direction keeps working until it ends as well
+				if errors.Is(closeWrite(dst), errors.ErrUnsupported) {
+					return errStreamEnded
+				}
+				return nil
 			}
+			return err
 		}
 	}
-	return nil
 }
 
+// ProxyTCP copies data between the connections in both directions until
+// both have finished, see ProxyTCPWithOptions.
 func ProxyTCP(mtu uint64, c1, c2 net.Conn) error {
-	// Start proxying
+	return ProxyTCPWithOptions(mtu, c1, c2, ProxyOptions{})
+}
+
+// ProxyTCPWithOptions copies data between the connections in both
+// directions. When one side stops sending, the write side of the other
+// is closed, if it supports that, so that half-closed connections keep
+// working until both directions are finished, and otherwise both are
+// closed. On any error both connections are closed right away. The
+// error is returned, or nil if the connections finished cleanly.
+func ProxyTCPWithOptions(mtu uint64, c1, c2 net.Conn, options ProxyOptions) error {
+	p := &tcpProxy{mtu: mtu, options: options}
+	p.lastActive.Store(time.Now().UnixNano())
 	errCh := make(chan error, 2)
-	go func() { errCh <- tcpProxyFunc(mtu, c1, c2) }()
-	go func() { errCh <- tcpProxyFunc(mtu, c2, c1) }()
+	go func() { errCh <- p.copy(c1, c2) }()
+	go func() { errCh <- p.copy(c2, c1) }()
 
-	// Wait
+	var err error
 	for i := 0; i < 2; i++ {
-		e := <-errCh
-		if e != nil {
-			// Close connections and return
-			c1.Close()
-			c2.Close()
-			return e
+		if e := <-errCh; e != nil && err == nil {
+			err = e
+			_ = c1.Close()
+			_ = c2.Close()
 		}
 	}
-
-	return nil
+	_ = c1.Close()
+	_ = c2.Close()
+	if err == errStreamEnded {
+		// One side ended, and any error of the other came from the close
+		return nil
+	}
+	return err
 }
@@ -0,0 +1,150 @@
+package types
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// proxiedTCPPair returns a client connection which is proxied to the
+// server connection
+func proxiedTCPPair(t *testing.T, options ProxyOptions) (client, server *net.TCPConn, result chan error) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dial := func() (*net.TCPConn, *net.TCPConn) {
+		c, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := listener.AcceptTCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = c.Close()
+			_ = s.Close()
+		})
+		return c, s
+	}
+	client, proxyIn := dial()
+	proxyOut, server := dial()
+	result = make(chan error, 1)
+	go func() { result <- ProxyTCPWithOptions(1500, proxyIn, proxyOut, options) }()
+	return client, server, result
+}
+
+func TestProxyTCPHalfClose(t *testing.T) {
+	client, server, result := proxiedTCPPair(t, ProxyOptions{})
+	if _, err := client.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server sees the end of the request, and can still answer
+	_ = server.SetDeadline(time.Now().Add(5 * time.Second))
+	request, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(request) != "request" {
+		t.Fatalf("unexpected request %q", request)
+	}
+	if _, err = server.Write([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+	_ = server.Close()
+
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	response, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "response" {
+		t.Fatalf("unexpected response %q", response)
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("cleanly finished proxy returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy did not finish")
+	}
+}
+
+func TestProxyTCPIdleTimeout(t *testing.T) {
+	client, server, result := proxiedTCPPair(t, ProxyOptions{IdleTimeout: 200 * time.Millisecond})
+
+	// Traffic in either direction keeps the connection open
+	buf := make([]byte, 4)
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(server, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case err := <-result:
+		if err != ErrIdleTimeout {
+			t.Fatalf("expected an idle timeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection was not closed")
+	}
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(buf); err == nil {
+		t.Fatal("client should be disconnected")
+	}
+}
+
+func TestProxyTCPWithoutHalfClose(t *testing.T) {
+	// Wrappers of a connection which can't half-close can't either
+	for name, wrap := range map[string]func(net.Conn) net.Conn{
+		"Pipe":     func(c net.Conn) net.Conn { return c },
+		"Limited":  func(c net.Conn) net.Conn { return NewLimitedConn(c, nil) },
+		"Balanced": func(c net.Conn) net.Conn { return &balancedConn{Conn: c, target: &balancerTarget{}} },
+		"Replay":   func(c net.Conn) net.Conn { return &replayConn{Conn: c, reader: c} },
+	} {
+		t.Run(name, func(t *testing.T) {
+			client, proxyIn := net.Pipe()
+			proxyOut, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			result := make(chan error, 1)
+			go func() { result <- ProxyTCP(1500, proxyIn, wrap(proxyOut)) }()
+
+			go func() {
+				_, _ = client.Write([]byte("request"))
+				_ = client.Close()
+			}()
+			// The end of the request can't be passed on, so the server
+			// connection is closed after it
+			_ = server.SetDeadline(time.Now().Add(5 * time.Second))
+			request, err := io.ReadAll(server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(request) != "request" {
+				t.Fatalf("unexpected request %q", request)
+			}
+			select {
+			case err := <-result:
+				if err != nil {
+					t.Fatalf("cleanly finished proxy returned %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("proxy did not finish")
+			}
+		})
+	}
+}
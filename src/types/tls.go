@@ -0,0 +1,197 @@
+package types
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+)
+
+// How long certificates made by NodeCertificate are valid by default
+const NodeCertificateValidity = 365 * 24 * time.Hour
+
+// KeyHasAddress reports whether the address is the node address of the
+// public key. Addresses from the subnet of the node don't count, as any
+// host routed through the node can use those.
+func KeyHasAddress(key ed25519.PublicKey, ip net.IP) bool {
+	addr := address.AddrForKey(key)
+	return addr != nil && net.IP(addr[:]).Equal(ip)
+}
+
+// KeyMatchesAddress reports whether the address, or the subnet it is
+// in, belongs to the node with the public key
+func KeyMatchesAddress(key ed25519.PublicKey, ip net.IP) bool {
+	if KeyHasAddress(key, ip) {
+		return true
+	}
+	snet := address.SubnetForKey(key)
+	ip16 := ip.To16()
+	return ip16 != nil && snet != nil && string(ip16[:len(snet)]) == string(snet[:])
+}
+
+// CertificateOptions tunes NodeCertificateWithOptions
+type CertificateOptions struct {
+	Hosts    []string      // Labels to prefix the node's name with, i.e. "www" or "*"
+	Validity time.Duration // Defaults to NodeCertificateValidity
+}
+
+// NodeCertificate creates a self-signed certificate for the node with the
+// private key, see NodeCertificateWithOptions.
+func NodeCertificate(key ed25519.PrivateKey) (tls.Certificate, error) {
+	return NodeCertificateWithOptions(key, CertificateOptions{})
+}
+
+// NodeCertificateWithOptions creates a self-signed certificate with the
+// private key of a node, for its name under .pk.ygg, any hosts under
+// that name, and its address. Clients can verify it without any
+// certificate authority, with VerifyNodeCertificate by the address or
+// with VerifyNodeName by the name.
+func NodeCertificateWithOptions(key ed25519.PrivateKey, options CertificateOptions) (tls.Certificate, error) {
+	if options.Validity <= 0 {
+		options.Validity = NodeCertificateValidity
+	}
+	public := key.Public().(ed25519.PublicKey)
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	name := hex.EncodeToString(public) + NameMappingSuffix
+	names := []string{name}
+	for _, host := range options.Hosts {
+		names = append(names, host+"."+name)
+	}
+	addr := address.AddrForKey(public)
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              names,
+		IPAddresses:           []net.IP{addr[:]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(options.Validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, public, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("x509.CreateCertificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("x509.ParseCertificate: %w", err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// PublicKeyForName returns the public key encoded in a .pk.ygg name,
+// which is the rightmost label before the suffix
+func PublicKeyForName(name string) (ed25519.PublicKey, error) {
+	name = strings.TrimSuffix(name, ".")
+	if !strings.HasSuffix(name, NameMappingSuffix) {
+		return nil, fmt.Errorf("%q is not a %s name", name, NameMappingSuffix)
+	}
+	name = strings.TrimSuffix(name, NameMappingSuffix)
+	name = name[strings.LastIndex(name, ".")+1:]
+	key, err := hex.DecodeString(name)
+	if err != nil {
+		return nil, fmt.Errorf("hex.DecodeString: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key %q has the wrong length", name)
+	}
+	return key, nil
+}
+
+// VerifyNodeName checks that a certificate is valid for a .pk.ygg name
+// and was made with the key encoded in that name
+func VerifyNodeName(cert *x509.Certificate, name string) error {
+	expected, err := PublicKeyForName(name)
+	if err != nil {
+		return err
+	}
+	key, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return errors.New("certificate is not for an Yggdrasil key")
+	}
+	if !key.Equal(expected) {
+		return fmt.Errorf("certificate key %s does not match %s", hex.EncodeToString(key), name)
+	}
+	if err = cert.VerifyHostname(strings.TrimSuffix(name, ".")); err != nil {
+		return err
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return errors.New("certificate is expired or not yet valid")
+	}
+	return nil
+}
+
+// NodeNameTLSConfig returns a client configuration which accepts the
+// server by the key in its .pk.ygg name rather than a certificate
+// authority
+func NodeNameTLSConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		ServerName: serverName,
+		// The certificate authority is the name itself
+		InsecureSkipVerify: true, // nolint:gosec
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("no certificate presented")
+			}
+			return VerifyNodeName(state.PeerCertificates[0], state.ServerName)
+		},
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// VerifyNodeCertificate checks that the certificate presented by a peer
+// was made with the key of the node with the address
+func VerifyNodeCertificate(rawCerts [][]byte, ip net.IP) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no certificate presented")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return fmt.Errorf("x509.ParseCertificate: %w", err)
+	}
+	key, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return errors.New("certificate is not for an Yggdrasil key")
+	}
+	if !KeyMatchesAddress(key, ip) {
+		return fmt.Errorf("certificate key %s does not belong to %s", hex.EncodeToString(key), ip)
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return errors.New("certificate is expired or not yet valid")
+	}
+	return nil
+}
+
+// PinnedTLSConfig returns a client configuration which only accepts the
+// node with the address, optionally sending a server name
+func PinnedTLSConfig(ip net.IP, serverName string) *tls.Config {
+	return &tls.Config{
+		ServerName: serverName,
+		// The certificate authority is the address itself
+		InsecureSkipVerify: true, // nolint:gosec
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return VerifyNodeCertificate(rawCerts, ip)
+		},
+		MinVersion: tls.VersionTLS12,
+	}
+}
@@ -0,0 +1,150 @@
+package types
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+)
+
+func TestNodeCertificate(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := NodeCertificate(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := hex.EncodeToString(public) + NameMappingSuffix
+	if err = cert.Leaf.VerifyHostname(name); err != nil {
+		t.Fatal(err)
+	}
+	addr, snet := address.AddrForKey(public), address.SubnetForKey(public)
+	if err = VerifyNodeCertificate(cert.Certificate, addr[:]); err != nil {
+		t.Fatal(err)
+	}
+	inSubnet := make(net.IP, 16)
+	copy(inSubnet, snet[:])
+	inSubnet[15] = 1
+	if err = VerifyNodeCertificate(cert.Certificate, inSubnet); err != nil {
+		t.Fatalf("address in the subnet should match: %s", err)
+	}
+
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	otherAddr := address.AddrForKey(other)
+	if err = VerifyNodeCertificate(cert.Certificate, otherAddr[:]); err == nil {
+		t.Fatal("certificate of another node should be refused")
+	}
+}
+
+func TestVerifyNodeCertificateKeyType(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.ygg"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyNodeCertificate([][]byte{der}, net.ParseIP("200::1")); err == nil {
+		t.Fatal("certificate without an Yggdrasil key should be refused")
+	}
+}
+
+func TestPinnedTLSConfig(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := NodeCertificate(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := address.AddrForKey(private.Public().(ed25519.PublicKey))
+	for ip, ok := range map[string]bool{net.IP(addr[:]).String(): true, "200::1": false} {
+		c, s := net.Pipe()
+		server := tls.Server(s, &tls.Config{Certificates: []tls.Certificate{cert}})
+		go func() {
+			_ = server.Handshake()
+			_ = server.Close()
+		}()
+		client := tls.Client(c, PinnedTLSConfig(net.ParseIP(ip), ""))
+		if err = client.Handshake(); (err == nil) != ok {
+			t.Fatalf("handshake with %s pinned: %v", ip, err)
+		}
+		_ = client.Close()
+	}
+}
+
+func TestVerifyNodeName(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := NodeCertificateWithOptions(private, CertificateOptions{Hosts: []string{"www"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := hex.EncodeToString(public) + NameMappingSuffix
+	for _, valid := range []string{name, "www." + name, name + "."} {
+		if err = VerifyNodeName(cert.Leaf, valid); err != nil {
+			t.Fatalf("%s: %s", valid, err)
+		}
+	}
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	for _, invalid := range []string{
+		"mail." + name, // Not in the certificate
+		hex.EncodeToString(other) + NameMappingSuffix, // Another key
+		"example.com",
+		"abcd" + NameMappingSuffix,
+	} {
+		if err = VerifyNodeName(cert.Leaf, invalid); err == nil {
+			t.Fatalf("%s should be refused", invalid)
+		}
+	}
+}
+
+func TestNodeNameTLSConfig(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := NodeCertificate(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	for name, ok := range map[string]bool{
+		hex.EncodeToString(public) + NameMappingSuffix: true,
+		hex.EncodeToString(other) + NameMappingSuffix:  false,
+	} {
+		c, s := net.Pipe()
+		server := tls.Server(s, &tls.Config{Certificates: []tls.Certificate{cert}})
+		go func() {
+			_ = server.Handshake()
+			_ = server.Close()
+		}()
+		client := tls.Client(c, NodeNameTLSConfig(name))
+		if err = client.Handshake(); (err == nil) != ok {
+			t.Fatalf("handshake with %s: %v", name, err)
+		}
+		_ = client.Close()
+	}
+}
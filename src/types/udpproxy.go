@@ -1,22 +1,59 @@
 package types
 
 import (
+	"errors"
 	"net"
+	"syscall"
+	"time"
 )
 
-func ReverseProxyUDP(mtu uint64, dst net.PacketConn, dstAddr net.Addr, src net.Conn) error {
+// How ServeUDP backs off after temporary errors
+var (
+	udpRetryMin = 5 * time.Millisecond
+	udpRetryMax = time.Second
+)
+
+// ServeUDP reads datagrams from the listener and forwards each of them,
+// including the first one of a new session, through the session
+// manager. It returns once the listener fails. Datagrams which arrive
+// along with an error are still forwarded, and temporary errors are
+// retried with a backoff.
+func ServeUDP(mtu uint64, listener net.PacketConn, sessions *UDPSessionManager) error {
 	buf := make([]byte, mtu)
+	backoff := udpRetryMin
 	for {
-		n, err := src.Read(buf[:])
-		if err != nil {
+		n, addr, err := listener.ReadFrom(buf)
+		if addr != nil && (n > 0 || err == nil) {
+			// Failures are counted in the session statistics
+			_ = sessions.Forward(addr, buf[:n])
+		}
+		if err == nil {
+			backoff = udpRetryMin
+			continue
+		}
+		if !IsTemporary(err) {
 			return err
 		}
-		if n > 0 {
-			n, err = dst.WriteTo(buf[:n], dstAddr)
-			if err != nil {
-				return err
-			}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > udpRetryMax {
+			backoff = udpRetryMax
+		}
+	}
+}
+
+// IsTemporary reports whether a socket error may go away by itself
+func IsTemporary(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	for _, errno := range []syscall.Errno{
+		syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM,
+		syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EINTR,
+	} {
+		if errors.Is(err, errno) {
+			return true
 		}
 	}
-	return nil
+	return false
 }
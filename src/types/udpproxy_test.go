@@ -0,0 +1,149 @@
+package types
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/yggdrasil-network/yggstack/src/netstack/netstacktest"
+)
+
+func serveUDPEcho(t *testing.T, conn net.PacketConn) {
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(buf[:n], addr)
+		}
+	}()
+}
+
+// assertUDPDelivery sends a burst of numbered datagrams, the first of
+// which opens the session, and expects all of them back in order
+func assertUDPDelivery(t *testing.T, client net.Conn) {
+	t.Helper()
+	const count = 20
+	for i := 0; i < count; i++ {
+		if _, err := fmt.Fprintf(client, "datagram %d", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, 1500)
+	for i := 0; i < count; i++ {
+		_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("datagram %d not delivered: %s", i, err)
+		}
+		if expected := fmt.Sprintf("datagram %d", i); string(buf[:n]) != expected {
+			t.Fatalf("expected %q, got %q", expected, buf[:n])
+		}
+	}
+}
+
+func TestServeUDP(t *testing.T) {
+	a, b := netstacktest.NewPeered(t)
+
+	// A local mapping on A forwards from the host to an echo server on B
+	remoteEcho, err := b.ListenUDP(&net.UDPAddr{Port: 5353})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveUDPEcho(t, remoteEcho)
+	local := listenLoopbackUDP(t)
+	localSessions := NewUDPSessionManager(1500, local, func(net.Addr) (net.Conn, error) {
+		return a.DialUDP(&net.UDPAddr{IP: b.Address(), Port: 5353})
+	}, UDPSessionOptions{})
+	t.Cleanup(func() { _ = localSessions.Close() })
+	go ServeUDP(1500, local, localSessions) // nolint:errcheck
+
+	// A remote mapping on B forwards from the network to an echo server
+	// on the host
+	hostEcho := listenLoopbackUDP(t)
+	serveUDPEcho(t, hostEcho)
+	remote, err := b.ListenUDP(&net.UDPAddr{Port: 53})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = remote.Close() })
+	remoteSessions := NewUDPSessionManager(1500, remote, func(net.Addr) (net.Conn, error) {
+		return net.DialUDP("udp", nil, hostEcho.LocalAddr().(*net.UDPAddr))
+	}, UDPSessionOptions{})
+	t.Cleanup(func() { _ = remoteSessions.Close() })
+	go ServeUDP(1500, remote, remoteSessions) // nolint:errcheck
+
+	t.Run("Local", func(t *testing.T) {
+		client, err := net.DialUDP("udp", nil, local.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		assertUDPDelivery(t, client)
+		if stats := localSessions.Stats(); stats.Created != 1 || stats.PacketsForwarded != 20 {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+	})
+	t.Run("Remote", func(t *testing.T) {
+		client, err := a.DialUDP(&net.UDPAddr{IP: b.Address(), Port: 53})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		assertUDPDelivery(t, client)
+		if stats := remoteSessions.Stats(); stats.Created != 1 || stats.PacketsForwarded != 20 {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+	})
+	t.Run("Empty", func(t *testing.T) {
+		client, err := net.DialUDP("udp", nil, local.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		if _, err = client.Write(nil); err != nil {
+			t.Fatal(err)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if n, err := client.Read(make([]byte, 16)); err != nil || n != 0 {
+			t.Fatalf("expected an empty datagram back, got %d bytes: %v", n, err)
+		}
+	})
+}
+
+func TestServeUDPStopsWithListener(t *testing.T) {
+	listener := listenLoopbackUDP(t)
+	sessions := NewUDPSessionManager(1500, listener, func(net.Addr) (net.Conn, error) {
+		return nil, fmt.Errorf("unreachable")
+	}, UDPSessionOptions{})
+	result := make(chan error, 1)
+	go func() { result <- ServeUDP(1500, listener, sessions) }()
+	_ = listener.Close()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Fatal("expected the listener error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeUDP did not return after the listener was closed")
+	}
+}
+
+func TestIsTemporary(t *testing.T) {
+	for err, temporary := range map[error]bool{
+		&net.OpError{Op: "accept", Err: fmt.Errorf("accept: %w", syscall.EMFILE)}: true,
+		fmt.Errorf("wrapped: %w", syscall.ECONNABORTED):                           true,
+		os.ErrDeadlineExceeded: true,
+		net.ErrClosed:          false,
+	} {
+		if IsTemporary(err) != temporary {
+			t.Errorf("IsTemporary(%v) should be %t", err, temporary)
+		}
+	}
+}
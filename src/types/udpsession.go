@@ -0,0 +1,313 @@
+package types
+
+import (
+	"container/list"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for UDPSessionOptions
+const (
+	DefaultUDPIdleTimeout = 2 * time.Minute
+	DefaultUDPMaxSessions = 1024
+)
+
+// UDPSessionOptions limits the sessions of a UDP mapping
+type UDPSessionOptions struct {
+	IdleTimeout time.Duration // Close sessions without traffic for this long
+	MaxSessions int           // Evict the least recently used session beyond this, 0 for no limit
+}
+
+// UDPSessionStats are counters of a UDPSessionManager
+type UDPSessionStats struct {
+	Active           int    `json:"active"`
+	Created          uint64 `json:"created"`
+	Expired          uint64 `json:"expired"`
+	Evicted          uint64 `json:"evicted"`
+	DialFailures     uint64 `json:"dial_failures"`
+	PacketsForwarded uint64 `json:"packets_forwarded"`
+	PacketsReturned  uint64 `json:"packets_returned"`
+	BytesForwarded   uint64 `json:"bytes_forwarded"`
+	BytesReturned    uint64 `json:"bytes_returned"`
+	Dropped          uint64 `json:"dropped"`
+}
+
+// UDPSessionManager relays datagrams between the clients of a listening
+// socket and a connection per client to the mapped address. Sessions
+// are closed when idle, and the least recently used one is evicted when
+// there are too many.
+type UDPSessionManager struct {
+	mtu      uint64
+	listener net.PacketConn
+	dial     func(client net.Addr) (net.Conn, error)
+	reply    func(client net.Addr) (net.Conn, error) // Replaces the listener for replies if set
+	options  UDPSessionOptions
+	mutex    sync.Mutex
+	sessions map[string]*list.Element
+	lru      *list.List // Of *udpSession, most recently used first
+	closed   bool
+	draining bool          // No new sessions are started
+	drained  chan struct{} // Closed once no sessions are left while draining
+	stats    struct {
+		created, expired, evicted, dialFailures atomic.Uint64
+		packetsForwarded, packetsReturned       atomic.Uint64
+		bytesForwarded, bytesReturned, dropped  atomic.Uint64
+	}
+}
+
+type udpSession struct {
+	key        string
+	client     net.Addr
+	conn       net.Conn
+	reply      net.Conn // Connection to the client, if not the listener
+	lastActive atomic.Int64
+}
+
+func (s *udpSession) close() {
+	_ = s.conn.Close()
+	if s.reply != nil {
+		_ = s.reply.Close()
+	}
+}
+
+// NewUDPSessionManager creates a session manager which sends replies to
+// clients through the listener, and dials the mapped address for each
+// new client. A zero idle timeout is replaced with the default.
+func NewUDPSessionManager(mtu uint64, listener net.PacketConn, dial func(client net.Addr) (net.Conn, error), options UDPSessionOptions) *UDPSessionManager {
+	if options.IdleTimeout <= 0 {
+		options.IdleTimeout = DefaultUDPIdleTimeout
+	}
+	if options.MaxSessions < 0 {
+		options.MaxSessions = 0
+	}
+	return &UDPSessionManager{
+		mtu:      mtu,
+		listener: listener,
+		dial:     dial,
+		options:  options,
+		sessions: make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// NewUDPSessionManagerWithReplies creates a session manager which sends
+// replies to each client through a connection of its own from reply,
+// i.e. one bound to the address the client sent its datagrams to.
+// Datagrams which the client sends to that connection are forwarded as
+// well.
+func NewUDPSessionManagerWithReplies(mtu uint64, dial, reply func(client net.Addr) (net.Conn, error), options UDPSessionOptions) *UDPSessionManager {
+	m := NewUDPSessionManager(mtu, nil, dial, options)
+	m.reply = reply
+	return m
+}
+
+// Forward sends a datagram from the client to the mapped address,
+// starting a session for the client if there is none.
+func (m *UDPSessionManager) Forward(client net.Addr, data []byte) error {
+	session, err := m.session(client)
+	if err != nil {
+		return err
+	}
+	session.lastActive.Store(time.Now().UnixNano())
+	if _, err = session.conn.Write(data); err != nil {
+		m.stats.dropped.Add(1)
+		m.remove(session)
+		return err
+	}
+	m.stats.packetsForwarded.Add(1)
+	m.stats.bytesForwarded.Add(uint64(len(data)))
+	return nil
+}
+
+func (m *UDPSessionManager) session(client net.Addr) (*udpSession, error) {
+	key := client.String()
+	m.mutex.Lock()
+	if elem, ok := m.sessions[key]; ok {
+		m.lru.MoveToFront(elem)
+		m.mutex.Unlock()
+		return elem.Value.(*udpSession), nil
+	}
+	m.mutex.Unlock()
+
+	// Dial without holding the lock, as it may take a while
+	conn, err := m.dial(client)
+	if err != nil {
+		m.stats.dialFailures.Add(1)
+		return nil, err
+	}
+	session := &udpSession{
+		key:    key,
+		client: client,
+		conn:   conn,
+	}
+	if m.reply != nil {
+		if session.reply, err = m.reply(client); err != nil {
+			_ = conn.Close()
+			m.stats.dialFailures.Add(1)
+			return nil, err
+		}
+	}
+	session.lastActive.Store(time.Now().UnixNano())
+
+	m.mutex.Lock()
+	if m.closed || m.draining {
+		m.mutex.Unlock()
+		session.close()
+		return nil, net.ErrClosed
+	}
+	if elem, ok := m.sessions[key]; ok {
+		// Another datagram from the client raced us to it
+		m.lru.MoveToFront(elem)
+		m.mutex.Unlock()
+		session.close()
+		return elem.Value.(*udpSession), nil
+	}
+	var evicted *udpSession
+	if m.options.MaxSessions > 0 && len(m.sessions) >= m.options.MaxSessions {
+		evicted = m.lru.Remove(m.lru.Back()).(*udpSession)
+		delete(m.sessions, evicted.key)
+	}
+	m.sessions[key] = m.lru.PushFront(session)
+	m.mutex.Unlock()
+
+	if evicted != nil {
+		m.stats.evicted.Add(1)
+		evicted.close()
+	}
+	m.stats.created.Add(1)
+	go m.relay(session)
+	if session.reply != nil {
+		go m.forwardReplies(session)
+	}
+	return session, nil
+}
+
+// relay returns datagrams from the mapped address to the client until
+// the session is idle for too long or closed.
+func (m *UDPSessionManager) relay(session *udpSession) {
+	defer m.remove(session)
+	buf := make([]byte, m.mtu)
+	for {
+		idle := time.Since(time.Unix(0, session.lastActive.Load()))
+		if idle >= m.options.IdleTimeout {
+			m.stats.expired.Add(1)
+			return
+		}
+		_ = session.conn.SetReadDeadline(time.Now().Add(m.options.IdleTimeout - idle))
+		n, err := session.conn.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		session.lastActive.Store(time.Now().UnixNano())
+		if session.reply != nil {
+			_, err = session.reply.Write(buf[:n])
+		} else {
+			_, err = m.listener.WriteTo(buf[:n], session.client)
+		}
+		if err != nil {
+			m.stats.dropped.Add(1)
+			return
+		}
+		m.stats.packetsReturned.Add(1)
+		m.stats.bytesReturned.Add(uint64(n))
+	}
+}
+
+// forwardReplies forwards the datagrams which the client sends to the
+// reply connection of the session, until relay closes it.
+func (m *UDPSessionManager) forwardReplies(session *udpSession) {
+	defer m.remove(session)
+	buf := make([]byte, m.mtu)
+	for {
+		n, err := session.reply.Read(buf)
+		if err != nil {
+			return
+		}
+		session.lastActive.Store(time.Now().UnixNano())
+		if _, err = session.conn.Write(buf[:n]); err != nil {
+			m.stats.dropped.Add(1)
+			return
+		}
+		m.stats.packetsForwarded.Add(1)
+		m.stats.bytesForwarded.Add(uint64(n))
+	}
+}
+
+// remove closes the session and takes it out of the table, unless it
+// was replaced already.
+func (m *UDPSessionManager) remove(session *udpSession) {
+	m.mutex.Lock()
+	if elem, ok := m.sessions[session.key]; ok && elem.Value == session {
+		m.lru.Remove(elem)
+		delete(m.sessions, session.key)
+		if len(m.sessions) == 0 && m.drained != nil {
+			close(m.drained)
+			m.drained = nil
+		}
+	}
+	m.mutex.Unlock()
+	session.close()
+}
+
+// Stats returns the counters of the session manager
+func (m *UDPSessionManager) Stats() UDPSessionStats {
+	m.mutex.Lock()
+	active := len(m.sessions)
+	m.mutex.Unlock()
+	return UDPSessionStats{
+		Active:           active,
+		Created:          m.stats.created.Load(),
+		Expired:          m.stats.expired.Load(),
+		Evicted:          m.stats.evicted.Load(),
+		DialFailures:     m.stats.dialFailures.Load(),
+		PacketsForwarded: m.stats.packetsForwarded.Load(),
+		PacketsReturned:  m.stats.packetsReturned.Load(),
+		BytesForwarded:   m.stats.bytesForwarded.Load(),
+		BytesReturned:    m.stats.bytesReturned.Load(),
+		Dropped:          m.stats.dropped.Load(),
+	}
+}
+
+// Drain stops starting sessions for new clients, while the existing
+// ones keep forwarding until they are idle. It returns a channel which is
+// closed once no sessions are left.
+func (m *UDPSessionManager) Drain() <-chan struct{} {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.draining = true
+	drained := make(chan struct{})
+	if len(m.sessions) == 0 {
+		close(drained)
+	} else {
+		if m.drained != nil {
+			close(m.drained)
+		}
+		m.drained = drained
+	}
+	return drained
+}
+
+// Close closes all sessions. The listener is left open.
+func (m *UDPSessionManager) Close() error {
+	m.mutex.Lock()
+	m.closed = true
+	sessions := m.sessions
+	m.sessions = make(map[string]*list.Element)
+	m.lru.Init()
+	if m.drained != nil {
+		close(m.drained)
+		m.drained = nil
+	}
+	m.mutex.Unlock()
+	for _, elem := range sessions {
+		elem.Value.(*udpSession).close()
+	}
+	return nil
+}
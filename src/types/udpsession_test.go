@@ -0,0 +1,151 @@
+package types
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func listenLoopbackUDP(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// newTestSessionManager relays between a listener and an echo server
+func newTestSessionManager(t *testing.T, options UDPSessionOptions) (*UDPSessionManager, *net.UDPConn) {
+	echo := listenLoopbackUDP(t)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	listener := listenLoopbackUDP(t)
+	dial := func(net.Addr) (net.Conn, error) {
+		return net.DialUDP("udp", nil, echo.LocalAddr().(*net.UDPAddr))
+	}
+	m := NewUDPSessionManager(1500, listener, dial, options)
+	t.Cleanup(func() { _ = m.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := listener.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_ = m.Forward(addr, buf[:n])
+		}
+	}()
+	return m, listener
+}
+
+func assertUDPEcho(t *testing.T, client *net.UDPConn, to net.Addr, payload string) {
+	t.Helper()
+	if _, err := client.WriteTo([]byte(payload), to); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != payload {
+		t.Fatalf("expected %q, got %q", payload, buf[:n])
+	}
+}
+
+func waitForUDPStats(t *testing.T, m *UDPSessionManager, check func(UDPSessionStats) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !check(m.Stats()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected stats %+v", m.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUDPSessionManagerEviction(t *testing.T) {
+	m, listener := newTestSessionManager(t, UDPSessionOptions{MaxSessions: 2})
+	clients := []*net.UDPConn{listenLoopbackUDP(t), listenLoopbackUDP(t), listenLoopbackUDP(t)}
+	assertUDPEcho(t, clients[0], listener.LocalAddr(), "a")
+	assertUDPEcho(t, clients[1], listener.LocalAddr(), "b")
+	// Using the first session again makes the second one the least
+	// recently used, so it is evicted for the third
+	assertUDPEcho(t, clients[0], listener.LocalAddr(), "c")
+	assertUDPEcho(t, clients[2], listener.LocalAddr(), "d")
+
+	waitForUDPStats(t, m, func(s UDPSessionStats) bool {
+		return s.Active == 2 && s.Created == 3 && s.Evicted == 1 &&
+			s.PacketsForwarded == 4 && s.PacketsReturned == 4 && s.BytesReturned == 4
+	})
+	m.mutex.Lock()
+	_, present := m.sessions[clients[1].LocalAddr().String()]
+	m.mutex.Unlock()
+	if present {
+		t.Fatal("least recently used session should be evicted")
+	}
+
+	// An evicted client gets a new session
+	assertUDPEcho(t, clients[1], listener.LocalAddr(), "e")
+	waitForUDPStats(t, m, func(s UDPSessionStats) bool { return s.Created == 4 && s.Evicted == 2 })
+}
+
+func TestUDPSessionManagerIdleTimeout(t *testing.T) {
+	m, listener := newTestSessionManager(t, UDPSessionOptions{IdleTimeout: 100 * time.Millisecond})
+	client := listenLoopbackUDP(t)
+	assertUDPEcho(t, client, listener.LocalAddr(), "a")
+	waitForUDPStats(t, m, func(s UDPSessionStats) bool { return s.Active == 0 && s.Expired == 1 })
+	assertUDPEcho(t, client, listener.LocalAddr(), "b")
+	waitForUDPStats(t, m, func(s UDPSessionStats) bool { return s.Active == 1 && s.Created == 2 })
+}
+
+func TestUDPSessionManagerReplies(t *testing.T) {
+	echo := listenLoopbackUDP(t)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	dial := func(net.Addr) (net.Conn, error) {
+		return net.DialUDP("udp", nil, echo.LocalAddr().(*net.UDPAddr))
+	}
+	reply := func(client net.Addr) (net.Conn, error) {
+		return net.DialUDP("udp", nil, client.(*net.UDPAddr))
+	}
+	m := NewUDPSessionManagerWithReplies(1500, dial, reply, UDPSessionOptions{})
+	t.Cleanup(func() { _ = m.Close() })
+
+	client := listenLoopbackUDP(t)
+	if err := m.Forward(client.LocalAddr(), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, from, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "a" {
+		t.Fatalf("expected %q, got %q", "a", buf[:n])
+	}
+	// Datagrams sent back to the reply connection are forwarded too
+	assertUDPEcho(t, client, from, "b")
+	waitForUDPStats(t, m, func(s UDPSessionStats) bool {
+		return s.Active == 1 && s.Created == 1 && s.PacketsForwarded == 2 && s.PacketsReturned == 2
+	})
+}
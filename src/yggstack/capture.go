@@ -0,0 +1,101 @@
+package yggstack
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/yggdrasil-network/yggstack/src/netstack"
+)
+
+// StartCapture writes packets exchanged with the Yggdrasil network to a
+// pcap file, replacing any capture already running.
+func (n *Node) StartCapture(options netstack.CaptureOptions) error {
+	return n.whenStarted(func() error {
+		if err := n.netstack.StartCapture(options); err != nil {
+			return fmt.Errorf("n.netstack.StartCapture: %w", err)
+		}
+		n.logger.Infof("Capturing packets to %s", options.Path)
+		return nil
+	})
+}
+
+// StopCapture stops the running packet capture, if any.
+func (n *Node) StopCapture() error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.netstack == nil {
+		return nil
+	}
+	if options, ok := n.netstack.Capturing(); ok {
+		n.logger.Infof("Stopped capturing packets to %s", options.Path)
+	}
+	return n.netstack.StopCapture()
+}
+
+// adminCapturePath returns where a capture started over the admin socket
+// is written. Admin clients only name a file in the capture directory,
+// so that they can't overwrite files elsewhere.
+func (n *Node) adminCapturePath(name string) (string, error) {
+	switch {
+	case n.config.captureDir == "":
+		return "", fmt.Errorf("no capture directory is configured")
+	case name == "":
+		return "", fmt.Errorf("path is required")
+	case name != filepath.Base(name) || name == "." || name == "..":
+		return "", fmt.Errorf("path must be a file name in the capture directory")
+	}
+	return filepath.Join(n.config.captureDir, name), nil
+}
+
+type StartCaptureRequest struct {
+	Path     string `json:"path"`
+	Filter   string `json:"filter"`
+	MaxSize  int64  `json:"maxsize"`
+	MaxFiles int    `json:"maxfiles"`
+}
+type StartCaptureResponse struct {
+	Path string `json:"path"`
+}
+
+type StopCaptureRequest struct{}
+type StopCaptureResponse struct{}
+
+func (n *Node) setupCaptureAdminHandlers() {
+	_ = n.admin.AddHandler(
+		"startCapture", "Capture packets exchanged with the network to a pcap file in the capture directory", []string{"path", "[filter]", "[maxsize]", "[maxfiles]"},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &StartCaptureRequest{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			path, err := n.adminCapturePath(req.Path)
+			if err != nil {
+				return nil, err
+			}
+			if err := n.netstack.StartCapture(netstack.CaptureOptions{
+				Path:     path,
+				MaxSize:  req.MaxSize,
+				MaxFiles: req.MaxFiles,
+				Filter:   req.Filter,
+			}); err != nil {
+				return nil, err
+			}
+			n.logger.Infof("Capturing packets to %s", path)
+			return &StartCaptureResponse{Path: path}, nil
+		},
+	)
+	_ = n.admin.AddHandler(
+		"stopCapture", "Stop capturing packets", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &StopCaptureRequest{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if options, ok := n.netstack.Capturing(); ok {
+				n.logger.Infof("Stopped capturing packets to %s", options.Path)
+			}
+			return &StopCaptureResponse{}, n.netstack.StopCapture()
+		},
+	)
+}
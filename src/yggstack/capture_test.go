@@ -0,0 +1,27 @@
+package yggstack
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestAdminCapturePath(t *testing.T) {
+	n := newTestNode(t)
+	if _, err := n.adminCapturePath("ygg.pcap"); err == nil {
+		t.Fatal("captures need a capture directory")
+	}
+	dir := t.TempDir()
+	n = newTestNode(t, CaptureDirectory(dir))
+	path, err := n.adminCapturePath("ygg.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(dir, "ygg.pcap") {
+		t.Fatalf("unexpected path %s", path)
+	}
+	for _, name := range []string{"", ".", "..", "../ygg.pcap", "/etc/passwd", "sub/ygg.pcap"} {
+		if _, err := n.adminCapturePath(name); err == nil {
+			t.Fatalf("%q should be refused", name)
+		}
+	}
+}
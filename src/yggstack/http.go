@@ -0,0 +1,70 @@
+package yggstack
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/yggdrasil-network/yggstack/src/types"
+)
+
+// AddHTTPServer serves static directories or reverse-proxies to local
+// backends on a Yggdrasil port
+func (n *Node) AddHTTPServer(mapping types.HTTPMapping) error {
+	return n.whenStarted(func() error {
+		listener, err := n.netstack.ListenTCP(mapping.Listen)
+		if err != nil {
+			return fmt.Errorf("n.netstack.ListenTCP: %w", err)
+		}
+		server := &http.Server{
+			Handler:           types.NewHTTPHandler(mapping.Routes, n.publicKeyForAddress),
+			ReadHeaderTimeout: time.Minute,
+		}
+		n.closers = append(n.closers, server)
+		for _, route := range mapping.Routes {
+			target := route.Dir
+			if route.Target != nil {
+				target = route.Target.String()
+			}
+			host := route.Host
+			if host == "" {
+				host = "*"
+			}
+			n.logger.Infof("Serving HTTP on Yggdrasil TCP port %d for host %s from %s", mapping.Listen.Port, host, target)
+		}
+		go func() {
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				n.logger.Errorf("HTTP server on port %d stopped: %s", mapping.Listen.Port, err)
+			}
+		}()
+		return nil
+	})
+}
+
+// publicKeyForAddress finds the full public key of a remote node from
+// the session table, since an address only encodes part of the key.
+// Connections from the node itself have its own key. Only node
+// addresses match, as the hosts on the subnet of a node are not the node.
+func (n *Node) publicKeyForAddress(ip net.IP) ed25519.PublicKey {
+	return n.findPublicKey(ip, types.KeyHasAddress)
+}
+
+// publicKeyForRoute finds the public key of the node which the address
+// is routed through, which is the node itself or one on its subnet
+func (n *Node) publicKeyForRoute(ip net.IP) ed25519.PublicKey {
+	return n.findPublicKey(ip, types.KeyMatchesAddress)
+}
+
+func (n *Node) findPublicKey(ip net.IP, matches func(ed25519.PublicKey, net.IP) bool) ed25519.PublicKey {
+	if key := n.core.PublicKey(); matches(key, ip) {
+		return key
+	}
+	for _, session := range n.core.GetSessions() {
+		if matches(session.Key, ip) {
+			return session.Key
+		}
+	}
+	return nil
+}
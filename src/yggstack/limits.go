@@ -0,0 +1,152 @@
+package yggstack
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/things-go/go-socks5"
+
+	"github.com/yggdrasil-network/yggstack/src/types"
+)
+
+// LimitsStatus describes the limiters of the node by scope
+type LimitsStatus struct {
+	Global     *types.LimiterStats           `json:"global,omitempty"`
+	Mappings   map[string]types.LimiterStats `json:"mappings"`
+	SOCKSUsers map[string]types.LimiterStats `json:"socks_users"`
+	PublicKeys map[string]types.LimiterStats `json:"public_keys"`
+}
+
+func (n *Node) setupLimiters() {
+	n.limits.global = types.NewLimiter("the node", n.config.limits.Global, n.logger)
+	n.limits.users = types.NewLimiterGroup("SOCKS user", n.config.limits.SOCKSUser, n.logger)
+	n.limits.keys = types.NewLimiterGroup("public key", n.config.limits.PublicKey, n.logger)
+}
+
+// limiters returns the limiters of a connection, including the global
+// one, without those which don't limit anything
+func (n *Node) limiters(scoped ...*types.Limiter) types.Limiters {
+	limiters := make(types.Limiters, 0, len(scoped)+1)
+	for _, l := range append([]*types.Limiter{n.limits.global}, scoped...) {
+		if l != nil {
+			limiters = append(limiters, l)
+		}
+	}
+	return limiters
+}
+
+// keyLimiter returns the limiter of the remote node with the address,
+// which is identified by its public key if there is a session with it
+func (n *Node) keyLimiter(addr net.Addr) *types.Limiter {
+	if n.config.limits.PublicKey.IsZero() {
+		return nil
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return nil
+	}
+	// Hosts on the subnet of a node share its limit
+	if key := n.publicKeyForRoute(ip); key != nil {
+		return n.limits.keys.Get(hex.EncodeToString(key))
+	}
+	return n.limits.keys.Get(ip.String())
+}
+
+// addrIP returns the IP address of a TCP or UDP address, or nil
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	default:
+		return nil
+	}
+}
+
+// admit counts a new connection with the limiters, and logs which limit
+// refused it if one did
+func (n *Node) admit(what string, limiters types.Limiters) bool {
+	if refused := limiters.Acquire(); refused != nil {
+		n.logger.Debugf("Refusing %s: connection limit of %s reached", what, refused.Name())
+		return false
+	}
+	return true
+}
+
+// dialSOCKS dials the destination of a SOCKS request, subject to the
+// limits of the user and of the remote node
+func (n *Node) dialSOCKS(ctx context.Context, network, addr string, request *socks5.Request) (net.Conn, error) {
+	conn, err := n.resolver.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	limiters := n.limiters(n.socksUserLimiter(request), n.keyLimiter(conn.RemoteAddr()))
+	if len(limiters) == 0 {
+		return conn, nil
+	}
+	if !n.admit(fmt.Sprintf("SOCKS connection from %s to %s", request.RemoteAddr, addr), limiters) {
+		_ = conn.Close()
+		return nil, fmt.Errorf("connection limit reached")
+	}
+	return types.NewLimitedConn(conn, limiters), nil
+}
+
+// socksUserLimiter returns the limiter of the authenticated SOCKS user,
+// or of the client address if there is no authentication
+func (n *Node) socksUserLimiter(request *socks5.Request) *types.Limiter {
+	if n.config.limits.SOCKSUser.IsZero() {
+		return nil
+	}
+	if request.AuthContext != nil {
+		if user, ok := request.AuthContext.Payload["username"]; ok {
+			return n.limits.users.Get(user)
+		}
+	}
+	client := "local"
+	if addr, ok := request.RemoteAddr.(*net.TCPAddr); ok {
+		client = addr.IP.String()
+	}
+	return n.limits.users.Get(client)
+}
+
+// Limits returns the counters of the limiters in use
+func (n *Node) Limits() LimitsStatus {
+	status := LimitsStatus{
+		Mappings:   map[string]types.LimiterStats{},
+		SOCKSUsers: n.limits.users.Stats(),
+		PublicKeys: n.limits.keys.Stats(),
+	}
+	if n.limits.global != nil {
+		stats := n.limits.global.Stats()
+		status.Global = &stats
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for _, m := range n.mappings {
+		if m.limiter != nil {
+			status.Mappings[m.name] = m.limiter.Stats()
+		}
+	}
+	return status
+}
+
+type GetLimitsRequest struct{}
+type GetLimitsResponse LimitsStatus
+
+func (n *Node) setupLimitsAdminHandlers() {
+	_ = n.admin.AddHandler(
+		"getLimits", "Show bandwidth and connection limits and their counters", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetLimitsRequest{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			res := GetLimitsResponse(n.Limits())
+			return &res, nil
+		},
+	)
+}
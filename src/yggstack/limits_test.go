@@ -0,0 +1,64 @@
+package yggstack
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yggdrasil-network/yggstack/src/types"
+)
+
+func TestMappingConnectionLimit(t *testing.T) {
+	n, _ := startEchoMapping(t, Limits{Mapping: types.Limit{Conns: 1}})
+
+	// The first connection is still open, so the second one is refused
+	conn, err := n.Netstack().DialTCP(&net.TCPAddr{IP: n.Address(), Port: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write([]byte("ping")); err == nil {
+		_, err = conn.Read(make([]byte, 4))
+	}
+	if err == nil {
+		t.Fatal("connection beyond the limit should be closed")
+	}
+
+	status := n.Limits()
+	if len(status.Mappings) != 1 {
+		t.Fatalf("expected the limiter of the mapping, got %+v", status)
+	}
+	for _, stats := range status.Mappings {
+		if stats.Active != 1 || stats.Rejected != 1 {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+	}
+	if status.Global != nil {
+		t.Fatal("global limiter should not be used without a global limit")
+	}
+}
+
+func TestSOCKSUsersFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte("# SOCKS users\nalice:secret\n\nbob:pass:word\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	users := SOCKSUsers{}
+	if err := users.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users["alice"] != "secret" || users["bob"] != "pass:word" {
+		t.Fatalf("unexpected users %v", users)
+	}
+
+	if err := os.WriteFile(path, []byte("alice:secret\nbob\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.ReadFile(path); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Fatalf("expected an error for line 2, got %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package yggstack
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/yggdrasil-network/yggstack/src/types"
+)
+
+// AddLocalTCPMapping forwards connections from a local port to a remote
+// Yggdrasil node, or shares them between several
+func (n *Node) AddLocalTCPMapping(mapping types.TCPMapping) error {
+	return n.whenStarted(func() error {
+		targets := joinTargets(mapping.Targets())
+		name := fmt.Sprintf("local TCP %s to %s", mapping.Listen, targets)
+		dial := func(ctx context.Context, addr *net.TCPAddr) (net.Conn, error) {
+			return n.netstack.DialContext(ctx, "tcp", addr.String())
+		}
+		balancer := types.NewBalancer(name, mapping.Targets(), mapping.Balance, dial, n.config.health, n.logger)
+		go balancer.Run(n.ctx)
+		listen := func() (io.Closer, error) {
+			listener, err := net.ListenTCP("tcp", mapping.Listen)
+			if err != nil {
+				return nil, fmt.Errorf("net.ListenTCP: %w", err)
+			}
+			n.logger.Infof("Mapping local TCP port %d to Yggdrasil %s", mapping.Listen.Port, targets)
+			return listener, nil
+		}
+		forward := func(m *supervisedMapping, c net.Conn) {
+			r, err := balancer.Dial(n.ctx)
+			if err != nil {
+				n.logger.Errorf("Failed to connect to %s: %s", targets, err)
+				_ = c.Close()
+				return
+			}
+			if mapping.TLS != nil {
+				tr := tls.Client(r, types.PinnedTLSConfig(addrIP(r.RemoteAddr()), mapping.TLS.ServerName))
+				if err = n.handshakeTLS(tr); err != nil {
+					n.logger.Errorf("TLS handshake with %s failed: %s", r.RemoteAddr(), err)
+					_ = c.Close()
+					_ = r.Close()
+					return
+				}
+				r = tr
+			}
+			n.proxyTCP(c, r, m.limiter, n.keyLimiter(r.RemoteAddr()))
+		}
+		serve := func(m *supervisedMapping, socket io.Closer) error {
+			m.balancer.Store(balancer)
+			listener := socket.(net.Listener)
+			for {
+				c, err := m.accept(listener)
+				if err != nil {
+					return err
+				}
+				go forward(m, c)
+			}
+		}
+		return n.superviseMapping(name, false, listen, serve)
+	})
+}
+
+// AddRemoteTCPMapping forwards connections from a Yggdrasil port to a
+// local address, or shares them between several
+func (n *Node) AddRemoteTCPMapping(mapping types.TCPMapping) error {
+	return n.whenStarted(func() error {
+		targets := joinTargets(mapping.Targets())
+		name := fmt.Sprintf("remote TCP %s to %s", mapping.Listen, targets)
+		dial := func(ctx context.Context, addr *net.TCPAddr) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "tcp", addr.String())
+		}
+		balancer := types.NewBalancer(name, mapping.Targets(), mapping.Balance, dial, n.config.health, n.logger)
+		go balancer.Run(n.ctx)
+		routes := make([]sniRoute, 0, len(mapping.Routes))
+		for _, route := range mapping.Routes {
+			routeName := fmt.Sprintf("%s for %s", name, route.ServerName)
+			routes = append(routes, sniRoute{
+				serverName: route.ServerName,
+				balancer:   types.NewBalancer(routeName, []*net.TCPAddr{route.Target}, "", dial, n.config.health, n.logger),
+			})
+		}
+		listen := func() (io.Closer, error) {
+			listener, err := n.netstack.ListenTCP(mapping.Listen)
+			if err != nil {
+				return nil, fmt.Errorf("n.netstack.ListenTCP: %w", err)
+			}
+			n.logger.Infof("Mapping Yggdrasil TCP port %d to %s", mapping.Listen.Port, targets)
+			for _, route := range mapping.Routes {
+				n.logger.Infof("Mapping Yggdrasil TCP port %d for TLS server name %s to %s", mapping.Listen.Port, route.ServerName, route.Target)
+			}
+			return listener, nil
+		}
+		var tlsConfig *tls.Config
+		if mapping.TLS != nil {
+			var err error
+			if tlsConfig, err = n.serverTLSConfig(mapping.TLS); err != nil {
+				return err
+			}
+		}
+		forward := func(m *supervisedMapping, c net.Conn) {
+			if tlsConfig != nil {
+				tc := tls.Server(c, tlsConfig)
+				if err := n.handshakeTLS(tc); err != nil {
+					n.logger.Debugf("TLS handshake with %s failed: %s", c.RemoteAddr(), err)
+					_ = c.Close()
+					return
+				}
+				c = tc
+			}
+			target := balancer
+			if len(routes) > 0 {
+				c, target = n.routeServerName(c, routes, balancer)
+			}
+			r, err := target.Dial(n.ctx)
+			if err != nil {
+				n.logger.Errorf("Failed to connect for %s: %s", target.Name(), err)
+				_ = c.Close()
+				return
+			}
+			n.proxyTCP(c, r, m.limiter, n.keyLimiter(c.RemoteAddr()))
+		}
+		serve := func(m *supervisedMapping, socket io.Closer) error {
+			m.balancer.Store(balancer)
+			m.routes.Store(&routes)
+			listener := socket.(net.Listener)
+			for {
+				c, err := m.accept(listener)
+				if err != nil {
+					return err
+				}
+				go forward(m, c)
+			}
+		}
+		return n.superviseMapping(name, false, listen, serve)
+	})
+}
+
+// AddLocalUDPMapping forwards datagrams from a local port to a remote
+// Yggdrasil node
+func (n *Node) AddLocalUDPMapping(mapping types.UDPMapping) error {
+	return n.whenStarted(func() error {
+		name := fmt.Sprintf("local UDP %s to %s", mapping.Listen, mapping.Mapped)
+		listen := func() (io.Closer, error) {
+			udpListenConn, err := net.ListenUDP("udp", mapping.Listen)
+			if err != nil {
+				return nil, fmt.Errorf("net.ListenUDP: %w", err)
+			}
+			n.logger.Infof("Mapping local UDP port %d to Yggdrasil %s", mapping.Listen.Port, mapping.Mapped)
+			return udpListenConn, nil
+		}
+		serve := func(m *supervisedMapping, socket io.Closer) error {
+			udpListenConn := socket.(net.PacketConn)
+			dial := func(client net.Addr) (net.Conn, error) {
+				if n.stopping() {
+					return nil, errStopping
+				}
+				n.logger.Debugf("Creating new session for %s", client)
+				conn, err := n.netstack.DialUDP(mapping.Mapped)
+				if err != nil {
+					n.logger.Errorf("Failed to connect to %s: %s", mapping.Mapped, err)
+					return nil, err
+				}
+				return conn, nil
+			}
+			sessions := types.NewUDPSessionManager(n.core.MTU(), udpListenConn, dial, n.config.udp)
+			m.udp.Store(sessions)
+			defer sessions.Close() // nolint:errcheck
+			return types.ServeUDP(n.core.MTU(), udpListenConn, sessions)
+		}
+		return n.superviseMapping(name, true, listen, serve)
+	})
+}
+
+// AddRemoteUDPMapping forwards datagrams from a Yggdrasil port to a
+// local address
+func (n *Node) AddRemoteUDPMapping(mapping types.UDPMapping) error {
+	return n.whenStarted(func() error {
+		name := fmt.Sprintf("remote UDP %s to %s", mapping.Listen, mapping.Mapped)
+		listen := func() (io.Closer, error) {
+			udpListenConn, err := n.netstack.ListenUDP(mapping.Listen)
+			if err != nil {
+				return nil, fmt.Errorf("n.netstack.ListenUDP: %w", err)
+			}
+			n.logger.Infof("Mapping Yggdrasil UDP port %d to %s", mapping.Listen.Port, mapping.Mapped)
+			return udpListenConn, nil
+		}
+		serve := func(m *supervisedMapping, socket io.Closer) error {
+			udpListenConn := socket.(net.PacketConn)
+			dial := func(client net.Addr) (net.Conn, error) {
+				if n.stopping() {
+					return nil, errStopping
+				}
+				n.logger.Debugf("Creating new session for %s", client)
+				conn, err := net.DialUDP("udp", nil, mapping.Mapped)
+				if err != nil {
+					n.logger.Errorf("Failed to connect to %s: %s", mapping.Mapped, err)
+					return nil, err
+				}
+				return conn, nil
+			}
+			sessions := types.NewUDPSessionManager(n.core.MTU(), udpListenConn, dial, n.config.udp)
+			m.udp.Store(sessions)
+			defer sessions.Close() // nolint:errcheck
+			return types.ServeUDP(n.core.MTU(), udpListenConn, sessions)
+		}
+		return n.superviseMapping(name, true, listen, serve)
+	})
+}
+
+// joinTargets lists the targets of a mapping for logging
+func joinTargets(targets []*net.TCPAddr) string {
+	names := make([]string, 0, len(targets))
+	for _, target := range targets {
+		names = append(names, target.String())
+	}
+	return strings.Join(names, ",")
+}
+
+// acceptFailed logs a listener failure unless the node is shutting down
+func (n *Node) acceptFailed(listener net.Listener, err error) {
+	if n.stopping() {
+		return
+	}
+	n.logger.Errorf("Failed to accept on %s, mapping stopped: %s", listener.Addr(), err)
+}
@@ -0,0 +1,192 @@
+package yggstack
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/yggdrasil-network/yggstack/src/types"
+)
+
+func TestRemoteTCPMappingFailover(t *testing.T) {
+	// The first backend is down, the second one echoes
+	down, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = down.Close()
+	echo, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = echo.Close() })
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(c, c)
+				_ = c.Close()
+			}()
+		}
+	}()
+
+	n := newTestNode(t)
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.Stop)
+	if err := n.AddRemoteTCPMapping(types.TCPMapping{
+		Listen:  &net.TCPAddr{Port: 7},
+		Mapped:  down.Addr().(*net.TCPAddr),
+		Extra:   []*net.TCPAddr{echo.Addr().(*net.TCPAddr)},
+		Balance: types.BalanceRoundRobin,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		conn, err := n.Netstack().DialTCP(&net.TCPAddr{IP: n.Address(), Port: 7})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEcho(t, conn)
+		_ = conn.Close()
+	}
+
+	targets := n.Mappings()[0].Targets
+	if len(targets) != 2 || targets[0].Healthy || !targets[1].Healthy || targets[1].Conns != 3 {
+		t.Fatalf("unexpected targets %+v", targets)
+	}
+}
+
+func TestTCPMappingTLS(t *testing.T) {
+	// The node terminates TLS on Yggdrasil port 7 in front of the echo
+	// server, and originates it from a local port to that
+	n, _ := startEchoMapping(t)
+	echo := n.Mappings()[0].Targets[0].Address
+	mapped, err := net.ResolveTCPAddr("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = n.AddRemoteTCPMapping(types.TCPMapping{
+		Listen: &net.TCPAddr{Port: 443},
+		Mapped: mapped,
+		TLS:    &types.MappingTLS{},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	local := &net.TCPAddr{IP: net.IPv6loopback, Port: freeTCPPort(t)}
+	if err = n.AddLocalTCPMapping(types.TCPMapping{
+		Listen: local,
+		Mapped: &net.TCPAddr{IP: n.Address(), Port: 443},
+		TLS:    &types.MappingTLS{},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialTCP("tcp", nil, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn)
+
+	// Without TLS, the port doesn't answer in plain text
+	plain, err := n.Netstack().DialTCP(&net.TCPAddr{IP: n.Address(), Port: 443})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	_ = plain.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = plain.Write([]byte("ping\n")); err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := io.ReadAll(plain); string(buf) == "ping\n" {
+		t.Fatal("plain text should not be echoed")
+	}
+}
+
+func freeTCPPort(t *testing.T) int {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// startNamedTLSServer starts a local TLS server which answers with its name
+func startNamedTLSServer(t *testing.T, name string) *net.TCPAddr {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := types.NodeCertificate(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "[::1]:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = c.Write([]byte(name))
+			_ = c.Close()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr)
+}
+
+func TestRemoteTCPMappingSNI(t *testing.T) {
+	n := newTestNode(t)
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.Stop)
+	if err := n.AddRemoteTCPMapping(types.TCPMapping{
+		Listen: &net.TCPAddr{Port: 443},
+		Mapped: startNamedTLSServer(t, "default"),
+		Routes: []types.SNIRoute{
+			{ServerName: "app.example.ygg", Target: startNamedTLSServer(t, "app")},
+			{ServerName: "*.api.example.ygg", Target: startNamedTLSServer(t, "api")},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for serverName, expected := range map[string]string{
+		"app.example.ygg":    "app",
+		"v1.api.example.ygg": "api",
+		"www.example.ygg":    "default",
+		"":                   "default",
+	} {
+		conn, err := n.Netstack().DialTCP(&net.TCPAddr{IP: n.Address(), Port: 443})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}) // nolint:gosec
+		_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+		answer, err := io.ReadAll(client)
+		_ = client.Close()
+		if err != nil {
+			t.Fatalf("%q: %s", serverName, err)
+		}
+		if string(answer) != expected {
+			t.Fatalf("%q was routed to %q instead of %q", serverName, answer, expected)
+		}
+	}
+	if routes := n.Mappings()[0].Routes; len(routes) != 2 || routes["app.example.ygg"][0].Conns != 1 {
+		t.Fatalf("unexpected routes %+v", routes)
+	}
+}
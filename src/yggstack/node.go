@@ -0,0 +1,382 @@
+package yggstack
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gologme/log"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/admin"
+	"github.com/yggdrasil-network/yggdrasil-go/src/config"
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+	"github.com/yggdrasil-network/yggdrasil-go/src/multicast"
+
+	"github.com/yggdrasil-network/yggstack/src/netstack"
+	"github.com/yggdrasil-network/yggstack/src/types"
+
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+)
+
+// Node is a Yggdrasil node with a userspace network stack, which can
+// run SOCKS servers and port mappings on top of it.
+type Node struct {
+	mutex     sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	cfg       *config.NodeConfig
+	logger    *log.Logger
+	core      *core.Core
+	multicast *multicast.Multicast
+	admin     *admin.AdminSocket
+	netstack  *netstack.YggdrasilNetstack
+	resolver  *types.NameResolver
+	pending   []func() error // Things to start once the node is up
+	closers   []io.Closer    // Listeners to close on shutdown
+	sessions  sessionTracker // Proxied connections to drain on shutdown
+	mappings  []*supervisedMapping
+	limits    struct {
+		global      *types.Limiter
+		users, keys *types.LimiterGroup
+	}
+	done   chan struct{} // Closed once the node is stopped
+	err    error         // Why the node stopped by itself, if it did
+	config struct {
+		nameserver       string
+		tcp              *netstack.TCPOptions
+		mappingPolicy    MappingPolicy
+		udp              types.UDPSessionOptions
+		proxyIdleTimeout time.Duration
+		limits           types.Limits
+		health           types.HealthOptions
+		socksUsers       map[string]string
+		captureDir       string
+	}
+}
+
+// New creates a node from the given configuration. Nothing is started
+// until Start is called.
+func New(cfg *config.NodeConfig, logger *log.Logger, opts ...SetupOption) (*Node, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("no configuration supplied")
+	}
+	if logger == nil {
+		return nil, fmt.Errorf("no logger supplied")
+	}
+	n := &Node{
+		cfg:    cfg,
+		logger: logger,
+		done:   make(chan struct{}),
+	}
+	n.config.udp = types.UDPSessionOptions{
+		IdleTimeout: types.DefaultUDPIdleTimeout,
+		MaxSessions: types.DefaultUDPMaxSessions,
+	}
+	n.config.health = types.HealthOptions{
+		Interval:  types.DefaultHealthInterval,
+		Timeout:   types.DefaultHealthTimeout,
+		EjectTime: types.DefaultEjectTime,
+	}
+	for _, opt := range opts {
+		n._applyOption(opt)
+	}
+	n.setupLimiters()
+	return n, nil
+}
+
+// Start brings up the Yggdrasil core, admin socket, multicast and the
+// netstack, and then starts any SOCKS servers and mappings which were
+// added beforehand. Cancelling the context stops the node, as does the
+// netstack failing, in which case Err returns the reason.
+func (n *Node) Start(ctx context.Context) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.ctx != nil {
+		return fmt.Errorf("node is already started")
+	}
+	n.ctx, n.cancel = context.WithCancel(ctx)
+	if err := n._start(); err != nil {
+		n._stop()
+		return err
+	}
+	for _, start := range n.pending {
+		if err := start(); err != nil {
+			n._stop()
+			return err
+		}
+	}
+	n.pending = nil
+	go func(ctx context.Context, failed <-chan struct{}) {
+		select {
+		case <-ctx.Done():
+			n.Stop()
+		case <-failed:
+			_, err := n.netstack.Health()
+			n.logger.Errorf("Stopping because the Yggdrasil network is unreachable")
+			n.mutex.Lock()
+			defer n.mutex.Unlock()
+			n.err = err
+			n._stop()
+		}
+	}(n.ctx, n.netstack.Failed())
+	return nil
+}
+
+func (n *Node) _start() error {
+	var err error
+	cfg := n.cfg
+
+	// Setup the Yggdrasil node itself.
+	{
+		options := []core.SetupOption{
+			core.NodeInfo(cfg.NodeInfo),
+			core.NodeInfoPrivacy(cfg.NodeInfoPrivacy),
+		}
+		for _, addr := range cfg.Listen {
+			options = append(options, core.ListenAddress(addr))
+		}
+		for _, peer := range cfg.Peers {
+			options = append(options, core.Peer{URI: peer})
+		}
+		for intf, peers := range cfg.InterfacePeers {
+			for _, peer := range peers {
+				options = append(options, core.Peer{URI: peer, SourceInterface: intf})
+			}
+		}
+		for _, allowed := range cfg.AllowedPublicKeys {
+			k, err := hex.DecodeString(allowed)
+			if err != nil {
+				return fmt.Errorf("hex.DecodeString: %w", err)
+			}
+			options = append(options, core.AllowedPublicKey(k[:]))
+		}
+		if n.core, err = core.New(cfg.Certificate, n.logger, options...); err != nil {
+			return fmt.Errorf("core.New: %w", err)
+		}
+		address, subnet := n.core.Address(), n.core.Subnet()
+		publicstr := hex.EncodeToString(n.core.PublicKey())
+		n.logger.Printf("Your public key is %s", publicstr)
+		n.logger.Printf("Your IPv6 address is %s", address.String())
+		n.logger.Printf("Your IPv6 subnet is %s", subnet.String())
+		n.logger.Printf("Your Yggstack resolver name is %s%s", publicstr, types.NameMappingSuffix)
+	}
+
+	// Setup the admin socket.
+	{
+		options := []admin.SetupOption{
+			admin.ListenAddress(cfg.AdminListen),
+		}
+		if cfg.LogLookups {
+			options = append(options, admin.LogLookups{})
+		}
+		if n.admin, err = admin.New(n.core, n.logger, options...); err != nil {
+			return fmt.Errorf("admin.New: %w", err)
+		}
+		if n.admin != nil {
+			n.admin.SetupAdminHandlers()
+		}
+	}
+
+	// Setup the multicast module.
+	{
+		options := []multicast.SetupOption{}
+		for _, intf := range cfg.MulticastInterfaces {
+			regex, err := regexp.Compile(intf.Regex)
+			if err != nil {
+				return fmt.Errorf("regexp.Compile: %w", err)
+			}
+			options = append(options, multicast.MulticastInterface{
+				Regex:    regex,
+				Beacon:   intf.Beacon,
+				Listen:   intf.Listen,
+				Port:     intf.Port,
+				Priority: uint8(intf.Priority),
+				Password: intf.Password,
+			})
+		}
+		if n.multicast, err = multicast.New(n.core, n.logger, options...); err != nil {
+			return fmt.Errorf("multicast.New: %w", err)
+		}
+		if n.admin != nil && n.multicast != nil {
+			n.multicast.SetupAdminHandlers(n.admin)
+		}
+	}
+
+	// Setup Yggdrasil netstack
+	if n.netstack, err = netstack.CreateYggdrasilNetstack(n.core, n.logger); err != nil {
+		return fmt.Errorf("netstack.CreateYggdrasilNetstack: %w", err)
+	}
+	if n.config.tcp != nil {
+		if err = n.netstack.SetTCPOptions(*n.config.tcp); err != nil {
+			return fmt.Errorf("n.netstack.SetTCPOptions: %w", err)
+		}
+	}
+	n.resolver = types.NewNameResolver(n.netstack, n.config.nameserver, n.logger)
+	n.netstack.SetResolver(n.resolver)
+	if n.admin != nil {
+		n.setupCaptureAdminHandlers()
+		n.setupTCPAdminHandlers()
+		n.setupMappingAdminHandlers()
+		n.setupLimitsAdminHandlers()
+	}
+	return nil
+}
+
+// Stop closes all SOCKS servers and mappings and shuts down the node.
+func (n *Node) Stop() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n._stop()
+}
+
+func (n *Node) _stop() {
+	if n.cancel == nil {
+		return
+	}
+	n.cancel()
+	n.cancel = nil
+	for _, c := range n.closers {
+		_ = c.Close()
+	}
+	n.closers = nil
+	n.sessions.closeAll()
+	if n.netstack != nil {
+		_ = n.netstack.StopCapture()
+		n.netstack.Close()
+	}
+	if n.admin != nil {
+		_ = n.admin.Stop()
+	}
+	if n.multicast != nil {
+		_ = n.multicast.Stop()
+	}
+	if n.core != nil {
+		n.core.Stop()
+	}
+	close(n.done)
+}
+
+// whenStarted runs the function immediately if the node is running, or
+// defers it until Start otherwise.
+func (n *Node) whenStarted(start func() error) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	switch {
+	case n.ctx == nil:
+		n.pending = append(n.pending, start)
+		return nil
+	case n.cancel == nil:
+		return fmt.Errorf("node is stopped")
+	default:
+		return start()
+	}
+}
+
+// Done returns a channel which is closed once the node is stopped.
+func (n *Node) Done() <-chan struct{} {
+	return n.done
+}
+
+// Err returns why the node stopped by itself, or nil if it is running or
+// was stopped deliberately.
+func (n *Node) Err() error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.err
+}
+
+// Health returns the state of the node's connection to the Yggdrasil
+// network.
+func (n *Node) Health() (netstack.Health, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	switch {
+	case n.err != nil:
+		return netstack.HealthFailed, n.err
+	case n.netstack == nil:
+		return netstack.HealthOK, nil
+	default:
+		return n.netstack.Health()
+	}
+}
+
+// Core returns the underlying Yggdrasil core, or nil if the node has
+// not been started.
+func (n *Node) Core() *core.Core {
+	return n.core
+}
+
+// Netstack returns the userspace network stack, or nil if the node has
+// not been started.
+func (n *Node) Netstack() *netstack.YggdrasilNetstack {
+	return n.netstack
+}
+
+// Resolver returns the name resolver used by SOCKS servers.
+func (n *Node) Resolver() *types.NameResolver {
+	return n.resolver
+}
+
+func (n *Node) PublicKey() ed25519.PublicKey {
+	return n.core.PublicKey()
+}
+
+func (n *Node) Address() net.IP {
+	return n.core.Address()
+}
+
+func (n *Node) Subnet() net.IPNet {
+	return n.core.Subnet()
+}
+
+// Ping sends ICMPv6 echo requests to the address until one is answered,
+// and returns the round trip time, see netstack.YggdrasilNetstack.Ping
+func (n *Node) Ping(ctx context.Context, ip net.IP) (time.Duration, error) {
+	return n.netstack.Ping(ctx, ip)
+}
+
+func (n *Node) Dial(network, address string) (net.Conn, error) {
+	return n.netstack.Dial(network, address)
+}
+
+func (n *Node) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return n.netstack.DialContext(ctx, network, address)
+}
+
+func (n *Node) Listen(network, address string) (net.Listener, error) {
+	return n.netstack.Listen(network, address)
+}
+
+func (n *Node) ListenPacket(network, address string) (net.PacketConn, error) {
+	return n.netstack.ListenPacket(network, address)
+}
+
+func (n *Node) DialTCP(addr *net.TCPAddr) (*gonet.TCPConn, error) {
+	return n.netstack.DialTCP(addr)
+}
+
+func (n *Node) DialTCPWithBind(ctx context.Context, laddr, raddr *net.TCPAddr) (*gonet.TCPConn, error) {
+	return n.netstack.DialTCPWithBind(ctx, laddr, raddr)
+}
+
+func (n *Node) DialUDP(addr *net.UDPAddr) (*gonet.UDPConn, error) {
+	return n.netstack.DialUDP(addr)
+}
+
+func (n *Node) DialUDPWithBind(laddr, raddr *net.UDPAddr) (*gonet.UDPConn, error) {
+	return n.netstack.DialUDPWithBind(laddr, raddr)
+}
+
+func (n *Node) ListenTCP(addr *net.TCPAddr) (net.Listener, error) {
+	return n.netstack.ListenTCP(addr)
+}
+
+func (n *Node) ListenUDP(addr *net.UDPAddr) (*gonet.UDPConn, error) {
+	return n.netstack.ListenUDP(addr)
+}
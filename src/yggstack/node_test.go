@@ -0,0 +1,108 @@
+package yggstack
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/gologme/log"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/config"
+
+	"github.com/yggdrasil-network/yggstack/src/netstack"
+)
+
+func newTestNode(t *testing.T, opts ...SetupOption) *Node {
+	cfg := config.GenerateConfig()
+	cfg.AdminListen = "none"
+	cfg.MulticastInterfaces = nil
+	n, err := New(cfg, log.New(io.Discard, "", 0), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestNodeLifecycle(t *testing.T) {
+	n := newTestNode(t)
+	if err := n.AddSOCKSServer("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Start(context.Background()); err == nil {
+		t.Fatal("node should not start twice")
+	}
+	if !n.Address().Equal(n.Core().Address()) {
+		t.Fatal("node address should match the core address")
+	}
+	if err := n.AddSOCKSServer("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	n.Stop()
+	n.Stop()
+	if err := n.AddSOCKSServer("127.0.0.1:0"); err == nil {
+		t.Fatal("stopped node should not accept new SOCKS servers")
+	}
+}
+
+func TestNodeStopsWithContext(t *testing.T) {
+	n := newTestNode(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := n.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	n.Stop()
+	if err := n.AddSOCKSServer("127.0.0.1:0"); err == nil {
+		t.Fatal("stopped node should not accept new SOCKS servers")
+	}
+}
+
+func TestNodeHealth(t *testing.T) {
+	n := newTestNode(t)
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if health, err := n.Health(); health != netstack.HealthOK || err != nil {
+		t.Fatalf("expected a healthy node, got %s: %v", health, err)
+	}
+	select {
+	case <-n.Done():
+		t.Fatal("running node should not be done")
+	default:
+	}
+	n.Stop()
+	select {
+	case <-n.Done():
+	default:
+		t.Fatal("stopped node should be done")
+	}
+	if err := n.Err(); err != nil {
+		t.Fatalf("deliberately stopped node should not have an error: %s", err)
+	}
+}
+
+func TestPublicKeyForAddress(t *testing.T) {
+	n := newTestNode(t)
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+	if key := n.publicKeyForAddress(n.Address()); !key.Equal(n.core.PublicKey()) {
+		t.Fatalf("expected the node's key for its address, got %x", key)
+	}
+	// Hosts on the subnet are routed through the node, but aren't the node
+	subnet := n.Netstack().Subnet()
+	host := make(net.IP, net.IPv6len)
+	copy(host, subnet.IP)
+	host[15] = 1
+	if key := n.publicKeyForAddress(host); key != nil {
+		t.Fatalf("subnet address should not have the node's key, got %x", key)
+	}
+	if key := n.publicKeyForRoute(host); !key.Equal(n.core.PublicKey()) {
+		t.Fatalf("subnet address should be routed through the node, got %x", key)
+	}
+}
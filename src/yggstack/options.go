@@ -0,0 +1,147 @@
+package yggstack
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yggdrasil-network/yggstack/src/netstack"
+	"github.com/yggdrasil-network/yggstack/src/types"
+)
+
+func (n *Node) _applyOption(opt SetupOption) {
+	switch v := opt.(type) {
+	case Nameserver:
+		n.config.nameserver = string(v)
+	case TCP:
+		options := netstack.TCPOptions(v)
+		n.config.tcp = &options
+	case UDPSessions:
+		n.config.udp = types.UDPSessionOptions(v)
+	case ProxyIdleTimeout:
+		n.config.proxyIdleTimeout = time.Duration(v)
+	case MappingPolicy:
+		n.config.mappingPolicy = v
+	case Limits:
+		n.config.limits = types.Limits(v)
+	case SOCKSUsers:
+		n.config.socksUsers = v
+	case HealthChecks:
+		n.config.health = types.HealthOptions(v)
+	case CaptureDirectory:
+		n.config.captureDir = string(v)
+	}
+}
+
+type SetupOption interface {
+	isSetupOption()
+}
+
+// Nameserver is the Yggdrasil address of the DNS server used to
+// resolve names other than .pk.ygg, optionally with a port
+type Nameserver string
+
+func (a Nameserver) isSetupOption() {}
+
+// TCP tunes the TCP implementation of the netstack, starting from
+// netstack.DefaultTCPOptions
+type TCP netstack.TCPOptions
+
+func (a TCP) isSetupOption() {}
+
+// UDPSessions limits the sessions of each UDP mapping
+type UDPSessions types.UDPSessionOptions
+
+func (a UDPSessions) isSetupOption() {}
+
+// ProxyIdleTimeout closes proxied TCP connections of the mappings after
+// no data in either direction for this long
+type ProxyIdleTimeout time.Duration
+
+func (a ProxyIdleTimeout) isSetupOption() {}
+
+// Limits limits the bandwidth and the number of connections of the
+// proxied TCP connections of mappings and the SOCKS server
+type Limits types.Limits
+
+func (a Limits) isSetupOption() {}
+
+// SOCKSUsers are the names and passwords of the users allowed to use the
+// SOCKS server. Without any, no authentication is required. Users can be
+// added as a flag in the form name:password.
+type SOCKSUsers map[string]string
+
+func (a SOCKSUsers) isSetupOption() {}
+
+func (a SOCKSUsers) String() string {
+	users := make([]string, 0, len(a))
+	for user := range a {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return strings.Join(users, ",")
+}
+
+func (a SOCKSUsers) Set(value string) error {
+	user, password, found := strings.Cut(value, ":")
+	if !found || user == "" {
+		return fmt.Errorf("SOCKS user must be name:password")
+	}
+	a[user] = password
+	return nil
+}
+
+// ReadFile adds the users of a file with one name:password per line,
+// so that the passwords don't show up in the command line of the process.
+// Blank lines and lines starting with # are skipped.
+func (a SOCKSUsers) ReadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := a.Set(line); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+	}
+	return nil
+}
+
+// HealthChecks configures how TCP mappings with several targets find the
+// ones which are down
+type HealthChecks types.HealthOptions
+
+func (a HealthChecks) isSetupOption() {}
+
+// CaptureDirectory is where captures started over the admin socket are
+// written. Without it, the admin socket can't start captures.
+type CaptureDirectory string
+
+func (a CaptureDirectory) isSetupOption() {}
+
+// MappingPolicy decides what happens when a mapping can't be started
+// with the node
+type MappingPolicy string
+
+const (
+	MappingPolicyFatal MappingPolicy = "fatal" // The node fails to start
+	MappingPolicyRetry MappingPolicy = "retry" // The mapping is retried in the background
+)
+
+func (a MappingPolicy) isSetupOption() {}
+
+// ParseMappingPolicy parses a startup policy for mappings
+func ParseMappingPolicy(policy string) (MappingPolicy, error) {
+	switch p := MappingPolicy(policy); p {
+	case MappingPolicyFatal, MappingPolicyRetry:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown mapping policy %q, expected %q or %q", policy, MappingPolicyFatal, MappingPolicyRetry)
+	}
+}
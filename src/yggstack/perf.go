@@ -0,0 +1,737 @@
+package yggstack
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yggdrasil-network/yggstack/src/netstack"
+)
+
+// DefaultPerfPort is the Yggdrasil port of perf servers, for TCP and UDP
+const DefaultPerfPort = 5201
+
+const (
+	perfMaxStreams   = 128
+	perfMaxDuration  = time.Hour
+	perfTCPLength    = 128 * 1024
+	perfUDPLength    = 1232 // Fits into the minimum IPv6 MTU
+	perfUDPHeader    = 28   // Cookie, stream, sequence number and send time
+	perfUDPBitrate   = 1000 * 1000
+	perfUDPQuiet     = 250 * time.Millisecond
+	perfPings        = 3
+	perfPingTimeout  = 10 * time.Second
+	perfHandshake    = 10 * time.Second
+	perfFinishWindow = 10 * time.Second // For the streams to end after the test
+)
+
+// PerfOptions configures a throughput test
+type PerfOptions struct {
+	UDP      bool
+	Streams  int           // Parallel connections, or UDP sockets, defaults to 1
+	Duration time.Duration // Defaults to 10 seconds
+	Interval time.Duration // Between reports during the test, defaults to 1 second
+	Length   int           // Size of writes, or of datagrams
+	Bitrate  uint64        // Over all UDP streams, in bits per second, defaults to 1 Mbit/s
+}
+
+// PerfRetransmits are TCP counters of the netstack over a test. They
+// cover all connections of the node, not only those of the test.
+type PerfRetransmits struct {
+	Retransmits          uint64 `json:"retransmits"`
+	FastRetransmits      uint64 `json:"fast_retransmits"`
+	SlowStartRetransmits uint64 `json:"slow_start_retransmits"`
+	SACKRecoveries       uint64 `json:"sack_recoveries"`
+	Timeouts             uint64 `json:"timeouts"`
+}
+
+func perfRetransmits(stats netstack.TCPStats) PerfRetransmits {
+	return PerfRetransmits{
+		Retransmits:          stats.Retransmits,
+		FastRetransmits:      stats.FastRetransmits,
+		SlowStartRetransmits: stats.SlowStartRetransmits,
+		SACKRecoveries:       stats.SACKRecoveries,
+		Timeouts:             stats.Timeouts,
+	}
+}
+
+func (r PerfRetransmits) since(before PerfRetransmits) PerfRetransmits {
+	return PerfRetransmits{
+		Retransmits:          r.Retransmits - before.Retransmits,
+		FastRetransmits:      r.FastRetransmits - before.FastRetransmits,
+		SlowStartRetransmits: r.SlowStartRetransmits - before.SlowStartRetransmits,
+		SACKRecoveries:       r.SACKRecoveries - before.SACKRecoveries,
+		Timeouts:             r.Timeouts - before.Timeouts,
+	}
+}
+
+// PerfInterval is what the client sent during an interval of a test
+type PerfInterval struct {
+	Start         float64         `json:"start"`
+	End           float64         `json:"end"`
+	Bytes         uint64          `json:"bytes"`
+	Packets       uint64          `json:"packets,omitempty"`
+	BitsPerSecond float64         `json:"bits_per_second"`
+	Retransmits   PerfRetransmits `json:"retransmits"`
+}
+
+// PerfStream is the outcome of a stream of a test. The sent counters
+// are filled in by the client, the received ones by the server.
+type PerfStream struct {
+	Stream          int     `json:"stream"`
+	BytesSent       uint64  `json:"bytes_sent,omitempty"`
+	BytesReceived   uint64  `json:"bytes_received"`
+	PacketsSent     uint64  `json:"packets_sent,omitempty"`
+	PacketsReceived uint64  `json:"packets_received,omitempty"`
+	PacketsLost     uint64  `json:"packets_lost,omitempty"`
+	OutOfOrder      uint64  `json:"out_of_order,omitempty"`
+	JitterMs        float64 `json:"jitter_ms,omitempty"`
+	BitsPerSecond   float64 `json:"bits_per_second"`
+}
+
+// PerfReport is the server's side of a test
+type PerfReport struct {
+	Protocol    string          `json:"protocol"`
+	Seconds     float64         `json:"seconds"`
+	Streams     []PerfStream    `json:"streams"`
+	Retransmits PerfRetransmits `json:"retransmits"`
+}
+
+// PerfResult is the outcome of a test, as seen by the client
+type PerfResult struct {
+	Address           string          `json:"address"`
+	Protocol          string          `json:"protocol"`
+	LatencyMs         float64         `json:"latency_ms"`
+	Seconds           float64         `json:"seconds"`
+	Intervals         []PerfInterval  `json:"intervals"`
+	Streams           []PerfStream    `json:"streams"`
+	Sum               PerfStream      `json:"sum"` // Stream is 0
+	Retransmits       PerfRetransmits `json:"retransmits"`
+	ServerRetransmits PerfRetransmits `json:"server_retransmits"`
+}
+
+func perfProtocol(udp bool) string {
+	if udp {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// The control connection starts with a hello which carries the test, and
+// the TCP streams with one which names their stream. The client then
+// says when it is done sending, and the server replies with its report.
+type perfHello struct {
+	Cookie string    `json:"cookie"`
+	Stream int       `json:"stream"`
+	Test   *perfTest `json:"test,omitempty"`
+}
+
+type perfTest struct {
+	UDP      bool          `json:"udp"`
+	Streams  int           `json:"streams"`
+	Duration time.Duration `json:"duration"`
+}
+
+type perfReply struct {
+	Error  string      `json:"error,omitempty"`
+	Report *PerfReport `json:"report,omitempty"`
+}
+
+type perfDone struct{}
+
+func writePerfMessage(c net.Conn, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(append(b, '\n'))
+	return err
+}
+
+func readPerfMessage(r *bufio.Reader, v interface{}) error {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(line, v)
+}
+
+// PerfServerOptions configures the perf server
+type PerfServerOptions struct {
+	Listen  int                                 // Yggdrasil port, for both TCP and UDP
+	Results func(remote net.Addr, r PerfReport) // Called after each test, if set
+}
+
+// perfServer keeps the tests in progress, by their cookies
+type perfServer struct {
+	node    *Node
+	options PerfServerOptions
+	mutex   sync.Mutex
+	tests   map[string]*perfSession
+}
+
+// perfSession is a test in progress on the server
+type perfSession struct {
+	test     perfTest
+	mutex    sync.Mutex
+	streams  []PerfStream
+	conns    []bool          // Whether a TCP stream is connected
+	next     []uint64        // Expected sequence numbers of datagrams
+	transit  []time.Duration // Of the last datagrams, for the jitter
+	jitter   []time.Duration
+	finished chan struct{} // Receives when a TCP stream ends
+}
+
+// AddPerfServer answers throughput tests of yggstack perf clients over
+// the netstack, on a TCP and UDP port.
+func (n *Node) AddPerfServer(options PerfServerOptions) error {
+	if options.Listen <= 0 || options.Listen > 65535 {
+		return fmt.Errorf("invalid perf port %d", options.Listen)
+	}
+	s := &perfServer{node: n, options: options, tests: map[string]*perfSession{}}
+	return n.whenStarted(func() error {
+		listener, err := n.netstack.ListenTCP(&net.TCPAddr{Port: options.Listen})
+		if err != nil {
+			return fmt.Errorf("n.netstack.ListenTCP: %w", err)
+		}
+		n.closers = append(n.closers, listener)
+		conn, err := n.netstack.ListenUDP(&net.UDPAddr{Port: options.Listen})
+		if err != nil {
+			return fmt.Errorf("n.netstack.ListenUDP: %w", err)
+		}
+		n.closers = append(n.closers, conn)
+		n.logger.Infof("Serving perf tests on Yggdrasil TCP and UDP port %d", options.Listen)
+		go func(listener net.Listener) {
+			for {
+				c, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go s.handle(c)
+			}
+		}(&trackingListener{listener, &n.sessions})
+		go s.serveUDP(conn)
+		return nil
+	})
+}
+
+func (s *perfServer) handle(c net.Conn) {
+	defer c.Close()
+	_ = c.SetReadDeadline(time.Now().Add(perfHandshake))
+	r := bufio.NewReader(c)
+	var hello perfHello
+	if err := readPerfMessage(r, &hello); err != nil {
+		s.node.logger.Debugf("Perf connection from %s failed: %s", c.RemoteAddr(), err)
+		return
+	}
+	_ = c.SetReadDeadline(time.Time{})
+	if hello.Test != nil {
+		s.control(c, r, hello)
+		return
+	}
+	s.mutex.Lock()
+	t := s.tests[hello.Cookie]
+	s.mutex.Unlock()
+	if t == nil || t.test.UDP || hello.Stream < 0 || hello.Stream >= t.test.Streams || !t.connect(hello.Stream) {
+		return
+	}
+	t.receive(r, hello.Stream)
+}
+
+// connect claims a TCP stream for a connection, and reports false if
+// another one already has it
+func (t *perfSession) connect(stream int) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.conns[stream] {
+		return false
+	}
+	t.conns[stream] = true
+	return true
+}
+
+func newPerfSession(test perfTest) *perfSession {
+	return &perfSession{
+		test:     test,
+		streams:  make([]PerfStream, test.Streams),
+		conns:    make([]bool, test.Streams),
+		next:     make([]uint64, test.Streams),
+		transit:  make([]time.Duration, test.Streams),
+		jitter:   make([]time.Duration, test.Streams),
+		finished: make(chan struct{}, test.Streams),
+	}
+}
+
+// control runs a test for a client
+func (s *perfServer) control(c net.Conn, r *bufio.Reader, hello perfHello) {
+	test := *hello.Test
+	var err error
+	switch {
+	case test.Streams < 1 || test.Streams > perfMaxStreams:
+		err = fmt.Errorf("streams must be between 1 and %d", perfMaxStreams)
+	case test.Duration <= 0 || test.Duration > perfMaxDuration:
+		err = fmt.Errorf("duration must be up to %s", perfMaxDuration)
+	case hello.Cookie == "":
+		err = fmt.Errorf("no cookie")
+	}
+	var t *perfSession
+	if err == nil {
+		t = newPerfSession(test)
+		s.mutex.Lock()
+		if s.tests[hello.Cookie] != nil {
+			err = fmt.Errorf("test is already running")
+		} else {
+			s.tests[hello.Cookie] = t
+			defer func() {
+				s.mutex.Lock()
+				defer s.mutex.Unlock()
+				delete(s.tests, hello.Cookie)
+			}()
+		}
+		s.mutex.Unlock()
+	}
+	if err != nil {
+		_ = writePerfMessage(c, perfReply{Error: err.Error()})
+		return
+	}
+
+	before := perfRetransmits(s.node.netstack.TCPStats())
+	if err = writePerfMessage(c, perfReply{}); err != nil {
+		return
+	}
+	start := time.Now()
+	_ = c.SetReadDeadline(start.Add(test.Duration + perfFinishWindow))
+	var done perfDone
+	if err = readPerfMessage(r, &done); err != nil {
+		s.node.logger.Debugf("Perf test from %s failed: %s", c.RemoteAddr(), err)
+		return
+	}
+	elapsed := time.Since(start)
+	if test.UDP {
+		t.waitQuiet()
+	} else {
+		timeout := time.NewTimer(perfFinishWindow)
+		defer timeout.Stop()
+	wait:
+		for i := 0; i < test.Streams; i++ {
+			select {
+			case <-t.finished:
+			case <-timeout.C:
+				break wait
+			}
+		}
+	}
+
+	report := t.report(elapsed)
+	report.Retransmits = perfRetransmits(s.node.netstack.TCPStats()).since(before)
+	_ = c.SetWriteDeadline(time.Now().Add(perfHandshake))
+	if err = writePerfMessage(c, perfReply{Report: &report}); err != nil {
+		return
+	}
+	var received uint64
+	for _, stream := range report.Streams {
+		received += stream.BytesReceived
+	}
+	s.node.logger.Infof("Perf test from %s: %d bytes over %s in %d streams", c.RemoteAddr(), received, report.Protocol, test.Streams)
+	if s.options.Results != nil {
+		s.options.Results(c.RemoteAddr(), report)
+	}
+}
+
+// receive counts what arrives on a TCP stream until it ends
+func (t *perfSession) receive(r *bufio.Reader, stream int) {
+	defer func() {
+		select {
+		case t.finished <- struct{}{}:
+		default:
+		}
+	}()
+	buf := make([]byte, perfTCPLength)
+	for {
+		n, err := r.Read(buf)
+		t.mutex.Lock()
+		t.streams[stream].BytesReceived += uint64(n)
+		t.mutex.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// serveUDP counts the datagrams of all tests
+func (s *perfServer) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		now := time.Now()
+		if n < perfUDPHeader {
+			continue
+		}
+		s.mutex.Lock()
+		t := s.tests[hex.EncodeToString(buf[:8])]
+		s.mutex.Unlock()
+		// Compared before the conversion, which may be negative on 32 bits
+		stream := binary.BigEndian.Uint32(buf[8:12])
+		if t == nil || !t.test.UDP || stream >= uint32(t.test.Streams) {
+			continue
+		}
+		seq := binary.BigEndian.Uint64(buf[12:20])
+		sent := time.Unix(0, int64(binary.BigEndian.Uint64(buf[20:28])))
+		t.datagram(int(stream), seq, now.Sub(sent), n)
+	}
+}
+
+// datagram counts a datagram, and updates the jitter like RTP does. The
+// clocks of the nodes differ, but not the differences of transit times.
+func (t *perfSession) datagram(stream int, seq uint64, transit time.Duration, size int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	st := &t.streams[stream]
+	st.BytesReceived += uint64(size)
+	st.PacketsReceived++
+	if seq < t.next[stream] {
+		st.OutOfOrder++
+	} else {
+		t.next[stream] = seq + 1
+	}
+	if st.PacketsReceived > 1 {
+		d := transit - t.transit[stream]
+		if d < 0 {
+			d = -d
+		}
+		t.jitter[stream] += (d - t.jitter[stream]) / 16
+	}
+	t.transit[stream] = transit
+}
+
+// waitQuiet waits for datagrams still on their way after the test
+func (t *perfSession) waitQuiet() {
+	deadline := time.Now().Add(perfFinishWindow)
+	var last uint64 = 1<<64 - 1
+	for time.Now().Before(deadline) {
+		var received uint64
+		t.mutex.Lock()
+		for _, stream := range t.streams {
+			received += stream.PacketsReceived
+		}
+		t.mutex.Unlock()
+		if received == last {
+			return
+		}
+		last = received
+		time.Sleep(perfUDPQuiet)
+	}
+}
+
+func (t *perfSession) report(elapsed time.Duration) PerfReport {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	report := PerfReport{
+		Protocol: perfProtocol(t.test.UDP),
+		Seconds:  elapsed.Seconds(),
+		Streams:  make([]PerfStream, len(t.streams)),
+	}
+	for i, stream := range t.streams {
+		stream.Stream = i + 1
+		stream.BitsPerSecond = float64(stream.BytesReceived) * 8 / elapsed.Seconds()
+		if t.test.UDP {
+			if t.next[i] > stream.PacketsReceived {
+				stream.PacketsLost = t.next[i] - stream.PacketsReceived
+			}
+			stream.JitterMs = float64(t.jitter[i]) / float64(time.Millisecond)
+		}
+		report.Streams[i] = stream
+	}
+	return report
+}
+
+// Perf runs a throughput test against the perf server at the address,
+// which can be a .pk.ygg name, over the netstack. The report function, if
+// set, is called after each interval with what was sent.
+func (n *Node) Perf(ctx context.Context, address string, options PerfOptions, report func(PerfInterval)) (*PerfResult, error) {
+	if options.Streams == 0 {
+		options.Streams = 1
+	}
+	if options.Duration == 0 {
+		options.Duration = 10 * time.Second
+	}
+	if options.Interval == 0 {
+		options.Interval = time.Second
+	}
+	if options.Length == 0 {
+		options.Length = perfTCPLength
+		if options.UDP {
+			options.Length = perfUDPLength
+		}
+	}
+	if options.UDP && options.Bitrate == 0 {
+		options.Bitrate = perfUDPBitrate
+	}
+	switch {
+	case options.Streams < 1 || options.Streams > perfMaxStreams:
+		return nil, fmt.Errorf("streams must be between 1 and %d", perfMaxStreams)
+	case options.Duration < 0 || options.Duration > perfMaxDuration:
+		return nil, fmt.Errorf("duration must be up to %s", perfMaxDuration)
+	case options.Interval < 0:
+		return nil, fmt.Errorf("invalid interval %s", options.Interval)
+	case options.UDP && (options.Length < perfUDPHeader || options.Length > 65535-48):
+		return nil, fmt.Errorf("UDP length must be between %d and %d", perfUDPHeader, 65535-48)
+	case options.Length < 1:
+		return nil, fmt.Errorf("invalid length %d", options.Length)
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := n.resolver.LookupAll(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	address = net.JoinHostPort(ips[0].String(), port)
+	result := &PerfResult{
+		Address:  address,
+		Protocol: perfProtocol(options.UDP),
+	}
+	// The first ping sets up the paths to the node, which would otherwise
+	// slow down the start of the test or lose datagrams
+	pingCtx, cancel := context.WithTimeout(ctx, perfPingTimeout)
+	_, err = n.Ping(pingCtx, ips[0])
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("no reply to pings from %s: %w", ips[0], err)
+	}
+	var latency time.Duration
+	for i := 0; i < perfPings; i++ {
+		pingCtx, cancel := context.WithTimeout(ctx, perfPingTimeout)
+		rtt, err := n.Ping(pingCtx, ips[0])
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("no reply to pings from %s: %w", ips[0], err)
+		}
+		if latency == 0 || rtt < latency {
+			latency = rtt
+		}
+	}
+	result.LatencyMs = float64(latency) / float64(time.Millisecond)
+
+	cookie := make([]byte, 8)
+	if _, err = rand.Read(cookie); err != nil {
+		return nil, err
+	}
+	control, err := n.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer control.Close()
+	r := bufio.NewReader(control)
+	var reply perfReply
+	_ = control.SetDeadline(time.Now().Add(perfHandshake))
+	if err = writePerfMessage(control, perfHello{
+		Cookie: hex.EncodeToString(cookie),
+		Test: &perfTest{
+			UDP:      options.UDP,
+			Streams:  options.Streams,
+			Duration: options.Duration,
+		},
+	}); err != nil {
+		return nil, err
+	}
+	if err = readPerfMessage(r, &reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != "" {
+		return nil, fmt.Errorf("server refused the test: %s", reply.Error)
+	}
+	_ = control.SetDeadline(time.Time{})
+
+	conns := make([]net.Conn, 0, options.Streams)
+	defer func() {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	}()
+	for i := 0; i < options.Streams; i++ {
+		c, err := n.DialContext(ctx, result.Protocol, address)
+		if err != nil {
+			return nil, err
+		}
+		conns = append(conns, c)
+		if !options.UDP {
+			if err = writePerfMessage(c, perfHello{Cookie: hex.EncodeToString(cookie), Stream: i}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	before := perfRetransmits(n.netstack.TCPStats())
+	start := time.Now()
+	end := start.Add(options.Duration)
+	bytes := make([]atomic.Uint64, options.Streams)
+	packets := make([]atomic.Uint64, options.Streams)
+	var wg sync.WaitGroup
+	for i, c := range conns {
+		wg.Add(1)
+		go func(i int, c net.Conn) {
+			defer wg.Done()
+			if options.UDP {
+				perfSendUDP(c, cookie, i, options, end, &bytes[i], &packets[i])
+			} else {
+				perfSendTCP(c, options.Length, end, &bytes[i])
+			}
+		}(i, c)
+	}
+	sent := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(sent)
+	}()
+
+	ticker := time.NewTicker(options.Interval)
+	defer ticker.Stop()
+	last, lastBytes, lastPackets, lastRetransmits := start, uint64(0), uint64(0), before
+	interval := func(now time.Time) {
+		var total, totalPackets uint64
+		for i := range bytes {
+			total += bytes[i].Load()
+			totalPackets += packets[i].Load()
+		}
+		retransmits := perfRetransmits(n.netstack.TCPStats())
+		iv := PerfInterval{
+			Start:         last.Sub(start).Seconds(),
+			End:           now.Sub(start).Seconds(),
+			Bytes:         total - lastBytes,
+			Packets:       totalPackets - lastPackets,
+			BitsPerSecond: float64(total-lastBytes) * 8 / now.Sub(last).Seconds(),
+			Retransmits:   retransmits.since(lastRetransmits),
+		}
+		last, lastBytes, lastPackets, lastRetransmits = now, total, totalPackets, retransmits
+		result.Intervals = append(result.Intervals, iv)
+		if report != nil {
+			report(iv)
+		}
+	}
+running:
+	for {
+		select {
+		case <-ctx.Done():
+			for _, c := range conns {
+				_ = c.Close()
+			}
+			<-sent
+			return nil, ctx.Err()
+		case now := <-ticker.C:
+			interval(now)
+		case <-sent:
+			break running
+		}
+	}
+	elapsed := time.Since(start)
+	if now := time.Now(); now.Sub(last) > options.Interval/10 {
+		interval(now)
+	}
+
+	// Closing the TCP streams ends them once everything is delivered
+	for _, c := range conns {
+		_ = c.Close()
+	}
+	conns = nil
+	_ = control.SetDeadline(time.Now().Add(perfFinishWindow + perfHandshake))
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = control.Close()
+		case <-sent:
+		}
+	}()
+	if err = writePerfMessage(control, perfDone{}); err != nil {
+		return nil, err
+	}
+	reply = perfReply{}
+	if err = readPerfMessage(r, &reply); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if reply.Report == nil || len(reply.Report.Streams) != options.Streams {
+		return nil, fmt.Errorf("server sent no report: %s", reply.Error)
+	}
+	result.Retransmits = perfRetransmits(n.netstack.TCPStats()).since(before)
+	result.ServerRetransmits = reply.Report.Retransmits
+
+	result.Seconds = elapsed.Seconds()
+	var jitter float64
+	for i, stream := range reply.Report.Streams {
+		stream.Stream = i + 1
+		stream.BytesSent = bytes[i].Load()
+		stream.PacketsSent = packets[i].Load()
+		stream.BitsPerSecond = float64(stream.BytesReceived) * 8 / result.Seconds
+		result.Streams = append(result.Streams, stream)
+		result.Sum.BytesSent += stream.BytesSent
+		result.Sum.BytesReceived += stream.BytesReceived
+		result.Sum.PacketsSent += stream.PacketsSent
+		result.Sum.PacketsReceived += stream.PacketsReceived
+		result.Sum.PacketsLost += stream.PacketsLost
+		result.Sum.OutOfOrder += stream.OutOfOrder
+		jitter += stream.JitterMs
+	}
+	result.Sum.JitterMs = jitter / float64(options.Streams)
+	result.Sum.BitsPerSecond = float64(result.Sum.BytesReceived) * 8 / result.Seconds
+	return result, nil
+}
+
+// perfSendTCP writes as fast as the connection takes it until the end
+func perfSendTCP(c net.Conn, length int, end time.Time, bytes *atomic.Uint64) {
+	_ = c.SetWriteDeadline(end)
+	buf := make([]byte, length)
+	for time.Now().Before(end) {
+		n, err := c.Write(buf)
+		bytes.Add(uint64(n))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// perfSendUDP sends datagrams at the stream's share of the bitrate until
+// the end
+func perfSendUDP(c net.Conn, cookie []byte, stream int, options PerfOptions, end time.Time, bytes, packets *atomic.Uint64) {
+	buf := make([]byte, options.Length)
+	copy(buf, cookie)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(stream))
+	gap := time.Duration(float64(options.Length*8*options.Streams) / float64(options.Bitrate) * float64(time.Second))
+	next := time.Now()
+	for seq := uint64(0); ; seq++ {
+		if wait := time.Until(next); wait > 0 {
+			time.Sleep(wait)
+		}
+		now := time.Now()
+		if !now.Before(end) {
+			return
+		}
+		binary.BigEndian.PutUint64(buf[12:20], seq)
+		binary.BigEndian.PutUint64(buf[20:28], uint64(now.UnixNano()))
+		n, err := c.Write(buf)
+		switch {
+		case errors.Is(err, net.ErrClosed):
+			return
+		case err == nil:
+			bytes.Add(uint64(n))
+			packets.Add(1)
+		}
+		next = next.Add(gap)
+	}
+}
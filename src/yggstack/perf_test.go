@@ -0,0 +1,156 @@
+package yggstack
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPerf(t *testing.T) {
+	n := newTestNode(t)
+	reports := make(chan PerfReport, 2)
+	if err := n.AddPerfServer(PerfServerOptions{
+		Listen:  DefaultPerfPort,
+		Results: func(_ net.Addr, r PerfReport) { reports <- r },
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.Stop)
+	address := net.JoinHostPort(n.Address().String(), "5201")
+
+	intervals := 0
+	result, err := n.Perf(context.Background(), address, PerfOptions{
+		Streams:  2,
+		Duration: time.Second,
+		Interval: 250 * time.Millisecond,
+	}, func(PerfInterval) { intervals++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if intervals < 3 || intervals != len(result.Intervals) {
+		t.Fatalf("expected reports of the intervals, got %d of %d", intervals, len(result.Intervals))
+	}
+	if len(result.Streams) != 2 || result.Sum.BytesReceived == 0 || result.Sum.BytesReceived != result.Sum.BytesSent {
+		t.Fatalf("everything sent should be received: %+v", result.Sum)
+	}
+	if r := <-reports; r.Protocol != "tcp" || len(r.Streams) != 2 || r.Streams[0].BitsPerSecond == 0 {
+		t.Fatalf("unexpected server report %+v", r)
+	}
+
+	result, err = n.Perf(context.Background(), address, PerfOptions{
+		UDP:      true,
+		Streams:  2,
+		Duration: time.Second,
+		Bitrate:  8e6,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := result.Sum
+	if sum.PacketsReceived == 0 || sum.PacketsReceived+sum.PacketsLost != sum.PacketsSent {
+		t.Fatalf("datagrams should be received or lost: %+v", sum)
+	}
+	// 8 Mbit/s is 1 MB/s. The pacing never sends more than that plus the
+	// first datagram of each stream over the time the test took, but a
+	// busy machine may fall behind.
+	limit := 1e6*result.Seconds + 2*perfUDPLength
+	if sent := float64(sum.BytesSent); sent > limit || sent < limit/4 {
+		t.Fatalf("datagrams should be sent at the bitrate over %.2f s: %+v", result.Seconds, sum)
+	}
+	if r := <-reports; r.Protocol != "udp" {
+		t.Fatalf("unexpected server report %+v", r)
+	}
+
+	if _, err = n.Perf(context.Background(), address, PerfOptions{Streams: perfMaxStreams + 1}, nil); err == nil {
+		t.Fatal("too many streams should be refused")
+	}
+}
+
+func TestPerfServerStreams(t *testing.T) {
+	s := &perfServer{node: newTestNode(t), tests: map[string]*perfSession{}}
+	cookie := make([]byte, 8)
+	session := newPerfSession(perfTest{Streams: 1})
+	s.tests[hex.EncodeToString(cookie)] = session
+
+	t.Run("TCP", func(t *testing.T) {
+		// A second connection for the same stream is refused
+		connect := func() net.Conn {
+			client, server := net.Pipe()
+			t.Cleanup(func() { _ = client.Close() })
+			go s.handle(server)
+			if err := writePerfMessage(client, perfHello{Cookie: hex.EncodeToString(cookie), Stream: 0}); err != nil {
+				t.Fatal(err)
+			}
+			return client
+		}
+		first := connect()
+		claimed := func() bool {
+			session.mutex.Lock()
+			defer session.mutex.Unlock()
+			return session.conns[0]
+		}
+		for deadline := time.Now().Add(5 * time.Second); !claimed(); {
+			if time.Now().After(deadline) {
+				t.Fatal("first connection did not claim its stream")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		second := connect()
+		_ = second.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("second connection for the stream should be closed, got %v", err)
+		}
+		_ = first.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := first.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("first connection for the stream should stay open, got %v", err)
+		}
+	})
+
+	t.Run("UDP", func(t *testing.T) {
+		session.test.UDP = true
+		server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		go s.serveUDP(server)
+		client, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		// Stream indexes beyond the test are ignored, even those which
+		// are negative as an int on 32 bits
+		for _, stream := range []uint32{0x80000000, 1, 0} {
+			datagram := make([]byte, perfUDPHeader)
+			copy(datagram, cookie)
+			binary.BigEndian.PutUint32(datagram[8:12], stream)
+			binary.BigEndian.PutUint64(datagram[20:28], uint64(time.Now().UnixNano()))
+			if _, err = client.Write(datagram); err != nil {
+				t.Fatal(err)
+			}
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			session.mutex.Lock()
+			received := session.streams[0].PacketsReceived
+			session.mutex.Unlock()
+			if received == 1 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("datagram of the stream was not counted")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package yggstack
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// AddRouterLink routes the node's subnet to a network segment, which
+// exchanges raw IPv6 packets with yggstack over a datagram socket. The
+// listen address is either a UDP address, i.e. [::]:9999, or fd:<n> for
+// an inherited datagram socket, i.e. one end of a socketpair. Packets
+// are exchanged with the peer if given, or with the sender of the first
+// packet.
+func (n *Node) AddRouterLink(listen, peer string) error {
+	return n.whenStarted(func() error {
+		var conn net.PacketConn
+		var err error
+		if fd, ok := strings.CutPrefix(listen, "fd:"); ok {
+			var fdnum uint64
+			if fdnum, err = strconv.ParseUint(fd, 10, 0); err != nil {
+				return fmt.Errorf("invalid file descriptor %q", fd)
+			}
+			file := os.NewFile(uintptr(fdnum), "router-link")
+			conn, err = net.FilePacketConn(file)
+			_ = file.Close()
+			if err != nil {
+				return fmt.Errorf("net.FilePacketConn: %w", err)
+			}
+		} else if conn, err = net.ListenPacket("udp", listen); err != nil {
+			return fmt.Errorf("net.ListenPacket: %w", err)
+		}
+		var peerAddr net.Addr
+		if peer != "" {
+			if peerAddr, err = net.ResolveUDPAddr("udp", peer); err != nil {
+				_ = conn.Close()
+				return fmt.Errorf("net.ResolveUDPAddr: %w", err)
+			}
+		}
+		subnet := n.core.Subnet()
+		link, err := n.netstack.AddPacketLink(conn, peerAddr, subnet)
+		if err != nil {
+			_ = conn.Close()
+			return fmt.Errorf("n.netstack.AddPacketLink: %w", err)
+		}
+		n.closers = append(n.closers, link)
+		n.logger.Infof("Routing subnet %s to the link on %s", subnet.String(), conn.LocalAddr())
+		return nil
+	})
+}
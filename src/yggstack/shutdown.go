@@ -0,0 +1,246 @@
+package yggstack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/yggdrasil-network/yggstack/src/types"
+)
+
+// sessionTracker keeps the connections of proxied sessions, so that a
+// shutdown can wait for them to finish and close whatever remains
+type sessionTracker struct {
+	mutex    sync.Mutex
+	draining bool
+	conns    map[io.Closer]bool // Whether shutdown waits for the connection
+	waiting  int                // Connections which shutdown waits for
+	drained  chan struct{}      // Closed once none are left while draining
+}
+
+// add registers a connection. Shutdown waits for it to be removed if
+// wait is set, and closes it otherwise. A connection added while the
+// node is shutting down is closed right away and false is returned.
+func (t *sessionTracker) add(c io.Closer, wait bool) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.draining {
+		_ = c.Close()
+		return false
+	}
+	if t.conns == nil {
+		t.conns = make(map[io.Closer]bool)
+	}
+	t.conns[c] = wait
+	if wait {
+		t.waiting++
+	}
+	return true
+}
+
+// remove unregisters a connection once its session has finished.
+func (t *sessionTracker) remove(c io.Closer) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	wait, ok := t.conns[c]
+	if !ok {
+		return
+	}
+	delete(t.conns, c)
+	if wait {
+		if t.waiting--; t.waiting == 0 && t.drained != nil {
+			close(t.drained)
+			t.drained = nil
+		}
+	}
+}
+
+// drain refuses new connections from now on and returns a channel which
+// is closed once the connections which shutdown waits for are removed.
+func (t *sessionTracker) drain() <-chan struct{} {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.draining = true
+	drained := make(chan struct{})
+	if t.waiting == 0 {
+		close(drained)
+	} else {
+		t.drained = drained
+	}
+	return drained
+}
+
+// isDraining reports whether the node is shutting down
+func (t *sessionTracker) isDraining() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.draining
+}
+
+// closeAll closes the remaining connections and returns how many of
+// them shutdown was waiting for.
+func (t *sessionTracker) closeAll() int {
+	t.mutex.Lock()
+	t.draining = true
+	conns, waiting := t.conns, t.waiting
+	t.conns, t.waiting = nil, 0
+	t.mutex.Unlock()
+	for c := range conns {
+		_ = c.Close()
+	}
+	return waiting
+}
+
+// trackingListener registers accepted connections with the node, for
+// servers which handle their connections themselves, i.e. SOCKS
+type trackingListener struct {
+	net.Listener
+	sessions *sessionTracker
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.sessions.add(c, true) {
+			return &trackedConn{Conn: c, sessions: l.sessions}, nil
+		}
+	}
+}
+
+type trackedConn struct {
+	net.Conn
+	sessions *sessionTracker
+}
+
+func (c *trackedConn) Close() error {
+	c.sessions.remove(c.Conn)
+	return c.Conn.Close()
+}
+
+// gracefulCloser is a server which can finish its connections itself,
+// i.e. http.Server
+type gracefulCloser interface {
+	io.Closer
+	Shutdown(ctx context.Context) error
+}
+
+// proxyTCP proxies between the connections until either side closes,
+// and lets shutdown wait for the session to finish. The connection is
+// subject to the global limit and the given ones, and refused if it is
+// beyond any of their connection limits.
+func (n *Node) proxyTCP(c1, c2 net.Conn, scoped ...*types.Limiter) {
+	limiters := n.limiters(scoped...)
+	if !n.admit(fmt.Sprintf("connection from %s to %s", c1.RemoteAddr(), c2.RemoteAddr()), limiters) {
+		_ = c1.Close()
+		_ = c2.Close()
+		return
+	}
+	defer limiters.Release()
+	if !n.sessions.add(c1, true) {
+		_ = c2.Close()
+		return
+	}
+	defer n.sessions.remove(c1)
+	// Closing one side is enough for shutdown to end the session, but
+	// both have to be closed if it finishes in between
+	if !n.sessions.add(c2, false) {
+		_ = c1.Close()
+		return
+	}
+	defer n.sessions.remove(c2)
+	_ = types.ProxyTCPWithOptions(n.core.MTU(), c1, c2, types.ProxyOptions{
+		IdleTimeout: n.config.proxyIdleTimeout,
+		Limiters:    limiters,
+	})
+}
+
+// Shutdown stops the node gracefully. It stops accepting connections on
+// all listeners and waits for the proxied sessions to finish until the
+// context is done. UDP mappings keep forwarding for their existing
+// sessions, which are waited for until they are idle, but start no new
+// ones. Then it stops the node as Stop does. An error is returned if
+// TCP or UDP sessions had to be cut off.
+func (n *Node) Shutdown(ctx context.Context) error {
+	n.mutex.Lock()
+	if n.cancel == nil {
+		n.mutex.Unlock()
+		return nil
+	}
+	drained := n.sessions.drain()
+	var udpSessions []*types.UDPSessionManager
+	var udpDrained []<-chan struct{}
+	var servers sync.WaitGroup
+	closers := n.closers[:0]
+	for _, c := range n.closers {
+		switch c := c.(type) {
+		case gracefulCloser:
+			closers = append(closers, c)
+			servers.Add(1)
+			go func() {
+				defer servers.Done()
+				_ = c.Shutdown(ctx)
+			}()
+		case net.Listener:
+			_ = c.Close()
+		case *supervisedMapping:
+			if c.packet {
+				closers = append(closers, c)
+				if sessions := c.udp.Load(); sessions != nil {
+					udpSessions = append(udpSessions, sessions)
+					udpDrained = append(udpDrained, sessions.Drain())
+				}
+			} else {
+				_ = c.Close()
+			}
+		default:
+			closers = append(closers, c)
+		}
+	}
+	n.closers = closers
+	n.mutex.Unlock()
+
+	n.logger.Infof("Waiting for open connections to finish")
+	serversDone := make(chan struct{})
+	go func() {
+		servers.Wait()
+		close(serversDone)
+	}()
+	// Closing the session managers in the end closes these as well
+	udpDone := make(chan struct{})
+	go func() {
+		for _, c := range udpDrained {
+			<-c
+		}
+		close(udpDone)
+	}()
+	for _, done := range []<-chan struct{}{drained, serversDone, udpDone} {
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	cut := n.sessions.closeAll()
+	udpCut := 0
+	for _, sessions := range udpSessions {
+		udpCut += sessions.Stats().Active
+	}
+	n._stop()
+	if cut > 0 || udpCut > 0 {
+		return fmt.Errorf("closed %d connections and %d UDP sessions which were still open after the drain timeout", cut, udpCut)
+	}
+	return nil
+}
+
+// stopping reports whether the node is shutting down, so that listener
+// errors are expected
+func (n *Node) stopping() bool {
+	return n.ctx.Err() != nil || n.sessions.isDraining()
+}
@@ -0,0 +1,205 @@
+package yggstack
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yggdrasil-network/yggstack/src/types"
+)
+
+// startEchoMapping starts a node exposing a local echo server on
+// Yggdrasil port 7, and returns a connection to it through the netstack
+func startEchoMapping(t *testing.T, opts ...SetupOption) (*Node, net.Conn) {
+	echo, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = echo.Close() })
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(c, c)
+				_ = c.Close()
+			}()
+		}
+	}()
+
+	n := newTestNode(t, opts...)
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.Stop)
+	if err := n.AddRemoteTCPMapping(types.TCPMapping{
+		Listen: &net.TCPAddr{Port: 7},
+		Mapped: echo.Addr().(*net.TCPAddr),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := n.Netstack().DialTCP(&net.TCPAddr{IP: n.Address(), Port: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	assertEcho(t, conn)
+	return n, conn
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("unexpected echo %q", buf)
+	}
+}
+
+func TestNodeShutdownDrains(t *testing.T) {
+	n, conn := startEchoMapping(t)
+	result := make(chan error, 1)
+	go func() {
+		result <- n.Shutdown(context.Background())
+	}()
+
+	// The listener stops accepting, but the open session keeps working
+	// until the client closes it
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := n.Netstack().DialTCP(&net.TCPAddr{IP: n.Address(), Port: 7})
+		if err != nil {
+			break
+		}
+		_ = c.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("mapping still accepts connections while shutting down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertEcho(t, conn)
+	select {
+	case err := <-result:
+		t.Fatalf("shutdown finished with a session open: %v", err)
+	default:
+	}
+
+	_ = conn.Close()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish once the session was closed")
+	}
+	select {
+	case <-n.Done():
+	default:
+		t.Fatal("node should be stopped after shutdown")
+	}
+}
+
+func TestNodeShutdownTimeout(t *testing.T) {
+	n, conn := startEchoMapping(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := n.Shutdown(ctx); err == nil {
+		t.Fatal("shutdown should report the session it cut off")
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("session should be closed after the drain timeout")
+	}
+}
+
+// startUDPEchoMapping starts a node exposing a local UDP echo server on
+// Yggdrasil port 7, and returns a session to it through the netstack
+func startUDPEchoMapping(t *testing.T, opts ...SetupOption) (*Node, net.Conn) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = echo.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	n := newTestNode(t, opts...)
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.Stop)
+	if err := n.AddRemoteUDPMapping(types.UDPMapping{
+		Listen: &net.UDPAddr{Port: 7},
+		Mapped: echo.LocalAddr().(*net.UDPAddr),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	conn := dialUDPEcho(t, n)
+	assertEcho(t, conn)
+	return n, conn
+}
+
+func dialUDPEcho(t *testing.T, n *Node) net.Conn {
+	conn, err := n.Netstack().DialUDP(&net.UDPAddr{IP: n.Address(), Port: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestNodeShutdownDrainsUDP(t *testing.T) {
+	n, conn := startUDPEchoMapping(t, UDPSessions{IdleTimeout: 500 * time.Millisecond})
+	result := make(chan error, 1)
+	go func() {
+		result <- n.Shutdown(context.Background())
+	}()
+
+	// The open session keeps working, but new clients get none
+	assertEcho(t, conn)
+	other := dialUDPEcho(t, n)
+	_, _ = other.Write([]byte("ping"))
+	_ = other.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := other.Read(make([]byte, 4)); err == nil {
+		t.Fatal("new UDP session started while shutting down")
+	}
+
+	// Shutdown finishes once the session is idle
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish once the UDP session was idle")
+	}
+}
+
+func TestNodeShutdownUDPTimeout(t *testing.T) {
+	n, _ := startUDPEchoMapping(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := n.Shutdown(ctx); err == nil || !strings.Contains(err.Error(), "1 UDP sessions") {
+		t.Fatalf("shutdown should report the UDP session it cut off, got %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package yggstack
+
+import (
+	"net"
+	"time"
+
+	"github.com/yggdrasil-network/yggstack/src/types"
+)
+
+// sniRoute is a route of a remote mapping for a TLS server name, with a
+// balancer of its own for the health of its target
+type sniRoute struct {
+	serverName string
+	balancer   *types.Balancer
+}
+
+// routeServerName peeks at the TLS ClientHello of a connection, and
+// returns the connection to pass on along with the balancer of the first
+// route matching the server name, or the fallback if none does
+func (n *Node) routeServerName(c net.Conn, routes []sniRoute, fallback *types.Balancer) (net.Conn, *types.Balancer) {
+	_ = c.SetReadDeadline(time.Now().Add(tlsHandshakeTimeout))
+	serverName, c, err := types.PeekServerName(c)
+	_ = c.SetReadDeadline(time.Time{})
+	if err != nil {
+		n.logger.Debugf("No TLS server name from %s, using the default target: %s", c.RemoteAddr(), err)
+		return c, fallback
+	}
+	for _, route := range routes {
+		if types.MatchServerName(route.serverName, serverName) {
+			return c, route.balancer
+		}
+	}
+	return c, fallback
+}
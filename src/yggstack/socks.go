@@ -0,0 +1,105 @@
+package yggstack
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/things-go/go-socks5"
+)
+
+type unixListener struct {
+	net.Listener
+	path string
+}
+
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	_ = os.RemoveAll(l.path)
+	return err
+}
+
+// AddSOCKSServer starts a SOCKS server which dials through the
+// netstack. The address is either a TCP address, i.e. :1080, or a UNIX
+// socket file path, i.e. /tmp/yggstack.sock.
+func (n *Node) AddSOCKSServer(address string) error {
+	return n.whenStarted(func() error {
+		return n.startSOCKSServer(address)
+	})
+}
+
+func (n *Node) startSOCKSServer(address string) error {
+	if n.config.nameserver == "" {
+		n.logger.Infof("DNS nameserver is not set!")
+		n.logger.Infof("SOCKS server will not be able to resolve hostnames other than .pk.ygg !")
+	}
+	socksOptions := []socks5.Option{
+		socks5.WithDialAndRequest(n.dialSOCKS),
+		socks5.WithResolver(n.resolver),
+	}
+	if len(n.config.socksUsers) > 0 {
+		socksOptions = append(socksOptions, socks5.WithCredential(socks5.StaticCredentials(n.config.socksUsers)))
+	}
+	if n.logger.GetLevel("debug") {
+		socksOptions = append(socksOptions, socks5.WithLogger(n.logger))
+	}
+	server := socks5.NewServer(socksOptions...)
+	var listener net.Listener
+	var err error
+	if strings.Contains(address, ":") {
+		n.logger.Infof("Starting SOCKS server on %s", address)
+		if listener, err = net.Listen("tcp", address); err != nil {
+			return fmt.Errorf("net.Listen: %w", err)
+		}
+	} else {
+		n.logger.Infof("Starting SOCKS server with socket file %s", address)
+		listener, err = net.Listen("unix", address)
+		if err != nil {
+			// If address in use, try connecting to
+			// the socket to see if other yggstack
+			// instance is listening on it
+			if !isErrorAddressAlreadyInUse(err) {
+				return fmt.Errorf("net.Listen: %w", err)
+			}
+			if _, err = net.Dial("unix", address); err == nil {
+				return fmt.Errorf("Another yggstack instance is listening on socket '%s'", address)
+			}
+			// Unlink dead socket if not connected
+			if err = os.RemoveAll(address); err != nil {
+				return fmt.Errorf("os.RemoveAll: %w", err)
+			}
+			if listener, err = net.Listen("unix", address); err != nil {
+				return fmt.Errorf("net.Listen: %w", err)
+			}
+		}
+		listener = &unixListener{listener, address}
+	}
+	n.closers = append(n.closers, listener)
+	go server.Serve(&trackingListener{listener, &n.sessions}) // nolint:errcheck
+	return nil
+}
+
+// Helper to detect if socket address is in use
+// https://stackoverflow.com/a/52152912
+func isErrorAddressAlreadyInUse(err error) bool {
+	var eOsSyscall *os.SyscallError
+	if !errors.As(err, &eOsSyscall) {
+		return false
+	}
+	var errErrno syscall.Errno // doesn't need a "*" (ptr) because it's already a ptr (uintptr)
+	if !errors.As(eOsSyscall, &errErrno) {
+		return false
+	}
+	if errors.Is(errErrno, syscall.EADDRINUSE) {
+		return true
+	}
+	const WSAEADDRINUSE = 10048
+	if runtime.GOOS == "windows" && errErrno == WSAEADDRINUSE {
+		return true
+	}
+	return false
+}
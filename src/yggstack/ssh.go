@@ -0,0 +1,401 @@
+package yggstack
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/yggdrasil-network/yggstack/src/types"
+)
+
+// Give up on SSH handshakes and logins after this long
+var sshHandshakeTimeout = 30 * time.Second
+
+// SSHServerOptions configures the embedded SSH server
+type SSHServerOptions struct {
+	Listen         *net.TCPAddr     // Yggdrasil port to listen on
+	AuthorizedKeys string           // OpenSSH authorized_keys file with the keys of the users
+	AllowedKeys    types.PublicKeys // Remote nodes whose users log in without any SSH key
+	Shell          string           // Defaults to $SHELL, or /bin/sh
+}
+
+// AddSSHServer starts an SSH server on a Yggdrasil port, for access to
+// the machine where no other SSH server can run. It offers shells and
+// commands without terminals, and port forwarding which dials and
+// listens through the netstack. The host key is the node's key.
+func (n *Node) AddSSHServer(options SSHServerOptions) error {
+	var authorized []ssh.PublicKey
+	if options.AuthorizedKeys != "" {
+		var err error
+		if authorized, err = types.LoadAuthorizedKeys(options.AuthorizedKeys); err != nil {
+			return fmt.Errorf("types.LoadAuthorizedKeys: %w", err)
+		}
+	}
+	if len(authorized) == 0 && len(options.AllowedKeys) == 0 {
+		return fmt.Errorf("SSH server needs authorized keys or allowed public keys")
+	}
+	if options.Shell == "" {
+		options.Shell = defaultShell()
+	}
+	return n.whenStarted(func() error {
+		signer, err := ssh.NewSignerFromKey(ed25519.PrivateKey(n.cfg.PrivateKey))
+		if err != nil {
+			return fmt.Errorf("ssh.NewSignerFromKey: %w", err)
+		}
+		config := &ssh.ServerConfig{ServerVersion: "SSH-2.0-yggstack"}
+		config.AddHostKey(signer)
+		if len(authorized) > 0 {
+			config.PublicKeyCallback = func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+				for _, k := range authorized {
+					if bytes.Equal(k.Marshal(), key.Marshal()) {
+						return sshPermissions("key " + ssh.FingerprintSHA256(key)), nil
+					}
+				}
+				return nil, fmt.Errorf("key %s is not authorized", ssh.FingerprintSHA256(key))
+			}
+		}
+		if len(options.AllowedKeys) > 0 {
+			config.NoClientAuth = true
+			config.NoClientAuthCallback = func(meta ssh.ConnMetadata) (*ssh.Permissions, error) {
+				ip := addrIP(meta.RemoteAddr())
+				if ip == nil {
+					return nil, fmt.Errorf("no remote address")
+				}
+				// Only the node's own address, as the hosts on its
+				// subnet can be anyone
+				key := options.AllowedKeys.ForAddress(ip)
+				if key == nil {
+					return nil, fmt.Errorf("node %s is not allowed", ip)
+				}
+				return sshPermissions("public key " + hex.EncodeToString(key)), nil
+			}
+		}
+		listener, err := n.netstack.ListenTCP(options.Listen)
+		if err != nil {
+			return fmt.Errorf("n.netstack.ListenTCP: %w", err)
+		}
+		n.closers = append(n.closers, listener)
+		n.logger.Infof("Serving SSH on Yggdrasil TCP port %d", options.Listen.Port)
+		go func(listener net.Listener) {
+			for {
+				c, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go n.handleSSH(c, config, options.Shell)
+			}
+		}(&trackingListener{listener, &n.sessions})
+		return nil
+	})
+}
+
+func sshPermissions(auth string) *ssh.Permissions {
+	return &ssh.Permissions{Extensions: map[string]string{"auth": auth}}
+}
+
+// defaultShell returns the shell of the user running yggstack
+func defaultShell() string {
+	if runtime.GOOS == "windows" {
+		if shell := os.Getenv("COMSPEC"); shell != "" {
+			return shell
+		}
+		return "cmd.exe"
+	}
+	if shell := os.Getenv("SHELL"); shell != "" {
+		return shell
+	}
+	return "/bin/sh"
+}
+
+// sshConn is a logged in SSH connection. Its commands are killed and its
+// forwarded ports are closed when it ends.
+type sshConn struct {
+	node     *Node
+	ctx      context.Context
+	conn     *ssh.ServerConn
+	shell    string
+	mutex    sync.Mutex
+	forwards map[uint32]net.Listener
+}
+
+func (n *Node) handleSSH(c net.Conn, config *ssh.ServerConfig, shell string) {
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(sshHandshakeTimeout))
+	conn, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		n.logger.Debugf("SSH login from %s failed: %s", c.RemoteAddr(), err)
+		return
+	}
+	_ = c.SetDeadline(time.Time{})
+	defer conn.Close()
+	n.logger.Infof("SSH login of %s from %s by %s", conn.User(), conn.RemoteAddr(), conn.Permissions.Extensions["auth"])
+
+	ctx, cancel := context.WithCancel(n.ctx)
+	defer cancel()
+	s := &sshConn{
+		node:     n,
+		ctx:      ctx,
+		conn:     conn,
+		shell:    shell,
+		forwards: map[uint32]net.Listener{},
+	}
+	defer s.closeForwards()
+	go s.handleRequests(reqs)
+	for newChannel := range chans {
+		switch newChannel.ChannelType() {
+		case "session":
+			go s.session(newChannel)
+		case "direct-tcpip":
+			go s.directTCPIP(newChannel)
+		default:
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+		}
+	}
+}
+
+// session runs a shell or a command, once the client asks for one
+func (s *sshConn) session(newChannel ssh.NewChannel) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	var env []string
+	for req := range requests {
+		var cmd *exec.Cmd
+		switch req.Type {
+		case "env":
+			var payload struct{ Name, Value string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err == nil {
+				env = append(env, payload.Name+"="+payload.Value)
+			}
+			_ = req.Reply(err == nil, nil)
+			continue
+		case "shell":
+			cmd = exec.CommandContext(s.ctx, s.shell)
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			flag := "-c"
+			if runtime.GOOS == "windows" {
+				flag = "/C"
+			}
+			cmd = exec.CommandContext(s.ctx, s.shell, flag, payload.Command)
+		default:
+			// There are no terminals, subsystems or signals
+			_ = req.Reply(false, nil)
+			continue
+		}
+		_ = req.Reply(true, nil)
+		go ssh.DiscardRequests(requests)
+		cmd.Env = append(os.Environ(), env...)
+		if home, err := os.UserHomeDir(); err == nil {
+			cmd.Dir = home
+		}
+		status := runSSHCommand(cmd, channel)
+		_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+		return
+	}
+}
+
+// runSSHCommand runs the command with the channel as its standard input
+// and output, and returns its exit status
+func runSSHCommand(cmd *exec.Cmd, channel ssh.Channel) uint32 {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		_, _ = fmt.Fprintln(channel.Stderr(), err)
+		return 255
+	}
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+	if err = cmd.Start(); err != nil {
+		_, _ = fmt.Fprintln(channel.Stderr(), err)
+		return 127
+	}
+	go func() {
+		_, _ = io.Copy(stdin, channel)
+		_ = stdin.Close()
+	}()
+	var exitErr *exec.ExitError
+	switch err = cmd.Wait(); {
+	case err == nil:
+		return 0
+	case errors.As(err, &exitErr) && exitErr.ExitCode() >= 0:
+		return uint32(exitErr.ExitCode())
+	default:
+		return 255
+	}
+}
+
+// directTCPIP connects a channel to an address dialled through the
+// netstack, for local forwarding and SOCKS in the client
+func (s *sshConn) directTCPIP(newChannel ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, "malformed request")
+		return
+	}
+	address := net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+	conn, err := s.node.resolver.DialContext(s.ctx, "tcp", address)
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, ok := s.node.limitConn(fmt.Sprintf("SSH forwarding from %s to %s", s.conn.RemoteAddr(), address), conn)
+	if !ok {
+		_ = newChannel.Reject(ssh.ResourceShortage, "connection limit reached")
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	proxySSHChannel(channel, conn)
+}
+
+// handleRequests listens on Yggdrasil ports for remote forwarding
+func (s *sshConn) handleRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		var payload struct {
+			Addr string
+			Port uint32
+		}
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Port > 65535 {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		switch req.Type {
+		case "tcpip-forward":
+			port, err := s.forward(payload.Addr, payload.Port)
+			if err != nil {
+				s.node.logger.Debugf("SSH forwarding of port %d for %s failed: %s", payload.Port, s.conn.RemoteAddr(), err)
+				_ = req.Reply(false, nil)
+				continue
+			}
+			var reply []byte
+			if payload.Port == 0 {
+				reply = ssh.Marshal(struct{ Port uint32 }{port})
+			}
+			_ = req.Reply(true, reply)
+		case "cancel-tcpip-forward":
+			s.mutex.Lock()
+			listener, ok := s.forwards[payload.Port]
+			delete(s.forwards, payload.Port)
+			s.mutex.Unlock()
+			if ok {
+				_ = listener.Close()
+			}
+			_ = req.Reply(ok, nil)
+		default:
+			_ = req.Reply(false, nil)
+		}
+	}
+}
+
+// forward listens on a Yggdrasil port and passes the connections back to
+// the client, returning the port which is listened on
+func (s *sshConn) forward(addr string, port uint32) (uint32, error) {
+	listener, err := s.node.netstack.ListenTCP(&net.TCPAddr{Port: int(port)})
+	if err != nil {
+		return 0, err
+	}
+	port = uint32(listener.Addr().(*net.TCPAddr).Port)
+	s.mutex.Lock()
+	s.forwards[port] = listener
+	s.mutex.Unlock()
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.forwarded(c, addr, port)
+		}
+	}()
+	return port, nil
+}
+
+func (s *sshConn) forwarded(c net.Conn, addr string, port uint32) {
+	originHost, originPort, _ := net.SplitHostPort(c.RemoteAddr().String())
+	origin, _ := strconv.Atoi(originPort)
+	c, ok := s.node.limitConn(fmt.Sprintf("SSH forwarding from %s to %s", c.RemoteAddr(), s.conn.RemoteAddr()), c)
+	if !ok {
+		return
+	}
+	channel, requests, err := s.conn.OpenChannel("forwarded-tcpip", ssh.Marshal(struct {
+		Addr       string
+		Port       uint32
+		OriginAddr string
+		OriginPort uint32
+	}{addr, port, originHost, uint32(origin)}))
+	if err != nil {
+		_ = c.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	proxySSHChannel(channel, c)
+}
+
+func (s *sshConn) closeForwards() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for port, listener := range s.forwards {
+		_ = listener.Close()
+		delete(s.forwards, port)
+	}
+}
+
+// limitConn subjects a connection to the global limits and those of the
+// remote node, and closes it if they refuse it
+func (n *Node) limitConn(what string, conn net.Conn) (net.Conn, bool) {
+	limiters := n.limiters(n.keyLimiter(conn.RemoteAddr()))
+	if len(limiters) == 0 {
+		return conn, true
+	}
+	if !n.admit(what, limiters) {
+		_ = conn.Close()
+		return nil, false
+	}
+	return types.NewLimitedConn(conn, limiters), true
+}
+
+// proxySSHChannel copies between a channel and a connection until both
+// directions are done, passing on half-closes
+func proxySSHChannel(channel ssh.Channel, conn net.Conn) {
+	defer channel.Close()
+	defer conn.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(conn, channel)
+		if hc, ok := conn.(interface{ CloseWrite() error }); !ok || errors.Is(hc.CloseWrite(), errors.ErrUnsupported) {
+			_ = conn.Close()
+		}
+	}()
+	_, _ = io.Copy(channel, conn)
+	_ = channel.CloseWrite()
+	<-done
+}
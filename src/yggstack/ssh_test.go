@@ -0,0 +1,183 @@
+package yggstack
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/yggdrasil-network/yggstack/src/types"
+)
+
+// dialSSH logs in to the SSH server of the node on Yggdrasil port 22
+func dialSSH(t *testing.T, n *Node, auth ...ssh.AuthMethod) (*ssh.Client, error) {
+	t.Helper()
+	conn, err := n.Netstack().DialTCP(&net.TCPAddr{IP: n.Address(), Port: 22})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loginSSH(t, n, conn, auth...)
+}
+
+// loginSSH logs in to the SSH server of the node over the connection
+func loginSSH(t *testing.T, n *Node, conn net.Conn, auth ...ssh.AuthMethod) (*ssh.Client, error) {
+	t.Helper()
+	hostKey, err := ssh.NewPublicKey(n.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, "[200::]:22", &ssh.ClientConfig{
+		User:            "test",
+		Auth:            auth,
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	t.Cleanup(func() { _ = client.Close() })
+	return client, nil
+}
+
+func TestSSHServer(t *testing.T) {
+	n, _ := startEchoMapping(t)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizedKeys := filepath.Join(t.TempDir(), "authorized_keys")
+	if err = os.WriteFile(authorizedKeys, append([]byte("# test\n"), ssh.MarshalAuthorizedKey(signer.PublicKey())...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = n.AddSSHServer(SSHServerOptions{
+		Listen:         &net.TCPAddr{Port: 22},
+		AuthorizedKeys: authorizedKeys,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = dialSSH(t, n); err == nil {
+		t.Fatal("login without a key should fail")
+	}
+	client, err := dialSSH(t, n, ssh.PublicKeys(signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if runtime.GOOS != "windows" {
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := session.Output("echo hello")
+		if err != nil || strings.TrimSpace(string(out)) != "hello" {
+			t.Fatalf("unexpected output %q: %v", out, err)
+		}
+		session, err = client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var exitErr *ssh.ExitError
+		if err = session.Run("exit 3"); err == nil || !errors.As(err, &exitErr) || exitErr.ExitStatus() != 3 {
+			t.Fatalf("expected exit status 3, got %v", err)
+		}
+	}
+
+	// Local forwarding dials through the netstack
+	conn, err := client.Dial("tcp", net.JoinHostPort(n.Address().String(), "7"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	_ = conn.Close()
+
+	// Remote forwarding listens on a Yggdrasil port
+	listener, err := client.Listen("tcp", "[::]:2222")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		c, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(c, c)
+		_ = c.Close()
+	}()
+	conn, err = n.Netstack().DialTCP(&net.TCPAddr{IP: n.Address(), Port: 2222})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	_ = conn.Close()
+}
+
+func TestSSHServerYggdrasilKey(t *testing.T) {
+	n := newTestNode(t)
+	if err := n.AddSSHServer(SSHServerOptions{Listen: &net.TCPAddr{Port: 22}}); err == nil {
+		t.Fatal("SSH server without any way to log in should fail")
+	}
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startNode := func(allowSelf bool) *Node {
+		n := newTestNode(t)
+		allowed := types.PublicKeys{other}
+		if allowSelf {
+			allowed = append(allowed, ed25519.PrivateKey(n.cfg.PrivateKey).Public().(ed25519.PublicKey))
+		}
+		if err := n.AddSSHServer(SSHServerOptions{
+			Listen:      &net.TCPAddr{Port: 22},
+			AllowedKeys: allowed,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := n.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(n.Stop)
+		return n
+	}
+
+	// The connections come from the node itself
+	if _, err = dialSSH(t, startNode(false)); err == nil {
+		t.Fatal("login from a node which is not allowed should fail")
+	}
+	allowed := startNode(true)
+	client, err := dialSSH(t, allowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.NewSession(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hosts on the subnet of an allowed node are not the node
+	subnet := allowed.Netstack().Subnet()
+	host := make(net.IP, net.IPv6len)
+	copy(host, subnet.IP)
+	host[15] = 1
+	conn, err := allowed.Netstack().DialTCPWithBind(context.Background(), &net.TCPAddr{IP: host}, &net.TCPAddr{IP: allowed.Address(), Port: 22})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loginSSH(t, allowed, conn); err == nil {
+		t.Fatal("login from a subnet address of an allowed node should fail")
+	}
+	_ = conn.Close()
+}
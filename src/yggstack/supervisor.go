@@ -0,0 +1,304 @@
+package yggstack
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yggdrasil-network/yggstack/src/types"
+)
+
+var errStopping = errors.New("node is shutting down")
+
+// How mappings retry after their sockets fail
+var (
+	mappingRetryMin = 100 * time.Millisecond
+	mappingRetryMax = 30 * time.Second
+	acceptRetryMax  = time.Second
+)
+
+// MappingState is the state of a supervised mapping
+type MappingState int
+
+const (
+	MappingStarting MappingState = iota // Opening its socket
+	MappingActive                       // Forwarding traffic
+	MappingFailed                       // Waiting to retry after an error
+)
+
+func (s MappingState) String() string {
+	switch s {
+	case MappingStarting:
+		return "starting"
+	case MappingActive:
+		return "active"
+	case MappingFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// MappingStatus describes a supervised mapping
+type MappingStatus struct {
+	Name     string
+	State    MappingState
+	Err      error // Why the mapping last failed, if it did
+	Restarts int   // How often the socket was reopened
+	Since    time.Time
+	UDP      *types.UDPSessionStats         // Sessions of a UDP mapping
+	Targets  []types.TargetStats            // Targets of a TCP mapping
+	Routes   map[string][]types.TargetStats // Targets of the SNI routes by server name
+}
+
+// supervisedMapping runs a mapping and reopens its socket with a backoff
+// whenever it fails, so that one error doesn't take the node down
+type supervisedMapping struct {
+	node     *Node
+	name     string
+	packet   bool // Keeps working while the node drains on shutdown
+	listen   func() (io.Closer, error)
+	serve    func(*supervisedMapping, io.Closer) error
+	mutex    sync.Mutex
+	socket   io.Closer
+	state    MappingState
+	err      error
+	restarts int
+	since    time.Time
+	closed   chan struct{}
+	udp      atomic.Pointer[types.UDPSessionManager] // Sessions of a UDP mapping
+	limiter  *types.Limiter                          // Limits of a TCP mapping
+	balancer atomic.Pointer[types.Balancer]          // Targets of a TCP mapping
+	routes   atomic.Pointer[[]sniRoute]              // SNI routes of a remote TCP mapping
+}
+
+// superviseMapping opens the socket of a mapping with listen and hands
+// it to serve, which returns once the socket fails. If the socket can't
+// be opened at first, the error is returned under the fatal startup
+// policy, and retried in the background otherwise.
+func (n *Node) superviseMapping(name string, packet bool, listen func() (io.Closer, error), serve func(*supervisedMapping, io.Closer) error) error {
+	m := &supervisedMapping{
+		node:   n,
+		name:   name,
+		packet: packet,
+		listen: listen,
+		serve:  serve,
+		closed: make(chan struct{}),
+	}
+	if !packet {
+		m.limiter = types.NewLimiter("mapping "+name, n.config.limits.Mapping, n.logger)
+	}
+	m.setState(MappingStarting, nil)
+	socket, err := listen()
+	if err != nil {
+		if n.config.mappingPolicy != MappingPolicyRetry {
+			return err
+		}
+		m.setState(MappingFailed, err)
+	}
+	n.mappings = append(n.mappings, m)
+	n.closers = append(n.closers, m)
+	go m.run(socket)
+	return nil
+}
+
+func (m *supervisedMapping) run(socket io.Closer) {
+	backoff := mappingRetryMin
+	for {
+		if socket != nil {
+			m.mutex.Lock()
+			m.socket = socket
+			m.mutex.Unlock()
+			if m.isClosed() {
+				_ = socket.Close()
+				return
+			}
+			m.setState(MappingActive, nil)
+			started := time.Now()
+			err := m.serve(m, socket)
+			_ = socket.Close()
+			if m.isClosed() || m.node.stopping() {
+				return
+			}
+			if err == nil {
+				err = errors.New("stopped unexpectedly")
+			}
+			// A mapping which ran for a while starts over with short delays
+			if time.Since(started) > mappingRetryMax {
+				backoff = mappingRetryMin
+			}
+			m.setState(MappingFailed, err)
+		}
+		m.node.logger.Warnf("Mapping %s will restart in %s", m.name, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-m.closed:
+			return
+		}
+		if backoff *= 2; backoff > mappingRetryMax {
+			backoff = mappingRetryMax
+		}
+		m.setState(MappingStarting, nil)
+		var err error
+		if socket, err = m.listen(); err != nil {
+			m.setState(MappingFailed, err)
+			continue
+		}
+		m.mutex.Lock()
+		m.restarts++
+		m.mutex.Unlock()
+	}
+}
+
+func (m *supervisedMapping) setState(state MappingState, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if state == m.state && err == nil && !m.since.IsZero() {
+		return
+	}
+	m.state, m.since = state, time.Now()
+	if err != nil {
+		m.err = err
+	}
+	switch state {
+	case MappingFailed:
+		m.node.logger.Errorf("Mapping %s failed: %s", m.name, err)
+	case MappingActive:
+		m.node.logger.Debugf("Mapping %s is active", m.name)
+	case MappingStarting:
+		m.node.logger.Debugf("Mapping %s is starting", m.name)
+	}
+}
+
+func (m *supervisedMapping) status() MappingStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	status := MappingStatus{
+		Name:     m.name,
+		State:    m.state,
+		Err:      m.err,
+		Restarts: m.restarts,
+		Since:    m.since,
+	}
+	if sessions := m.udp.Load(); sessions != nil {
+		stats := sessions.Stats()
+		status.UDP = &stats
+	}
+	if balancer := m.balancer.Load(); balancer != nil {
+		status.Targets = balancer.Stats()
+	}
+	if routes := m.routes.Load(); routes != nil && len(*routes) > 0 {
+		status.Routes = make(map[string][]types.TargetStats, len(*routes))
+		for _, route := range *routes {
+			status.Routes[route.serverName] = route.balancer.Stats()
+		}
+	}
+	return status
+}
+
+func (m *supervisedMapping) isClosed() bool {
+	select {
+	case <-m.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops the mapping and closes its socket.
+func (m *supervisedMapping) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.isClosed() {
+		return nil
+	}
+	close(m.closed)
+	if m.socket != nil {
+		return m.socket.Close()
+	}
+	return nil
+}
+
+// accept waits for a connection, and rides out temporary errors such as
+// running out of file descriptors with a short backoff. Other errors
+// mean that the listener failed.
+func (m *supervisedMapping) accept(listener net.Listener) (net.Conn, error) {
+	backoff := mappingRetryMin
+	for {
+		c, err := listener.Accept()
+		if err == nil {
+			return c, nil
+		}
+		if !types.IsTemporary(err) || m.isClosed() || m.node.stopping() {
+			return nil, err
+		}
+		m.node.logger.Warnf("Mapping %s failed to accept, retrying in %s: %s", m.name, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-m.closed:
+			return nil, err
+		}
+		if backoff *= 2; backoff > acceptRetryMax {
+			backoff = acceptRetryMax
+		}
+	}
+}
+
+// Mappings returns the status of the supervised mappings
+func (n *Node) Mappings() []MappingStatus {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	statuses := make([]MappingStatus, 0, len(n.mappings))
+	for _, m := range n.mappings {
+		statuses = append(statuses, m.status())
+	}
+	return statuses
+}
+
+type GetMappingsRequest struct{}
+type GetMappingsResponse struct {
+	Mappings []MappingEntry `json:"mappings"`
+}
+type MappingEntry struct {
+	Name     string                         `json:"name"`
+	State    string                         `json:"state"`
+	Error    string                         `json:"error,omitempty"`
+	Restarts int                            `json:"restarts"`
+	Since    string                         `json:"since"`
+	UDP      *types.UDPSessionStats         `json:"udp,omitempty"`
+	Targets  []types.TargetStats            `json:"targets,omitempty"`
+	Routes   map[string][]types.TargetStats `json:"routes,omitempty"`
+}
+
+func (n *Node) setupMappingAdminHandlers() {
+	_ = n.admin.AddHandler(
+		"getMappings", "Show the state of port mappings", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetMappingsRequest{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			res := &GetMappingsResponse{Mappings: []MappingEntry{}}
+			for _, status := range n.Mappings() {
+				entry := MappingEntry{
+					Name:     status.Name,
+					State:    status.State.String(),
+					Restarts: status.Restarts,
+					Since:    status.Since.Format(time.RFC3339),
+					UDP:      status.UDP,
+					Targets:  status.Targets,
+					Routes:   status.Routes,
+				}
+				if status.Err != nil {
+					entry.Error = status.Err.Error()
+				}
+				res.Mappings = append(res.Mappings, entry)
+			}
+			return res, nil
+		},
+	)
+}
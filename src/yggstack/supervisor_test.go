@@ -0,0 +1,90 @@
+package yggstack
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/yggdrasil-network/yggstack/src/types"
+)
+
+func waitForMapping(t *testing.T, n *Node, check func(MappingStatus) bool) MappingStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		statuses := n.Mappings()
+		if len(statuses) != 1 {
+			t.Fatalf("expected one mapping, got %d", len(statuses))
+		}
+		if check(statuses[0]) {
+			return statuses[0]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("mapping did not reach the expected state, got %+v", statuses[0])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMappingStartupPolicy(t *testing.T) {
+	busy, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapping := types.TCPMapping{
+		Listen: busy.Addr().(*net.TCPAddr),
+		Mapped: &net.TCPAddr{IP: net.ParseIP("200::1"), Port: 80},
+	}
+
+	n := newTestNode(t)
+	if err := n.AddLocalTCPMapping(mapping); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Start(context.Background()); err == nil {
+		n.Stop()
+		t.Fatal("node should fail to start with a fatal mapping")
+	}
+
+	n = newTestNode(t, MappingPolicyRetry)
+	if err := n.AddLocalTCPMapping(mapping); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+	waitForMapping(t, n, func(s MappingStatus) bool { return s.State == MappingFailed && s.Err != nil })
+
+	// The mapping comes up once the port is free
+	_ = busy.Close()
+	status := waitForMapping(t, n, func(s MappingStatus) bool { return s.State == MappingActive })
+	if status.Restarts != 1 {
+		t.Fatalf("expected one restart, got %d", status.Restarts)
+	}
+}
+
+func TestMappingRestartsAfterFailure(t *testing.T) {
+	n := newTestNode(t)
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+	if err := n.AddRemoteUDPMapping(types.UDPMapping{
+		Listen: &net.UDPAddr{Port: 53},
+		Mapped: &net.UDPAddr{IP: net.IPv6loopback, Port: 53},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	waitForMapping(t, n, func(s MappingStatus) bool { return s.State == MappingActive })
+
+	// Break the socket behind the mapping's back
+	m := n.mappings[0]
+	m.mutex.Lock()
+	_ = m.socket.Close()
+	m.mutex.Unlock()
+	status := waitForMapping(t, n, func(s MappingStatus) bool { return s.State == MappingActive && s.Restarts == 1 })
+	if status.Err == nil {
+		t.Fatal("mapping should remember why it failed")
+	}
+}
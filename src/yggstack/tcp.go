@@ -0,0 +1,36 @@
+package yggstack
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/yggdrasil-network/yggstack/src/netstack"
+)
+
+// TCPStats returns the TCP counters of the netstack, to verify the
+// effect of the TCP options
+func (n *Node) TCPStats() (netstack.TCPStats, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.netstack == nil {
+		return netstack.TCPStats{}, fmt.Errorf("node is not started")
+	}
+	return n.netstack.TCPStats(), nil
+}
+
+type GetTCPStatsRequest struct{}
+type GetTCPStatsResponse netstack.TCPStats
+
+func (n *Node) setupTCPAdminHandlers() {
+	_ = n.admin.AddHandler(
+		"getTCPStats", "Show TCP counters of the netstack", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetTCPStatsRequest{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			res := GetTCPStatsResponse(n.netstack.TCPStats())
+			return &res, nil
+		},
+	)
+}
@@ -0,0 +1,41 @@
+package yggstack
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/yggdrasil-network/yggstack/src/types"
+)
+
+// Give up on TLS handshakes of mappings after this long
+var tlsHandshakeTimeout = 10 * time.Second
+
+// serverTLSConfig returns the configuration to terminate TLS on a remote
+// mapping with, using a certificate for the node's key unless one is
+// configured
+func (n *Node) serverTLSConfig(options *types.MappingTLS) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if options.CertFile != "" {
+		if cert, err = tls.LoadX509KeyPair(options.CertFile, options.KeyFile); err != nil {
+			return nil, fmt.Errorf("tls.LoadX509KeyPair: %w", err)
+		}
+	} else if cert, err = types.NodeCertificate(ed25519.PrivateKey(n.cfg.PrivateKey)); err != nil {
+		return nil, fmt.Errorf("types.NodeCertificate: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// handshakeTLS completes the handshake of a TLS connection up front, so
+// that a failure can be logged rather than breaking the proxied stream
+func (n *Node) handshakeTLS(conn *tls.Conn) error {
+	ctx, cancel := context.WithTimeout(n.ctx, tlsHandshakeTimeout)
+	defer cancel()
+	return conn.HandshakeContext(ctx)
+}
@@ -0,0 +1,141 @@
+package yggstack
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/yggdrasil-network/yggstack/src/types"
+)
+
+// AddTransparentProxy accepts TCP connections and UDP datagrams aimed at
+// 200::/7 which are redirected to the address by ip6tables, and forwards
+// them to their original destination through the netstack. TCP works
+// with both REDIRECT and TPROXY, while UDP, i.e. for DNS, requires TPROXY
+// and CAP_NET_ADMIN. This is only supported on Linux.
+func (n *Node) AddTransparentProxy(address string) error {
+	return n.whenStarted(func() error {
+		listener, err := listenTransparentTCP(address)
+		if err != nil {
+			return fmt.Errorf("listenTransparentTCP: %w", err)
+		}
+		n.closers = append(n.closers, listener)
+		n.logger.Infof("Starting transparent TCP proxy on %s", listener.Addr())
+		go func() {
+			for {
+				c, err := listener.Accept()
+				if err != nil {
+					n.acceptFailed(listener, err)
+					return
+				}
+				go n.handleTransparentTCP(c.(*net.TCPConn))
+			}
+		}()
+
+		udpConn, err := listenTransparentUDP(address)
+		if err != nil {
+			n.logger.Warnf("Transparent UDP proxy is not available: %s", err)
+			return nil
+		}
+		n.logger.Infof("Starting transparent UDP proxy on %s", udpConn.LocalAddr())
+		listen := func() (io.Closer, error) {
+			// The socket opened above serves first, so that a missing
+			// capability is only a warning
+			if udpConn != nil {
+				c := udpConn
+				udpConn = nil
+				return c, nil
+			}
+			c, err := listenTransparentUDP(address)
+			if err != nil {
+				return nil, fmt.Errorf("listenTransparentUDP: %w", err)
+			}
+			return c, nil
+		}
+		return n.superviseMapping("transparent UDP on "+address, true, listen, n.serveTransparentUDP)
+	})
+}
+
+func (n *Node) handleTransparentTCP(c *net.TCPConn) {
+	dst, err := originalDestination(c)
+	if err != nil || !types.IsYggdrasilIP(dst.IP) {
+		n.logger.Debugf("Rejecting transparent connection from %s to %s: not redirected to Yggdrasil", c.RemoteAddr(), c.LocalAddr())
+		_ = c.Close()
+		return
+	}
+	r, err := n.netstack.DialTCP(dst)
+	if err != nil {
+		n.logger.Debugf("Failed to connect to %s: %s", dst, err)
+		_ = c.Close()
+		return
+	}
+	n.proxyTCP(c, r, n.keyLimiter(r.RemoteAddr()))
+}
+
+// transparentUDPClient identifies a transparent UDP session by both the
+// client and the original destination, as a client may send to several
+type transparentUDPClient struct {
+	from, dst *net.UDPAddr
+}
+
+func (c *transparentUDPClient) Network() string { return "udp" }
+func (c *transparentUDPClient) String() string  { return c.from.String() + "|" + c.dst.String() }
+
+func (n *Node) serveTransparentUDP(m *supervisedMapping, socket io.Closer) error {
+	conn := socket.(*net.UDPConn)
+	mtu := n.core.MTU()
+	dial := func(client net.Addr) (net.Conn, error) {
+		if n.stopping() {
+			return nil, errStopping
+		}
+		dst := client.(*transparentUDPClient).dst
+		r, err := n.netstack.DialUDP(dst)
+		if err != nil {
+			n.logger.Debugf("Failed to connect to %s: %s", dst, err)
+			return nil, err
+		}
+		return r, nil
+	}
+	// Replies must come from the original destination, and later
+	// datagrams from the client may arrive on the reply socket rather
+	// than the listener, as the kernel prefers the connected socket
+	reply := func(client net.Addr) (net.Conn, error) {
+		c := client.(*transparentUDPClient)
+		r, err := dialTransparentUDP(c.dst, c.from)
+		if err != nil {
+			n.logger.Debugf("Failed to reply from %s to %s: %s", c.dst, c.from, err)
+			return nil, err
+		}
+		return r, nil
+	}
+	sessions := types.NewUDPSessionManagerWithReplies(mtu, dial, reply, n.config.udp)
+	m.udp.Store(sessions)
+	defer sessions.Close() // nolint:errcheck
+	buf := make([]byte, mtu)
+	oob := make([]byte, 1024)
+	backoff := mappingRetryMin
+	for {
+		nr, noob, _, from, err := conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			if !types.IsTemporary(err) {
+				return err
+			}
+			select {
+			case <-time.After(backoff):
+			case <-m.closed:
+				return err
+			}
+			if backoff *= 2; backoff > acceptRetryMax {
+				backoff = acceptRetryMax
+			}
+			continue
+		}
+		backoff = mappingRetryMin
+		dst, err := originalDestinationUDP(oob[:noob])
+		if err != nil || !types.IsYggdrasilIP(dst.IP) {
+			continue
+		}
+		_ = sessions.Forward(&transparentUDPClient{from: from, dst: dst}, buf[:nr])
+	}
+}
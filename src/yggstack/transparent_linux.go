@@ -0,0 +1,143 @@
+//go:build linux
+
+package yggstack
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h
+const ip6tSOOriginalDst = 80
+
+// transparentControl sets IPV6_TRANSPARENT on a socket, so that it can
+// accept connections redirected by TPROXY and bind to addresses which
+// aren't local. If required is false then a lack of CAP_NET_ADMIN is
+// ignored, as REDIRECT works without it.
+func transparentControl(required bool, opts ...int) func(string, string, syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+			if err != nil && !required {
+				err = nil
+			}
+			for _, opt := range opts {
+				if err != nil {
+					return
+				}
+				err = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, opt, 1)
+			}
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+// reuseAddrControl sets SO_REUSEADDR on a socket before the next control
+func reuseAddrControl(next func(string, string, syscall.RawConn) error) func(string, string, syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		}); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return err
+		}
+		return next(network, address, c)
+	}
+}
+
+func listenTransparentTCP(address string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: transparentControl(false)}
+	return lc.Listen(context.Background(), "tcp6", address)
+}
+
+func listenTransparentUDP(address string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: transparentControl(true, unix.IPV6_RECVORIGDSTADDR)}
+	// Reply sockets bind to the original destinations, which may share
+	// the listener's port
+	lc.Control = reuseAddrControl(lc.Control)
+	conn, err := lc.ListenPacket(context.Background(), "udp6", address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// dialTransparentUDP returns a socket bound to the original destination
+// of a datagram, so that replies appear to come from it
+func dialTransparentUDP(laddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	d := net.Dialer{
+		LocalAddr: laddr,
+		Control:   reuseAddrControl(transparentControl(true)),
+	}
+	conn, err := d.Dial("udp6", raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// originalDestination returns where a redirected connection was headed.
+// REDIRECT records it in conntrack, while TPROXY keeps it as the local
+// address of the connection.
+func originalDestination(c *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var sa unix.RawSockaddrInet6
+	size := uint32(unsafe.Sizeof(sa))
+	var errno syscall.Errno
+	if err = raw.Control(func(fd uintptr) {
+		_, _, errno = unix.Syscall6(unix.SYS_GETSOCKOPT, fd, unix.SOL_IPV6, ip6tSOOriginalDst,
+			uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&size)), 0)
+	}); err != nil {
+		return nil, err
+	}
+	if errno != 0 {
+		return c.LocalAddr().(*net.TCPAddr), nil
+	}
+	return &net.TCPAddr{
+		IP:   net.IP(sa.Addr[:]),
+		Port: sockaddrPort(sa.Port),
+	}, nil
+}
+
+// originalDestinationUDP returns the original destination of a datagram
+// redirected by TPROXY from its control messages
+func originalDestinationUDP(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level != unix.SOL_IPV6 || msg.Header.Type != unix.IPV6_ORIGDSTADDR {
+			continue
+		}
+		if len(msg.Data) < unix.SizeofSockaddrInet6 {
+			break
+		}
+		sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(&msg.Data[0]))
+		return &net.UDPAddr{
+			IP:   append(net.IP(nil), sa.Addr[:]...),
+			Port: sockaddrPort(sa.Port),
+		}, nil
+	}
+	return nil, fmt.Errorf("no original destination")
+}
+
+// sockaddrPort converts a port in network byte order
+func sockaddrPort(port uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return int(b[0])<<8 | int(b[1])
+}
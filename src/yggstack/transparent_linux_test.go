@@ -0,0 +1,79 @@
+//go:build linux
+
+package yggstack
+
+import (
+	"net"
+	"testing"
+)
+
+func TestOriginalDestination(t *testing.T) {
+	listener, err := listenTransparentTCP("[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	c, err := net.Dial("tcp6", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	a, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	// Without REDIRECT the original destination is the listener itself
+	dst, err := originalDestination(a.(*net.TCPConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst.String() != listener.Addr().String() {
+		t.Fatalf("expected %s, got %s", listener.Addr(), dst)
+	}
+}
+
+func TestOriginalDestinationUDP(t *testing.T) {
+	conn, err := listenTransparentUDP("[::1]:0")
+	if err != nil {
+		t.Skipf("IPV6_TRANSPARENT is not available: %s", err)
+	}
+	defer conn.Close()
+	c, err := net.Dial("udp6", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.Write([]byte("query")); err != nil {
+		t.Fatal(err)
+	}
+	buf, oob := make([]byte, 64), make([]byte, 1024)
+	n, noob, _, from, err := conn.ReadMsgUDP(buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "query" || from.String() != c.LocalAddr().String() {
+		t.Fatalf("unexpected datagram %q from %s", buf[:n], from)
+	}
+	dst, err := originalDestinationUDP(oob[:noob])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst.String() != conn.LocalAddr().String() {
+		t.Fatalf("expected %s, got %s", conn.LocalAddr(), dst)
+	}
+
+	// Replies come from the original destination
+	reply, err := dialTransparentUDP(dst, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reply.Close()
+	if _, err = reply.Write([]byte("answer")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err = c.Read(buf); err != nil || string(buf[:n]) != "answer" {
+		t.Fatalf("unexpected reply %q: %v", buf[:n], err)
+	}
+}
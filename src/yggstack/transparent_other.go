@@ -0,0 +1,30 @@
+//go:build !linux
+
+package yggstack
+
+import (
+	"fmt"
+	"net"
+)
+
+var errTransparentUnsupported = fmt.Errorf("transparent proxying is only supported on Linux")
+
+func listenTransparentTCP(address string) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+func listenTransparentUDP(address string) (*net.UDPConn, error) {
+	return nil, errTransparentUnsupported
+}
+
+func dialTransparentUDP(laddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errTransparentUnsupported
+}
+
+func originalDestination(c *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
+
+func originalDestinationUDP(oob []byte) (*net.UDPAddr, error) {
+	return nil, errTransparentUnsupported
+}
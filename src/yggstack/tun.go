@@ -0,0 +1,19 @@
+package yggstack
+
+import "fmt"
+
+// AddTUN attaches a TUN adapter with the given name and routes the
+// node's subnet to it, so that applications on the host can reach the
+// Yggdrasil network natively. This is only supported on Linux.
+func (n *Node) AddTUN(name string) error {
+	return n.whenStarted(func() error {
+		subnet := n.core.Subnet()
+		tun, err := n.netstack.AddTUN(name, subnet)
+		if err != nil {
+			return fmt.Errorf("n.netstack.AddTUN: %w", err)
+		}
+		n.closers = append(n.closers, tun)
+		n.logger.Infof("Routing subnet %s to TUN adapter %s", subnet.String(), tun.Name())
+		return nil
+	})
+}